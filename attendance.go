@@ -0,0 +1,596 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// ===== 扫码签到 =====
+// 教师为某个班级开始一次签到后，投影上显示每隔几秒更换的二维码，二维码中的令牌由场次密钥和时间窗口算出，
+// 转发给不在教室的同学很快就会过期。学生扫码后以名册身份签到，并且只接受教室局域网网段内的请求；
+// 同一台设备只能为一名学生签到。每次签到的记录保存在 .fire_attendance/<场次>.json，可按场次或按班级导出 CSV。
+
+type AttendanceConfig struct {
+	Rotate  int      `json:"rotate"`  // 二维码更换间隔（秒），默认 10
+	Subnets []string `json:"subnets"` // 允许签到的网段（CIDR），为空时取本机各网卡所在网段
+}
+
+type CheckIn struct {
+	Name   string `json:"name"`
+	Number string `json:"number,omitempty"`
+	Time   int64  `json:"time"`
+	IP     string `json:"ip"`
+}
+
+type AttendanceRecord struct {
+	ID      string    `json:"id"`
+	Class   string    `json:"class"`
+	Started int64     `json:"started"`
+	Ended   int64     `json:"ended,omitempty"`
+	Present []CheckIn `json:"present"`
+}
+
+type attendanceSession struct {
+	AttendanceRecord
+	secret  []byte
+	byIP    map[string]string // 设备 IP -> 已签到学生
+	watches map[chan struct{}]bool
+}
+
+// 进行中的签到；结束后只保留文件记录
+var attendance = struct {
+	sync.Mutex
+	sessions map[string]*attendanceSession
+	stop     chan struct{}
+}{sessions: make(map[string]*attendanceSession)}
+
+// 扫码后凭票完成签到的时限（学生可能需要先输入 PIN 加入班级）
+const checkinTicketTTL = 3 * time.Minute
+
+func attendanceDir() string {
+	return metaPath(".fire_attendance")
+}
+
+func rotateInterval() time.Duration {
+	if n := getConfig().Attendance.Rotate; n >= 3 {
+		return time.Duration(n) * time.Second
+	}
+	return 10 * time.Second
+}
+
+func (s *attendanceSession) sign(parts ...string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(strings.Join(append([]string{s.ID}, parts...), "\x00")))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// 某个时间窗口的二维码令牌
+func (s *attendanceSession) token(window int64) string {
+	return s.sign("token", strconv.FormatInt(window, 10))
+}
+
+func currentWindow() int64 {
+	return time.Now().UnixNano() / int64(rotateInterval())
+}
+
+// 接受当前和上一个窗口，给扫码、联网留出余量
+func (s *attendanceSession) validToken(t string) bool {
+	w := currentWindow()
+	return t != "" && (hmac.Equal([]byte(t), []byte(s.token(w))) || hmac.Equal([]byte(t), []byte(s.token(w-1))))
+}
+
+func (s *attendanceSession) ticket() string {
+	exp := strconv.FormatInt(time.Now().Add(checkinTicketTTL).Unix(), 10)
+	return exp + "." + s.sign("ticket", exp)
+}
+
+func (s *attendanceSession) validTicket(t string) bool {
+	exp, sig, ok := strings.Cut(t, ".")
+	n, err := strconv.ParseInt(exp, 10, 64)
+	return ok && err == nil && time.Now().Unix() <= n && hmac.Equal([]byte(sig), []byte(s.sign("ticket", exp)))
+}
+
+func (s *attendanceSession) notify() {
+	for ch := range s.watches {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// 请求是否来自教室局域网
+func inClassroomSubnet(r *http.Request) bool {
+	ip := net.ParseIP(clientIP(r))
+	if ip == nil {
+		return false
+	}
+	if subnets := getConfig().Attendance.Subnets; len(subnets) > 0 {
+		for _, cidr := range subnets {
+			if _, n, err := net.ParseCIDR(cidr); err == nil && n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, a := range lanAddrs() {
+		if a.ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func saveAttendance(rec AttendanceRecord) error {
+	os.MkdirAll(attendanceDir(), 0755)
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	return writeHiddenJSON(filepath.Join(attendanceDir(), rec.ID+".json"), rec)
+}
+
+func loadAttendanceRecords(class string) []AttendanceRecord {
+	var list []AttendanceRecord
+	entries, _ := os.ReadDir(attendanceDir())
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		var rec AttendanceRecord
+		if readJSONFile(filepath.Join(attendanceDir(), e.Name()), &rec) != nil || rec.ID == "" {
+			continue
+		}
+		if class == "" || rec.Class == class {
+			list = append(list, rec)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Started < list[j].Started })
+	return list
+}
+
+// 场次记录：进行中的从内存取，已结束的从文件取
+func findAttendanceRecord(id string) (AttendanceRecord, bool) {
+	attendance.Lock()
+	if s := attendance.sessions[id]; s != nil {
+		rec := s.AttendanceRecord
+		rec.Present = append([]CheckIn(nil), s.Present...)
+		attendance.Unlock()
+		return rec, true
+	}
+	attendance.Unlock()
+	var rec AttendanceRecord
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return rec, false
+	}
+	err := readJSONFile(filepath.Join(attendanceDir(), id+".json"), &rec)
+	return rec, err == nil && rec.ID != ""
+}
+
+// 开始签到；该班已有进行中的签到时直接返回它
+func startAttendance(class string) (*attendanceSession, error) {
+	if loadRoster().Classes[class] == nil {
+		return nil, errors.New("班级不存在: " + class)
+	}
+	attendance.Lock()
+	defer attendance.Unlock()
+	for _, s := range attendance.sessions {
+		if s.Class == class {
+			return s, nil
+		}
+	}
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	s := &attendanceSession{
+		AttendanceRecord: AttendanceRecord{ID: time.Now().Format("20060102-150405") + "-" + randomToken(3), Class: class, Started: time.Now().Unix(), Present: []CheckIn{}},
+		secret:           secret,
+		byIP:             make(map[string]string),
+		watches:          make(map[chan struct{}]bool),
+	}
+	attendance.sessions[s.ID] = s
+	return s, saveAttendance(s.AttendanceRecord)
+}
+
+func stopAttendance(id string) (AttendanceRecord, error) {
+	attendance.Lock()
+	s := attendance.sessions[id]
+	if s == nil {
+		attendance.Unlock()
+		return AttendanceRecord{}, errors.New("签到不存在或已结束: " + id)
+	}
+	delete(attendance.sessions, id)
+	s.Ended = time.Now().Unix()
+	s.notify()
+	rec := s.AttendanceRecord
+	attendance.Unlock()
+	return rec, saveAttendance(rec)
+}
+
+// 让所有签到推送流结束（服务退出时调用）
+func closeAttendanceStreams() {
+	attendance.Lock()
+	defer attendance.Unlock()
+	if attendance.stop != nil {
+		close(attendance.stop)
+		attendance.stop = nil
+	}
+}
+
+// 开始签到：POST ?class=
+func handleAttendanceStart(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+		return
+	}
+	s, err := startAttendance(r.URL.Query().Get("class"))
+	if s == nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError("保存签到记录失败", err)
+	}
+	auditLog(r, "attendance.start", s.Class, auditDetail("session", s.ID))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"session": s.ID, "class": s.Class})
+}
+
+// 结束签到：POST ?session=
+func handleAttendanceStop(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+		return
+	}
+	rec, err := stopAttendance(r.URL.Query().Get("session"))
+	if rec.ID == "" {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logError("保存签到记录失败", err)
+		http.Error(w, "保存签到记录失败", http.StatusInternalServerError)
+		return
+	}
+	auditLog(r, "attendance.stop", rec.Class, auditDetail("session", rec.ID, "present", len(rec.Present)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec)
+}
+
+type attendanceLive struct {
+	Session string    `json:"session"`
+	Class   string    `json:"class"`
+	Open    bool      `json:"open"`
+	Count   int       `json:"count"`
+	Total   int       `json:"total"`
+	URL     string    `json:"url,omitempty"`
+	QR      string    `json:"qr,omitempty"`
+	Expires int64     `json:"expires,omitempty"` // 当前二维码失效时间（Unix 毫秒）
+	Recent  []CheckIn `json:"recent"`            // 最近签到的学生，最新的在前
+}
+
+// 投影端推送流（SSE）：每次更换二维码和每次有人签到时推送
+func handleAttendanceLive(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "不支持推送", http.StatusInternalServerError)
+		return
+	}
+	attendance.Lock()
+	s := attendance.sessions[r.URL.Query().Get("session")]
+	if s == nil {
+		attendance.Unlock()
+		http.Error(w, "签到不存在或已结束", http.StatusNotFound)
+		return
+	}
+	ch := make(chan struct{}, 1)
+	s.watches[ch] = true
+	if attendance.stop == nil {
+		attendance.stop = make(chan struct{})
+	}
+	stop := attendance.stop
+	attendance.Unlock()
+	defer func() {
+		attendance.Lock()
+		delete(s.watches, ch)
+		attendance.Unlock()
+	}()
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	total := 0
+	if c := loadRoster().Classes[s.Class]; c != nil {
+		total = len(c.Students)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	interval := rotateInterval()
+	ch <- struct{}{}
+	for {
+		select {
+		case <-ch:
+		case <-time.After(time.Until(time.Unix(0, (currentWindow()+1)*int64(interval)))):
+		case <-stop:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		window := currentWindow()
+		attendance.Lock()
+		live := attendanceLive{Session: s.ID, Class: s.Class, Open: s.Ended == 0, Count: len(s.Present), Total: total, Recent: []CheckIn{}}
+		for i := len(s.Present) - 1; i >= 0 && len(live.Recent) < 8; i-- {
+			live.Recent = append(live.Recent, s.Present[i])
+		}
+		token := s.token(window)
+		attendance.Unlock()
+		if live.Open {
+			live.URL = fmt.Sprintf("%s://%s/checkin?s=%s&t=%s", scheme, r.Host, url.QueryEscape(s.ID), token)
+			if png, err := qrcode.Encode(live.URL, qrcode.Medium, 320); err == nil {
+				live.QR = base64.StdEncoding.EncodeToString(png)
+			}
+			live.Expires = (window + 1) * int64(interval) / int64(time.Millisecond)
+		}
+		data, _ := json.Marshal(live)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+		if !live.Open {
+			return
+		}
+	}
+}
+
+type checkinRequest struct {
+	Session string `json:"session"`
+	Token   string `json:"token"`  // 二维码中的令牌
+	Ticket  string `json:"ticket"` // 扫码后换得的凭票，先加入班级再签到时使用
+}
+
+type checkinResponse struct {
+	Status  string           `json:"status"` // ok / already / join
+	Class   string           `json:"class"`
+	Ticket  string           `json:"ticket,omitempty"`
+	Student *StudentIdentity `json:"student,omitempty"`
+	Time    int64            `json:"time,omitempty"`
+}
+
+// 学生签到：令牌或凭票有效、来自教室网段、名册身份属于该班
+func handleAttendanceCheckin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+		return
+	}
+	var req checkinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad JSON", 400)
+		return
+	}
+	if !inClassroomSubnet(r) {
+		http.Error(w, "请连接教室的无线网络后再签到", http.StatusForbidden)
+		return
+	}
+	ip := clientIP(r)
+	id, joined := studentIdentity(r)
+
+	attendance.Lock()
+	s := attendance.sessions[req.Session]
+	if s == nil {
+		attendance.Unlock()
+		http.Error(w, "签到已结束", http.StatusNotFound)
+		return
+	}
+	if !s.validToken(req.Token) && !s.validTicket(req.Ticket) {
+		attendance.Unlock()
+		http.Error(w, "二维码已过期，请重新扫描投影上的二维码", http.StatusForbidden)
+		return
+	}
+	resp := checkinResponse{Class: s.Class}
+	if !joined {
+		resp.Status, resp.Ticket = "join", s.ticket()
+		attendance.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+	if id.Class != s.Class {
+		attendance.Unlock()
+		http.Error(w, "你不在「"+s.Class+"」的名册中", http.StatusForbidden)
+		return
+	}
+	resp.Student = &id
+	label := id.label()
+	for _, c := range s.Present {
+		if c.Name == id.Name && c.Number == id.Number {
+			resp.Status, resp.Time = "already", c.Time
+			attendance.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+	}
+	if other, used := s.byIP[ip]; used && other != label {
+		attendance.Unlock()
+		http.Error(w, "这台设备已为其他同学签到", http.StatusConflict)
+		return
+	}
+	s.byIP[ip] = label
+	c := CheckIn{Name: id.Name, Number: id.Number, Time: time.Now().Unix(), IP: ip}
+	s.Present = append(s.Present, c)
+	s.notify()
+	rec := s.AttendanceRecord
+	rec.Present = append([]CheckIn(nil), s.Present...)
+	attendance.Unlock()
+
+	if err := saveAttendance(rec); err != nil {
+		logError("保存签到记录失败", err)
+	}
+	auditLog(r, "attendance.checkin", rec.Class, auditDetail("session", rec.ID))
+	resp.Status, resp.Time = "ok", c.Time
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// 签到记录列表（教师端），可按 ?class= 过滤
+func handleAttendanceSessions(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	type info struct {
+		ID      string `json:"id"`
+		Class   string `json:"class"`
+		Started int64  `json:"started"`
+		Ended   int64  `json:"ended,omitempty"`
+		Present int    `json:"present"`
+		Open    bool   `json:"open,omitempty"`
+	}
+	attendance.Lock()
+	open := make(map[string]bool)
+	for id := range attendance.sessions {
+		open[id] = true
+	}
+	attendance.Unlock()
+	list := []info{}
+	records := loadAttendanceRecords(r.URL.Query().Get("class"))
+	for i := len(records) - 1; i >= 0; i-- {
+		rec := records[i]
+		list = append(list, info{rec.ID, rec.Class, rec.Started, rec.Ended, len(rec.Present), open[rec.ID]})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func studentKey(name, number string) string {
+	if number != "" {
+		return number
+	}
+	return name
+}
+
+// 导出 CSV：?session= 导出一次签到（含缺勤学生），?class= 导出该班全部签到的出勤表
+func handleAttendanceExport(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	var rows [][]string
+	var fileName, target string
+	if id := r.URL.Query().Get("session"); id != "" {
+		rec, ok := findAttendanceRecord(id)
+		if !ok {
+			http.Error(w, "签到记录不存在", http.StatusNotFound)
+			return
+		}
+		rows, fileName, target = sessionAttendanceRows(rec), rec.Class+"-"+rec.ID+".csv", rec.Class
+	} else {
+		class := r.URL.Query().Get("class")
+		records := loadAttendanceRecords(class)
+		if class == "" || (len(records) == 0 && loadRoster().Classes[class] == nil) {
+			http.Error(w, "班级不存在: "+class, http.StatusNotFound)
+			return
+		}
+		rows, fileName, target = classAttendanceRows(class, records), class+"-出勤表.csv", class
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(fileName))
+	cw := newExcelCSV(w)
+	cw.WriteAll(rows)
+	auditLog(r, "attendance.export", target, "")
+}
+
+func sessionAttendanceRows(rec AttendanceRecord) [][]string {
+	rows := [][]string{{"学号", "姓名", "状态", "签到时间", "IP"}}
+	present := make(map[string]CheckIn)
+	for _, c := range rec.Present {
+		present[studentKey(c.Name, c.Number)] = c
+	}
+	listed := make(map[string]bool)
+	if c := loadRoster().Classes[rec.Class]; c != nil {
+		for _, s := range c.Students {
+			listed[s.key()] = true
+			if ci, ok := present[s.key()]; ok {
+				rows = append(rows, []string{s.Number, s.Name, "出勤", time.Unix(ci.Time, 0).Format("15:04:05"), ci.IP})
+			} else {
+				rows = append(rows, []string{s.Number, s.Name, "缺勤", "", ""})
+			}
+		}
+	}
+	// 签到后又从名册中删除的学生也保留在记录里
+	for _, ci := range rec.Present {
+		if !listed[studentKey(ci.Name, ci.Number)] {
+			rows = append(rows, []string{ci.Number, ci.Name, "出勤", time.Unix(ci.Time, 0).Format("15:04:05"), ci.IP})
+		}
+	}
+	return rows
+}
+
+// 出勤表：每名学生一行，每次签到一列
+func classAttendanceRows(class string, records []AttendanceRecord) [][]string {
+	header := []string{"学号", "姓名"}
+	for _, rec := range records {
+		header = append(header, time.Unix(rec.Started, 0).Format("01-02 15:04"))
+	}
+	header = append(header, "出勤次数")
+	rows := [][]string{header}
+
+	type student struct{ number, name string }
+	var students []student
+	seen := make(map[string]bool)
+	if c := loadRoster().Classes[class]; c != nil {
+		for _, s := range c.Students {
+			students = append(students, student{s.Number, s.Name})
+			seen[s.key()] = true
+		}
+	}
+	presence := make([]map[string]bool, len(records))
+	for i, rec := range records {
+		presence[i] = make(map[string]bool)
+		for _, ci := range rec.Present {
+			key := studentKey(ci.Name, ci.Number)
+			presence[i][key] = true
+			if !seen[key] {
+				seen[key] = true
+				students = append(students, student{ci.Number, ci.Name})
+			}
+		}
+	}
+	for _, s := range students {
+		row := []string{s.number, s.name}
+		count := 0
+		for i := range records {
+			if presence[i][studentKey(s.name, s.number)] {
+				row = append(row, "✓")
+				count++
+			} else {
+				row = append(row, "")
+			}
+		}
+		rows = append(rows, append(row, strconv.Itoa(count)))
+	}
+	return rows
+}
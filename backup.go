@@ -0,0 +1,567 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== 元数据备份 =====
+// 把根目录下所有 .fire_* 元数据打成一个 zip。日志和可以重新扫描生成的哈希索引、媒体信息缓存不在其中。
+// 备份常被拷到 U 盘等移动介质，默认不含密钥类数据：HTTPS 的 CA 私钥、账号密码哈希、名册的签名密钥和学生 PIN，
+// 以及配置中的同步订阅密码和监控令牌；
+// 确需整机迁移时设置 backup.secrets 才一并打包。还原不含这些数据的备份时沿用本机现有的。
+// 配置了 folders 时，这些素材文件夹也一并打包，放在 zip 内的 files/ 下。
+// 定时备份写到 backup.dest（例如另一块硬盘），按 keep / keepDays 清理旧备份。
+
+type BackupConfig struct {
+	Dest     string   `json:"dest"`     // 备份目录，须为绝对路径
+	Interval int      `json:"interval"` // 定时备份间隔（小时），0 表示只手动备份
+	Keep     int      `json:"keep"`     // 最多保留的份数，默认 10
+	KeepDays int      `json:"keepDays"` // 超过天数的备份删除（最新一份总是保留），0 表示不限
+	Folders  []string `json:"folders"`  // 一并备份的素材文件夹
+	Secrets  bool     `json:"secrets"`  // 包含 CA 私钥、账号密码哈希、名册签名密钥、PIN、同步密码和监控令牌，默认不包含
+}
+
+type BackupArchive struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	Created int64  `json:"created"`
+}
+
+// 还原时每个条目的变化；dry-run 只返回这些而不写入
+type RestoreChange struct {
+	Path   string `json:"path"`
+	Action string `json:"action"` // create / overwrite / unchanged
+	Size   int64  `json:"size"`
+}
+
+const (
+	backupPrefix      = "firecloud-backup-"
+	backupFilesPrefix = "files/"
+	defaultBackupKeep = 10
+)
+
+var backupMu sync.Mutex // 同一时间只做一次备份或还原
+
+func backupExcluded(name string) bool {
+	return name == ".fire_logs" || name == ".fire_index.json" || name == ".fire_mediainfo.json" ||
+		strings.HasSuffix(name, ".tmp") // writeFileAtomic 中途留下的临时文件
+}
+
+// 只在 backup.secrets 开启时打包的元数据项
+func backupSecret(name string) bool {
+	return name == ".fire_tls" || name == ".fire_users.json"
+}
+
+// 根目录下参与备份的顶层元数据项
+func metadataEntries() []string {
+	entries, err := os.ReadDir(rootDir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".fire_") && !backupExcluded(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 把 base（文件或目录）写入 zip，条目名为 prefix 或 prefix/相对路径；skipMeta 时跳过其中的 .fire_* 元数据
+func zipTree(zw *zip.Writer, base, prefix string, skipMeta bool) (int, error) {
+	count := 0
+	err := filepath.WalkDir(base, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if skipMeta && p != base && isMetaPath(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(base, p)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = prefix
+		if rel != "." {
+			hdr.Name += "/" + filepath.ToSlash(rel)
+		}
+		hdr.Method = zip.Deflate
+		if !isCompressible(p) {
+			hdr.Method = zip.Store // 视频、图片本身已压缩
+		}
+		dst, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		if _, err := io.Copy(dst, src); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// 配置去掉同步订阅密码和监控令牌后写入 zip（调用方持有 metaMu）
+func zipConfigWithoutSecrets(zw *zip.Writer) (int, error) {
+	info, err := os.Stat(configFile())
+	if err != nil {
+		return 0, err
+	}
+	var c Config
+	if err := readJSONFile(configFile(), &c); err != nil {
+		return 0, err
+	}
+	for i := range c.Sync {
+		c.Sync[i].Password = ""
+	}
+	c.Metrics.Token = ""
+	data, err := json.Marshal(c)
+	if err != nil {
+		return 0, err
+	}
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: configFileName, Method: zip.Deflate, Modified: info.ModTime()})
+	if err != nil {
+		return 0, err
+	}
+	_, err = w.Write(data)
+	return 1, err
+}
+
+// 还原配置：备份中为空的同步密码沿用本机同一本机文件夹、同一对方地址的订阅，
+// 为空的监控令牌沿用本机的（调用方持有 metaMu）
+func restoreConfig(w io.Writer, src io.Reader) error {
+	var c Config
+	if err := json.NewDecoder(src).Decode(&c); err != nil {
+		return err
+	}
+	var cur Config
+	readJSONFile(configFile(), &cur)
+	for i := range c.Sync {
+		s := &c.Sync[i]
+		for _, o := range cur.Sync {
+			if s.Password == "" && o.localFolder() == s.localFolder() && o.Remote == s.Remote && o.User == s.User {
+				s.Password = o.Password
+			}
+		}
+	}
+	if c.Metrics.Token == "" {
+		c.Metrics.Token = cur.Metrics.Token
+	}
+	return json.NewEncoder(w).Encode(c)
+}
+
+func isCompressible(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json", ".md", ".txt", ".html", ".htm", ".css", ".js", ".csv", ".svg":
+		return true
+	}
+	return false
+}
+
+// 写出备份 zip，返回打包的文件数。folders 为一并备份的素材文件夹
+func writeBackup(w io.Writer, folders []string) (int, error) {
+	zw := zip.NewWriter(w)
+	count := 0
+	secrets := getConfig().Backup.Secrets
+	metaMu.Lock()
+	for _, name := range metadataEntries() {
+		if !secrets && backupSecret(name) {
+			continue
+		}
+		var n int
+		var err error
+		switch {
+		case name == rosterFileName && !secrets:
+			n, err = zipRosterWithoutSecrets(zw)
+		case name == configFileName && !secrets:
+			n, err = zipConfigWithoutSecrets(zw)
+		default:
+			n, err = zipTree(zw, metaPath(name), name, false)
+		}
+		count += n
+		if err != nil {
+			metaMu.Unlock()
+			zw.Close()
+			return count, err
+		}
+	}
+	metaMu.Unlock()
+	// 素材文件夹可能很大，打包时不占用元数据锁
+	for _, folder := range folders {
+		folder = cleanRelPath(folder)
+		absPath, ok := resolvePath(folder)
+		if folder == "" || !ok {
+			continue
+		}
+		n, err := zipTree(zw, absPath, backupFilesPrefix+folder, true)
+		count += n
+		if err != nil {
+			zw.Close()
+			return count, err
+		}
+	}
+	return count, zw.Close()
+}
+
+// 检查备份中的条目名：.fire_* 元数据还原到根目录，files/ 下的素材还原到素材库中的原路径
+func backupEntryPath(name string) (string, error) {
+	if strings.HasPrefix(name, backupFilesPrefix) {
+		rel := strings.TrimPrefix(name, backupFilesPrefix)
+		clean := cleanRelPath(rel)
+		absPath, ok := resolvePath(clean)
+		if clean != rel || clean == "" || !ok {
+			return "", errors.New("备份中含有非法条目: " + name)
+		}
+		if m, _ := splitMount(clean); m != nil && m.ReadOnly {
+			return "", errors.New("无法还原到只读挂载点: " + name)
+		}
+		return absPath, nil
+	}
+	clean := cleanRelPath(name)
+	top := strings.SplitN(clean, "/", 2)[0]
+	if clean != name || !strings.HasPrefix(top, ".fire_") || backupExcluded(top) {
+		return "", errors.New("备份中含有非法条目: " + name)
+	}
+	return filepath.Join(rootDir, filepath.FromSlash(clean)), nil
+}
+
+// 与磁盘上现有文件比较（zip 中已有 CRC32，无需解压）
+func restoreAction(f *zip.File, dst string) string {
+	info, err := os.Stat(dst)
+	if err != nil {
+		return "create"
+	}
+	if uint64(info.Size()) != f.UncompressedSize64 {
+		return "overwrite"
+	}
+	src, err := os.Open(dst)
+	if err != nil {
+		return "overwrite"
+	}
+	defer src.Close()
+	h := crc32.NewIEEE()
+	io.Copy(h, src)
+	if h.Sum32() == f.CRC32 {
+		return "unchanged"
+	}
+	return "overwrite"
+}
+
+// 从备份 zip 还原，覆盖有变化的文件，返回每个条目的变化。dryRun 时只比较不写入
+func restoreBackup(zipPath string, dryRun bool) ([]RestoreChange, error) {
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if _, err := backupEntryPath(f.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	var changes []RestoreChange
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		dst, _ := backupEntryPath(f.Name)
+		change := RestoreChange{Path: f.Name, Action: restoreAction(f, dst), Size: int64(f.UncompressedSize64)}
+		changes = append(changes, change)
+		if dryRun || change.Action == "unchanged" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return changes, err
+		}
+		src, err := f.Open()
+		if err != nil {
+			return changes, err
+		}
+		// 先写临时文件再替换，还原中途出错时正在使用的配置、账号等不会被截断
+		err = writeFileAtomic(dst, 0644, func(w io.Writer) error {
+			switch f.Name {
+			case rosterFileName:
+				return restoreRoster(w, src)
+			case configFileName:
+				return restoreConfig(w, src)
+			}
+			_, err := io.Copy(w, src)
+			return err
+		})
+		src.Close()
+		if err != nil {
+			return changes, err
+		}
+		os.Chtimes(dst, f.Modified, f.Modified)
+	}
+	if dryRun {
+		return changes, nil
+	}
+	if runtime.GOOS == "windows" {
+		for _, name := range metadataEntries() {
+			exec.Command("attrib", "+h", metaPath(name)).Run()
+		}
+	}
+	dataVersion.Add(1)
+	return changes, nil
+}
+
+// ===== 备份目录与定时备份 =====
+
+func backupDest() (string, error) {
+	dest := getConfig().Backup.Dest
+	if dest == "" || !filepath.IsAbs(dest) {
+		return "", errors.New("未配置备份目录（backup.dest，须为绝对路径）")
+	}
+	if isWithin(rootDir, dest) {
+		return "", errors.New("备份目录不能位于根目录之内")
+	}
+	return dest, os.MkdirAll(dest, 0755)
+}
+
+// 备份目录中的备份，按时间从新到旧
+func listBackups() ([]BackupArchive, error) {
+	dest, err := backupDest()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		return nil, err
+	}
+	list := []BackupArchive{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), backupPrefix) || !strings.HasSuffix(e.Name(), ".zip") {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			list = append(list, BackupArchive{Name: e.Name(), Size: info.Size(), Created: info.ModTime().Unix()})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name > list[j].Name })
+	return list, nil
+}
+
+// 在备份目录写一份新备份并按保留规则清理，返回备份文件名
+func runBackup(source string) (string, int, error) {
+	backupMu.Lock()
+	defer backupMu.Unlock()
+	dest, err := backupDest()
+	if err != nil {
+		return "", 0, err
+	}
+	cfg := getConfig().Backup
+	name := backupPrefix + time.Now().Format("20060102-150405") + ".zip"
+	tmp := filepath.Join(dest, name+".partial")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", 0, err
+	}
+	n, err := writeBackup(stopWriter{backgroundCtx(), f}, cfg.Folders)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dest, name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		logError("备份失败", err)
+		return "", n, err
+	}
+	removed := pruneBackups(cfg)
+	appLog.write(LogEntry{Type: "audit", Action: "backup.create", Target: name,
+		Detail: auditDetail("files", n, "pruned", removed, "source", source)})
+	return name, n, nil
+}
+
+// 按保留份数和天数删除旧备份，最新一份总是保留
+func pruneBackups(cfg BackupConfig) int {
+	list, err := listBackups()
+	if err != nil {
+		return 0
+	}
+	keep := cfg.Keep
+	if keep <= 0 {
+		keep = defaultBackupKeep
+	}
+	cutoff := time.Now().AddDate(0, 0, -cfg.KeepDays).Unix()
+	removed := 0
+	for i, b := range list {
+		if i == 0 {
+			continue
+		}
+		if i >= keep || (cfg.KeepDays > 0 && b.Created < cutoff) {
+			if os.Remove(filepath.Join(cfg.Dest, b.Name)) == nil {
+				removed++
+			}
+		}
+	}
+	return removed
+}
+
+// 服务停止后写入失败，进行中的备份随之放弃（.partial 文件会被删除）
+type stopWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (s stopWriter) Write(p []byte) (int, error) {
+	if err := s.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return s.w.Write(p)
+}
+
+// 定时备份：距最新一份超过间隔时备份一次，服务停止时退出
+func startBackupScheduler() {
+	goBackground(func(ctx context.Context) {
+		for {
+			if cfg := getConfig().Backup; cfg.Interval > 0 && cfg.Dest != "" {
+				list, err := listBackups()
+				if err == nil && (len(list) == 0 || time.Since(time.Unix(list[0].Created, 0)) >= time.Duration(cfg.Interval)*time.Hour) {
+					runBackup("schedule")
+				}
+			}
+			if !sleepOrStop(ctx, 5*time.Minute) {
+				return
+			}
+		}
+	})
+}
+
+// 备份目录中的文件名，禁止带路径
+func backupArchivePath(name string) (string, error) {
+	dest, err := backupDest()
+	if err != nil {
+		return "", err
+	}
+	if name == "" || name != filepath.Base(name) || !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, ".zip") {
+		return "", fmt.Errorf("备份文件名无效: %s", name)
+	}
+	return filepath.Join(dest, name), nil
+}
+
+// ===== 备份 API（仅限教师端） =====
+
+// GET 列出备份目录中的备份，POST 立即备份
+func handleBackups(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		list, err := listBackups()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case http.MethodPost:
+		name, n, err := runBackup("api")
+		if err != nil {
+			http.Error(w, "备份失败: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		auditLog(r, "backup.create", name, auditDetail("files", n))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "files": n})
+	default:
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+	}
+}
+
+// 直接下载一份即时备份（不写入备份目录）
+func handleBackupDownload(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	name := backupPrefix + time.Now().Format("20060102-150405") + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	n, err := writeBackup(w, getConfig().Backup.Folders)
+	if err != nil {
+		logError("下载备份失败", err)
+		return
+	}
+	auditLog(r, "backup.download", name, auditDetail("files", n))
+}
+
+// 还原：POST /api/backup/restore?name=备份文件名[&dryRun=1]
+func handleBackupRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireTeacher(w, r) {
+		return
+	}
+	name := r.URL.Query().Get("name")
+	dryRun := r.URL.Query().Get("dryRun") == "1"
+	zipPath, err := backupArchivePath(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	backupMu.Lock()
+	changes, err := restoreBackup(zipPath, dryRun)
+	backupMu.Unlock()
+	if err != nil {
+		http.Error(w, "还原失败: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	summary := map[string]int{}
+	for _, c := range changes {
+		summary[c.Action]++
+	}
+	if !dryRun {
+		loadConfig()
+		treeCache.mu.Lock()
+		treeCache.dropSubtree("")
+		treeCache.mu.Unlock()
+		auditLog(r, "backup.restore", name, auditDetail("create", summary["create"], "overwrite", summary["overwrite"]))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"dryRun": dryRun, "summary": summary, "changes": changes})
+}
@@ -0,0 +1,788 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ===== 命令行子命令 =====
+// 同一个 EXE 带参数运行时执行管理任务，不启动托盘和 HTTP 服务
+
+type cliCommand struct {
+	name  string
+	usage string
+	run   func(args []string) int
+}
+
+var cliCommands []cliCommand
+
+func init() {
+	cliCommands = []cliCommand{
+		{"serve", "无托盘运行 HTTP 服务（Linux 小主机、系统服务）", cliServe},
+		{"service", "安装或卸载系统服务: service install|uninstall", cliService},
+		{"index", "立即重建内容哈希索引并报告移动和重复文件", cliIndex},
+		{"check", "检查书签、标签和备课方案中的失效引用", cliCheck},
+		{"export-lesson", "导出备课方案及其使用的自定义模板: export-lesson <方案名> [-o 文件]", cliExportLesson},
+		{"import-lesson", "导入 export-lesson 生成的文件: import-lesson <文件> [-name 新名称]", cliImportLesson},
+		{"tags", "标签管理: tags list | rename <旧> <新> | merge <目标> <标签...>", cliTags},
+		{"sync", "立即执行配置中的同步订阅: sync [-local 文件夹]", cliSync},
+		{"backup", "把 .fire_* 元数据打包为 zip: backup [-o 文件] [-folders 文件夹,...]", cliBackup},
+		{"restore", "从 zip 还原元数据: restore <文件> [-dry-run]", cliRestore},
+		{"user", "账号管理: user add|passwd|remove|list <用户名>", cliUser},
+		{"roster", "学生名册: roster import <CSV/xlsx> [-class 班级] [-replace] | list [班级] | remove <班级> [学号]", cliRoster},
+	}
+}
+
+// 命令行修改也写审计日志，便于和网页端操作一起追溯
+func cliAudit(action, target, detail string) {
+	if detail != "" {
+		detail += " "
+	}
+	appLog.write(LogEntry{Type: "audit", Action: action, Target: target, Detail: detail + "source=cli"})
+}
+
+// 允许位置参数写在选项前面，例如 user add alice -role teacher
+func parseWithArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return append(positional, fs.Args()...), nil
+}
+
+func runCLI(args []string) int {
+	attachConsole()
+	for _, c := range cliCommands {
+		if c.name == args[0] {
+			return c.run(args[1:])
+		}
+	}
+	printCLIUsage()
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		return 0
+	}
+	return 2
+}
+
+func printCLIUsage() {
+	fmt.Fprintln(os.Stderr, "用法: FireCloud <命令> [参数]")
+	fmt.Fprintln(os.Stderr, "")
+	for _, c := range cliCommands {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", c.name, c.usage)
+	}
+}
+
+// -root / -addr 供需要指定根目录的命令共用
+func addServerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&rootDir, "root", rootDir, "资源根目录")
+	fs.StringVar(&listenAddr, "addr", listenAddr, "监听地址")
+}
+
+func cliServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addServerFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := os.MkdirAll(rootDir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, "无法创建根目录:", err)
+		return 1
+	}
+	if handled, code := runAsService(); handled {
+		return code
+	}
+	return runHeadless()
+}
+
+func cliService(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "用法: FireCloud service install|uninstall [-root 目录] [-addr 地址]")
+		return 2
+	}
+	fs := flag.NewFlagSet("service", flag.ContinueOnError)
+	addServerFlags(fs)
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	var err error
+	switch args[0] {
+	case "install":
+		err = installService()
+	case "uninstall":
+		err = uninstallService()
+	default:
+		fmt.Fprintln(os.Stderr, "未知操作:", args[0])
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "操作失败:", err)
+		return 1
+	}
+	fmt.Println("完成")
+	return 0
+}
+
+func cliCheck(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	addServerFlags(fs)
+	fix := fs.Bool("fix", false, "自动改链到内容哈希唯一匹配的文件")
+	prune := fs.Bool("prune", false, "删除仍无法修复的失效引用")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	loadConfig() // 挂载点下的引用也要检查
+
+	report := checkReferences()
+	fmt.Printf("共检查 %d 条引用，失效 %d 条\n", report.Checked, len(report.Dangling))
+	for _, ref := range report.Dangling {
+		where := ref.Source
+		if ref.Field != "" {
+			where += " " + ref.Field
+		}
+		fmt.Printf("  [%s] %s  (%s)\n", ref.Kind, ref.Path, where)
+		for _, s := range ref.Suggestions {
+			fmt.Printf("      → %s  [%s]\n", s.Path, s.Reason)
+		}
+	}
+
+	moves := make(map[string]string)
+	if *fix {
+		for _, ref := range report.Dangling {
+			var hashMatches []string
+			for _, s := range ref.Suggestions {
+				if s.Reason == "hash" {
+					hashMatches = append(hashMatches, s.Path)
+				}
+			}
+			if len(hashMatches) == 1 {
+				moves[ref.Path] = hashMatches[0]
+			}
+		}
+		n, err := relinkReferences(moves)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "改链失败:", err)
+			return 1
+		}
+		fmt.Printf("已改链 %d 条引用\n", n)
+	}
+	if *prune {
+		var orphans []string
+		for _, ref := range report.Dangling {
+			if _, moved := moves[ref.Path]; !moved && !containsString(orphans, ref.Path) {
+				orphans = append(orphans, ref.Path)
+			}
+		}
+		n, err := pruneReferences(orphans)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "清理失败:", err)
+			return 1
+		}
+		fmt.Printf("已清理 %d 条引用\n", n)
+	}
+
+	if len(report.Dangling) > 0 && !*fix && !*prune {
+		return 1
+	}
+	return 0
+}
+
+func cliIndex(args []string) int {
+	fs := flag.NewFlagSet("index", flag.ContinueOnError)
+	addServerFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	loadConfig() // 挂载点一并扫描，否则其中的文件会被当作已删除
+	fileIndex.load()
+	moves, err := fileIndex.scan()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "扫描失败:", err)
+		return 1
+	}
+	st := fileIndex.status()
+	fmt.Printf("已索引 %d 个文件\n", st.Files)
+	for old, np := range moves {
+		fmt.Printf("  移动 %s → %s（元数据已跟随）\n", old, np)
+	}
+	groups := fileIndex.duplicates()
+	var wasted int64
+	for _, g := range groups {
+		wasted += g.Wasted
+	}
+	fmt.Printf("重复文件 %d 组，多占用 %s\n", len(groups), formatBytes(wasted))
+	return 0
+}
+
+// 备课方案导出格式：方案本身加上它引用的自定义模板版本和测验
+type LessonBundle struct {
+	Format    string           `json:"format"`
+	Plan      LessonPlan       `json:"plan"`
+	Templates []LessonTemplate `json:"templates,omitempty"`
+	Quizzes   []Quiz           `json:"quizzes,omitempty"`
+}
+
+const lessonBundleFormat = "firecloud-lesson/1"
+
+// 把方案和它引用的自定义模板版本、测验打包
+func bundleLesson(plan LessonPlan) LessonBundle {
+	bundle := LessonBundle{Format: lessonBundleFormat, Plan: plan}
+	seen := make(map[string]bool)
+	for _, name := range lessonQuizzes(plan) {
+		if q, ok := loadQuiz(name); ok {
+			bundle.Quizzes = append(bundle.Quizzes, q)
+		}
+	}
+	for _, slide := range plan.Slides {
+		tpl, ok := resolveSlideTemplate(slide)
+		key := fmt.Sprintf("%s@%d", tpl.ID, tpl.Version)
+		if !ok || !tpl.Custom || seen[key] {
+			continue
+		}
+		seen[key] = true
+		bundle.Templates = append(bundle.Templates, tpl)
+	}
+	return bundle
+}
+
+// 校验备课包：包内的模板、将要写入的测验，以及按包内模板、测验解析的方案。不写入任何文件
+func validateBundle(bundle LessonBundle, plan *LessonPlan) []FieldError {
+	var errs []FieldError
+	templates := make(map[string]LessonTemplate)
+	for i, t := range bundle.Templates {
+		if !isValidTemplateID(t.ID) || t.Version <= 0 {
+			continue
+		}
+		for _, e := range validateTemplate(&t) {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("templates[%d].%s", i, e.Field), Message: e.Message})
+		}
+		templates[fmt.Sprintf("%s@%d", t.ID, t.Version)] = t
+	}
+	quizzes := make(map[string]bool)
+	for i, q := range bundle.Quizzes {
+		if quizExists(q.Name) {
+			continue
+		}
+		for _, e := range validateQuiz(&q) {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("quizzes[%d].%s", i, e.Field), Message: e.Message})
+		}
+		quizzes[q.Name] = true
+	}
+	resolve := func(slide Slide) (LessonTemplate, bool) {
+		if t, ok := templates[fmt.Sprintf("%s@%d", slide.Template, slide.TemplateVersion)]; ok {
+			return t, true
+		}
+		return resolveSlideTemplate(slide)
+	}
+	quizOK := func(name string) bool { return quizzes[name] || quizExists(name) }
+	return append(errs, validateLessonPlanWith(plan, resolve, quizOK)...)
+}
+
+// 补齐本机没有的模板版本，方案才能按原版本渲染。版本号各机独立编号：本机同号版本内容相同时直接沿用，
+// 内容不同时先找本机内容相同的其他版本，找不到才以新版本号写入。
+// 返回新写入的模板，以及 "模板ID@包内版本" 到本机版本的对应关系（交给 remapTemplateVersions）
+func installBundleTemplates(templates []LessonTemplate) ([]LessonTemplate, map[string]int, error) {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	var installed []LessonTemplate
+	remap := make(map[string]int)
+	for _, t := range templates {
+		if !isValidTemplateID(t.ID) || t.Version <= 0 {
+			continue
+		}
+		key := fmt.Sprintf("%s@%d", t.ID, t.Version)
+		hash := templateHash(t)
+		if local, ok := loadCustomTemplate(t.ID, t.Version); ok && templateHash(local) == hash {
+			continue
+		}
+		found := false
+		for _, v := range templateVersions(t.ID) {
+			if local, ok := loadCustomTemplate(t.ID, v); ok && templateHash(local) == hash {
+				remap[key] = v
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		if errs := validateTemplate(&t); len(errs) > 0 {
+			return installed, remap, fmt.Errorf("模板 %s 校验失败: %s", t.ID, errs[0].Message)
+		}
+		if _, taken := loadCustomTemplate(t.ID, t.Version); taken {
+			t.Version = nextTemplateVersion(t.ID)
+			remap[key] = t.Version
+		}
+		if err := writeTemplateVersion(t); err != nil {
+			return installed, remap, fmt.Errorf("写入模板失败: %v", err)
+		}
+		installed = append(installed, t)
+	}
+	return installed, remap, nil
+}
+
+// 按 installBundleTemplates 的对应关系改写方案中固定的模板版本
+func remapTemplateVersions(plan *LessonPlan, remap map[string]int) {
+	for i := range plan.Slides {
+		slide := &plan.Slides[i]
+		if v, ok := remap[fmt.Sprintf("%s@%d", slide.Template, slide.TemplateVersion)]; ok {
+			slide.TemplateVersion = v
+		}
+	}
+}
+
+// 补齐本机没有的测验；同名测验已存在时保留本机版本。返回新写入的测验
+func installBundleQuizzes(list []Quiz) ([]Quiz, error) {
+	var installed []Quiz
+	for _, q := range list {
+		if quizExists(q.Name) {
+			continue
+		}
+		if errs := validateQuiz(&q); len(errs) > 0 {
+			return installed, fmt.Errorf("测验 %s 校验失败: %s", q.Name, errs[0].Message)
+		}
+		os.MkdirAll(quizDir(), 0755)
+		metaMu.Lock()
+		err := writeHiddenJSON(filepath.Join(quizDir(), q.Name+".json"), q)
+		metaMu.Unlock()
+		if err != nil {
+			return installed, fmt.Errorf("写入测验失败: %v", err)
+		}
+		installed = append(installed, q)
+	}
+	return installed, nil
+}
+
+func cliExportLesson(args []string) int {
+	fs := flag.NewFlagSet("export-lesson", flag.ContinueOnError)
+	addServerFlags(fs)
+	out := fs.String("o", "", "输出文件（默认 <方案名>.lesson.json）")
+	rest, err := parseWithArgs(fs, args)
+	if err != nil || len(rest) != 1 {
+		fmt.Fprintln(os.Stderr, "用法: FireCloud export-lesson <方案名> [-o 文件]")
+		return 2
+	}
+	name := rest[0]
+	if !isValidLessonName(name) {
+		fmt.Fprintln(os.Stderr, "方案名称非法:", name)
+		return 2
+	}
+	var plan LessonPlan
+	if err := readJSONFile(filepath.Join(rootDir, ".fire_lessons", name+".json"), &plan); err != nil || plan.Name == "" {
+		fmt.Fprintln(os.Stderr, "找不到备课方案:", name)
+		return 1
+	}
+
+	bundle := bundleLesson(plan)
+	if *out == "" {
+		*out = name + ".lesson.json"
+	}
+	data, _ := json.MarshalIndent(bundle, "", "  ")
+	if err := os.WriteFile(*out, data, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "写入失败:", err)
+		return 1
+	}
+	fmt.Printf("已导出 %s（%d 页，%d 个自定义模板，%d 个测验）→ %s\n", name, len(plan.Slides), len(bundle.Templates), len(bundle.Quizzes), *out)
+	return 0
+}
+
+func cliImportLesson(args []string) int {
+	fs := flag.NewFlagSet("import-lesson", flag.ContinueOnError)
+	addServerFlags(fs)
+	rename := fs.String("name", "", "以新名称导入")
+	force := fs.Bool("force", false, "覆盖同名方案")
+	rest, err := parseWithArgs(fs, args)
+	if err != nil || len(rest) != 1 {
+		fmt.Fprintln(os.Stderr, "用法: FireCloud import-lesson <文件> [-name 新名称] [-force]")
+		return 2
+	}
+	data, err := os.ReadFile(rest[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "读取失败:", err)
+		return 1
+	}
+	var bundle LessonBundle
+	if err := json.Unmarshal(data, &bundle); err != nil || bundle.Format != lessonBundleFormat {
+		fmt.Fprintln(os.Stderr, "不是 FireCloud 备课方案导出文件")
+		return 1
+	}
+	plan := bundle.Plan
+	if *rename != "" {
+		plan.Name = *rename
+	}
+	if !isValidLessonName(plan.Name) {
+		fmt.Fprintln(os.Stderr, "方案名称非法:", plan.Name)
+		return 1
+	}
+	lessonFile := filepath.Join(rootDir, ".fire_lessons", plan.Name+".json")
+	if _, err := os.Stat(lessonFile); err == nil && !*force {
+		fmt.Fprintln(os.Stderr, "已存在同名方案，使用 -name 改名或 -force 覆盖:", plan.Name)
+		return 1
+	}
+
+	// 先整体校验再写入，被拒绝的导入不会在本机留下孤立的模板和测验。
+	// 素材缺失只提示（可能还没拷过来），结构错误则拒绝导入
+	var missing int
+	for _, e := range validateBundle(bundle, &plan) {
+		if e.Message == "文件不存在" {
+			missing++
+			fmt.Printf("  提示: %s 引用的素材不存在\n", e.Field)
+			continue
+		}
+		if e.Message == "测验不存在" {
+			missing++
+			fmt.Printf("  提示: %s 引用的测验不存在\n", e.Field)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "校验失败: %s %s\n", e.Field, e.Message)
+		return 1
+	}
+
+	installed, remap, err := installBundleTemplates(bundle.Templates)
+	for _, t := range installed {
+		fmt.Printf("  导入模板 %s v%d\n", t.ID, t.Version)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	remapTemplateVersions(&plan, remap)
+	quizList, err := installBundleQuizzes(bundle.Quizzes)
+	for _, q := range quizList {
+		fmt.Printf("  导入测验 %s\n", q.Name)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	os.MkdirAll(filepath.Dir(lessonFile), 0755)
+	metaMu.Lock()
+	err = writeHiddenJSON(lessonFile, plan)
+	metaMu.Unlock()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "写入备课方案失败:", err)
+		return 1
+	}
+	cliAudit("lesson.import", plan.Name, auditDetail("slides", len(plan.Slides), "missing", missing))
+	fmt.Printf("已导入 %s（%d 页，%d 处素材缺失）\n", plan.Name, len(plan.Slides), missing)
+	return 0
+}
+
+// 把 from 中的标签全部替换为 to，返回受影响的文件数
+func replaceTags(from []string, to string) (int, error) {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	tagFile := metaPath(".fire_tags.json")
+	db := make(map[string][]string)
+	if err := readJSONFile(tagFile, &db); err != nil {
+		return 0, err
+	}
+	changed := 0
+	for p, tags := range db {
+		var out []string
+		hit := false
+		for _, t := range tags {
+			if containsString(from, t) {
+				hit = true
+				t = to
+			}
+			if !containsString(out, t) {
+				out = append(out, t)
+			}
+		}
+		if hit {
+			db[p] = out
+			changed++
+		}
+	}
+	if changed == 0 {
+		return 0, nil
+	}
+	return changed, writeHiddenJSON(tagFile, db)
+}
+
+func cliTags(args []string) int {
+	fs := flag.NewFlagSet("tags", flag.ContinueOnError)
+	addServerFlags(fs)
+	rest, err := parseWithArgs(fs, args)
+	if err != nil || len(rest) == 0 {
+		fmt.Fprintln(os.Stderr, "用法: FireCloud tags list | rename <旧> <新> | merge <目标> <标签...>")
+		return 2
+	}
+	switch {
+	case rest[0] == "list":
+		db := make(map[string][]string)
+		readJSONFile(metaPath(".fire_tags.json"), &db)
+		counts := make(map[string]int)
+		for _, tags := range db {
+			for _, t := range tags {
+				counts[t]++
+			}
+		}
+		names := make([]string, 0, len(counts))
+		for t := range counts {
+			names = append(names, t)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			if counts[names[i]] != counts[names[j]] {
+				return counts[names[i]] > counts[names[j]]
+			}
+			return names[i] < names[j]
+		})
+		for _, t := range names {
+			fmt.Printf("%6d  %s\n", counts[t], t)
+		}
+		return 0
+	case rest[0] == "rename" && len(rest) == 3, rest[0] == "merge" && len(rest) >= 3:
+		var from []string
+		to := rest[2]
+		if rest[0] == "rename" {
+			from = []string{rest[1]}
+		} else {
+			to, from = rest[1], rest[2:]
+		}
+		if strings.TrimSpace(to) == "" {
+			fmt.Fprintln(os.Stderr, "目标标签不能为空")
+			return 2
+		}
+		n, err := replaceTags(from, to)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "修改标签失败:", err)
+			return 1
+		}
+		cliAudit("tags."+rest[0], to, auditDetail("from", strings.Join(from, ","), "files", n))
+		fmt.Printf("已更新 %d 个文件的标签\n", n)
+		return 0
+	}
+	fmt.Fprintln(os.Stderr, "用法: FireCloud tags list | rename <旧> <新> | merge <目标> <标签...>")
+	return 2
+}
+
+func cliSync(args []string) int {
+	fs := flag.NewFlagSet("sync", flag.ContinueOnError)
+	addServerFlags(fs)
+	local := fs.String("local", "", "只同步这个本机文件夹")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	loadConfig()
+	fileIndex.load()
+	code, ran := 0, 0
+	for _, sub := range getConfig().Sync {
+		if *local != "" && sub.localFolder() != cleanRelPath(*local) {
+			continue
+		}
+		ran++
+		err := runSync(sub)
+		st := syncStatusFor(sub)
+		fmt.Printf("%s <- %s/%s: 下载 %d（%s），复用 %d，删除 %d，方案 %d\n", st.Local, sub.Remote, st.Folder,
+			st.Downloaded, formatBytes(st.Bytes), st.Reused, st.Deleted, st.Lessons)
+		for _, c := range st.Conflicts {
+			fmt.Println("  冲突副本:", c)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "  同步失败:", err)
+			code = 1
+		}
+	}
+	if ran == 0 {
+		fmt.Fprintln(os.Stderr, "没有匹配的同步订阅（在 .fire_config.json 的 sync 中配置）")
+		return 1
+	}
+	return code
+}
+
+func cliBackup(args []string) int {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	addServerFlags(fs)
+	out := fs.String("o", "", "输出文件（默认 firecloud-backup-<时间>.zip）")
+	folders := fs.String("folders", "", "一并备份的素材文件夹，逗号分隔（默认取配置中的 backup.folders）")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	loadConfig()
+	list := getConfig().Backup.Folders
+	if *folders != "" {
+		list = strings.Split(*folders, ",")
+	}
+	if *out == "" {
+		*out = backupPrefix + time.Now().Format("20060102-150405") + ".zip"
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "创建备份文件失败:", err)
+		return 1
+	}
+	n, err := writeBackup(f, list)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(*out)
+		fmt.Fprintln(os.Stderr, "备份失败:", err)
+		return 1
+	}
+	cliAudit("backup.create", *out, auditDetail("files", n))
+	fmt.Printf("已备份 %d 个文件 → %s\n", n, *out)
+	return 0
+}
+
+func cliRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	addServerFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "只列出将要发生的变化，不写入")
+	rest, err := parseWithArgs(fs, args)
+	if err != nil || len(rest) != 1 {
+		fmt.Fprintln(os.Stderr, "用法: FireCloud restore <备份文件> [-dry-run]")
+		return 2
+	}
+	loadConfig() // files/ 下的条目可能还原到挂载点
+	changes, err := restoreBackup(rest[0], *dryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "还原失败:", err)
+		return 1
+	}
+	labels := map[string]string{"create": "新增", "overwrite": "覆盖", "unchanged": "不变"}
+	summary := make(map[string]int)
+	for _, c := range changes {
+		summary[c.Action]++
+		if c.Action != "unchanged" {
+			fmt.Printf("  %s %s\n", labels[c.Action], c.Path)
+		}
+	}
+	if *dryRun {
+		fmt.Printf("试运行：将新增 %d、覆盖 %d 个文件，%d 个不变\n", summary["create"], summary["overwrite"], summary["unchanged"])
+		return 0
+	}
+	cliAudit("backup.restore", rest[0], auditDetail("create", summary["create"], "overwrite", summary["overwrite"]))
+	fmt.Printf("已还原：新增 %d、覆盖 %d 个文件，%d 个不变\n", summary["create"], summary["overwrite"], summary["unchanged"])
+	return 0
+}
+
+// 从标准输入读取一行密码，终端上输入时不回显。密码不接受命令行参数，避免出现在进程列表中
+func readPassword() string {
+	fmt.Fprint(os.Stderr, "密码: ")
+	restore := disableEcho()
+	// 输入中途按 Ctrl+C 也要恢复回显，否则终端一直不显示输入
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		if _, ok := <-sig; ok {
+			restore()
+			os.Exit(130)
+		}
+	}()
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	signal.Stop(sig)
+	close(sig)
+	restore()
+	fmt.Fprintln(os.Stderr)
+	return strings.TrimRight(line, "\r\n")
+}
+
+func cliUser(args []string) int {
+	fs := flag.NewFlagSet("user", flag.ContinueOnError)
+	addServerFlags(fs)
+	role := fs.String("role", "teacher", "角色: teacher 或 student")
+	rest, err := parseWithArgs(fs, args)
+	usage := "用法: FireCloud user add <用户名> [-role teacher|student] | passwd <用户名> | remove <用户名> | list"
+	if err != nil || len(rest) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	if rest[0] == "list" {
+		for _, a := range listUsers() {
+			fmt.Printf("%-20s %-8s %s\n", a.Name, a.Role, time.Unix(a.Created, 0).Format("2006-01-02"))
+		}
+		return 0
+	}
+	if len(rest) != 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	name := rest[1]
+	switch rest[0] {
+	case "add":
+		err = addUser(name, *role, readPassword())
+	case "passwd":
+		err = setUserPassword(name, readPassword())
+	case "remove":
+		err = removeUser(name)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "操作失败:", err)
+		return 1
+	}
+	cliAudit("user."+rest[0], name, "")
+	fmt.Println("完成")
+	return 0
+}
+
+func cliRoster(args []string) int {
+	fs := flag.NewFlagSet("roster", flag.ContinueOnError)
+	addServerFlags(fs)
+	class := fs.String("class", "", "表中没有班级列时导入到该班级")
+	replace := fs.Bool("replace", false, "删除表中没有的学生")
+	rest, err := parseWithArgs(fs, args)
+	usage := "用法: FireCloud roster import <文件> [-class 班级] [-replace] | list [班级] | remove <班级> [学号]"
+	if err != nil || len(rest) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	switch {
+	case rest[0] == "list" && len(rest) <= 2:
+		for _, c := range sortedClasses(loadRoster()) {
+			if len(rest) == 2 && c.Name != rest[1] {
+				continue
+			}
+			fmt.Printf("%s（%d 人）\n", c.Name, len(c.Students))
+			for _, s := range c.Students {
+				fmt.Printf("  %-12s %-10s PIN %s\n", s.Number, s.Name, s.PIN)
+			}
+		}
+		return 0
+	case rest[0] == "import" && len(rest) == 2:
+		data, err := os.ReadFile(rest[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "读取失败:", err)
+			return 1
+		}
+		res, err := importRoster(data, *class, *replace)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "导入失败:", err)
+			return 1
+		}
+		cliAudit("roster.import", strings.Join(res.Classes, ","), auditDetail("added", res.Added, "updated", res.Updated, "removed", res.Removed))
+		fmt.Printf("已导入 %s：新增 %d，更新 %d，删除 %d，跳过 %d 行\n", strings.Join(res.Classes, "、"), res.Added, res.Updated, res.Removed, res.Skipped)
+		return 0
+	case rest[0] == "remove" && (len(rest) == 2 || len(rest) == 3):
+		student := ""
+		if len(rest) == 3 {
+			student = rest[2]
+		}
+		if err := removeFromRoster(rest[1], student); err != nil {
+			fmt.Fprintln(os.Stderr, "操作失败:", err)
+			return 1
+		}
+		cliAudit("roster.remove", rest[1], auditDetail("student", student))
+		fmt.Println("完成")
+		return 0
+	}
+	fmt.Fprintln(os.Stderr, usage)
+	return 2
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+)
+
+// ===== 运行配置 =====
+// 保存在根目录下的 .fire_config.json，文件不存在时全部使用默认值
+
+type Config struct {
+	Quotas       map[string]int64   `json:"quotas"`       // 顶层文件夹 -> 字节上限
+	UploadAreas  []string           `json:"uploadAreas"`  // 学生上传区，其下每个子文件夹属于一名学生
+	StudentQuota int64              `json:"studentQuota"` // 每名学生上传区的字节上限，0 表示不限
+	MinFreeSpace int64              `json:"minFreeSpace"` // 磁盘剩余空间低于该值时拒绝上传
+	Metrics      MetricsConfig      `json:"metrics"`
+	Throttle     ThrottleConfig     `json:"throttle"`
+	TLS          TLSConfig          `json:"tls"`
+	Discovery    DiscoveryConfig    `json:"discovery"`
+	Mounts       []Mount            `json:"mounts"`
+	Sync         []SyncSubscription `json:"sync"`
+	Backup       BackupConfig       `json:"backup"`
+	Attendance   AttendanceConfig   `json:"attendance"`
+	Filter       FilterConfig       `json:"filter"`
+}
+
+var (
+	configMu sync.RWMutex
+	config   Config
+)
+
+const configFileName = ".fire_config.json"
+
+func configFile() string {
+	return metaPath(configFileName)
+}
+
+func loadConfig() error {
+	var c Config
+	if err := readJSONFile(configFile(), &c); err != nil {
+		return err
+	}
+	configMu.Lock()
+	config = c
+	configMu.Unlock()
+	return nil
+}
+
+// 返回当前配置的副本
+func getConfig() Config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return config
+}
+
+// 修改并持久化配置
+func updateConfig(fn func(c *Config)) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+	c := config
+	fn(&c)
+	if err := writeHiddenJSON(configFile(), c); err != nil {
+		return err
+	}
+	config = c
+	return nil
+}
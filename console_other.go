@@ -0,0 +1,23 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+func attachConsole() {}
+
+// 关闭终端回显，返回恢复函数。标准输入不是终端（管道、重定向）时 stty 失败，什么也不做
+func disableEcho() func() {
+	stty := func(arg string) error {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = os.Stdin
+		return cmd.Run()
+	}
+	if stty("-echo") != nil {
+		return func() {}
+	}
+	return func() { stty("echo") }
+}
@@ -0,0 +1,36 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// -H windowsgui 编译的程序没有控制台，命令行模式下挂到父进程（cmd/PowerShell）的控制台上
+func attachConsole() {
+	if _, err := os.Stdout.Stat(); err == nil {
+		return // 输出已被重定向到文件或管道
+	}
+	attach := syscall.NewLazyDLL("kernel32.dll").NewProc("AttachConsole")
+	const attachParentProcess = uintptr(^uint32(0))
+	if ok, _, _ := attach.Call(attachParentProcess); ok == 0 {
+		return
+	}
+	if out, err := os.OpenFile("CONOUT$", os.O_WRONLY, 0); err == nil {
+		os.Stdout = out
+		os.Stderr = out
+	}
+}
+
+// 关闭控制台回显，返回恢复函数。标准输入不是控制台（管道、重定向）时什么也不做
+func disableEcho() func() {
+	h := windows.Handle(os.Stdin.Fd())
+	var mode uint32
+	if windows.GetConsoleMode(h, &mode) != nil || windows.SetConsoleMode(h, mode&^windows.ENABLE_ECHO_INPUT) != nil {
+		return func() {}
+	}
+	return func() { windows.SetConsoleMode(h, mode) }
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// ===== 局域网发现 =====
+// 1. 手写的最小 mDNS 应答器：应答 firecloud.local / <主机名>.local 的 A 记录，
+//    并以 DNS-SD 发布 _http._tcp 服务，学生直接输入 http://firecloud.local 即可访问；
+// 2. UDP 探测：向 discoveryPort 广播 "FIRECLOUD?"，回复 JSON 格式的访问地址。
+// 每个网卡单独监听并固定从该网卡发出应答，只用与提问方同一网段的地址作答，多网卡教师机也不会给出错误的 IP。
+
+type DiscoveryConfig struct {
+	Disabled bool   `json:"disabled"`
+	Name     string `json:"name"` // DNS-SD 服务实例名，默认 "FireCloud (<主机名>)"
+}
+
+const (
+	mdnsHost       = "firecloud.local"
+	mdnsTTL        = 120
+	discoveryPort  = 48080
+	discoveryProbe = "FIRECLOUD?"
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// ===== 网卡地址 =====
+
+type ifaceAddr struct {
+	name  string
+	ipnet *net.IPNet
+	score int
+}
+
+// 虚拟机、容器和 VPN 网卡排在后面
+var virtualIfaceHints = []string{"vmware", "virtualbox", "vbox", "vethernet", "hyper-v", "docker", "veth", "virbr", "br-", "tailscale", "zerotier", "vpn"}
+
+func ifaceScore(name string, ip net.IP) int {
+	score := 1
+	switch {
+	case ip[0] == 192 && ip[1] == 168:
+		score = 4
+	case ip[0] == 10:
+		score = 3
+	case ip[0] == 172 && ip[1]&0xf0 == 16:
+		score = 2
+	}
+	lower := strings.ToLower(name)
+	for _, hint := range virtualIfaceHints {
+		if strings.Contains(lower, hint) {
+			score -= 10
+			break
+		}
+	}
+	return score
+}
+
+// 所有已启用网卡上的 IPv4 地址，按可能性从高到低排序
+func lanAddrs() []ifaceAddr {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var list []ifaceAddr
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := ifi.Addrs()
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil || ipnet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			ip := ipnet.IP.To4()
+			list = append(list, ifaceAddr{
+				name:  ifi.Name,
+				ipnet: &net.IPNet{IP: ip, Mask: ipnet.Mask},
+				score: ifaceScore(ifi.Name, ip),
+			})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].score > list[j].score })
+	return list
+}
+
+// 默认路由所在网卡的地址（UDP Dial 不会真正发包）
+func routedIP() net.IP {
+	conn, err := net.Dial("udp4", "223.5.5.5:53")
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.To4()
+}
+
+// 与 peer 处于同一网段的本机地址
+func addrForPeer(peer net.IP) net.IP {
+	for _, a := range lanAddrs() {
+		if a.ipnet.Contains(peer) {
+			return a.ipnet.IP
+		}
+	}
+	return nil
+}
+
+func serviceURL(ip string) string {
+	_, port, _ := net.SplitHostPort(listenAddr)
+	if port == "" || port == "80" {
+		return "http://" + ip + "/"
+	}
+	return "http://" + ip + ":" + port + "/"
+}
+
+type LocalAddress struct {
+	Interface string `json:"interface"`
+	IP        string `json:"ip"`
+	URL       string `json:"url"`
+	QR        string `json:"qr,omitempty"`
+}
+
+// 状态接口中列出的全部候选地址，各带一个二维码
+func candidateAddresses(withQR bool) []LocalAddress {
+	var out []LocalAddress
+	for _, a := range lanAddrs() {
+		la := LocalAddress{Interface: a.name, IP: a.ipnet.IP.String(), URL: serviceURL(a.ipnet.IP.String())}
+		if withQR {
+			if png, err := qrcode.Encode(la.URL, qrcode.Medium, 256); err == nil {
+				la.QR = base64.StdEncoding.EncodeToString(png)
+			}
+		}
+		out = append(out, la)
+	}
+	return out
+}
+
+// ===== DNS 报文 =====
+
+const (
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsTypeANY = 255
+
+	dnsClassIN    = 1
+	dnsCacheFlush = 0x8000
+)
+
+type dnsQuestion struct {
+	name    string
+	qtype   uint16
+	unicast bool // QU 位
+}
+
+type dnsRecord struct {
+	name  string
+	rtype uint16
+	class uint16
+	data  []byte
+}
+
+func encodeDNSName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// 读取可能带压缩指针的域名，返回名称和指针之后的偏移
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; jumps < 16; {
+		if off >= len(msg) {
+			return "", 0, fmt.Errorf("域名越界")
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, fmt.Errorf("域名越界")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, fmt.Errorf("域名越界")
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+	return "", 0, fmt.Errorf("压缩指针过多")
+}
+
+func parseDNSQuery(msg []byte) (uint16, []dnsQuestion, bool) {
+	if len(msg) < 12 {
+		return 0, nil, false
+	}
+	id := binary.BigEndian.Uint16(msg)
+	if msg[2]&0x80 != 0 { // 应答报文
+		return 0, nil, false
+	}
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	off := 12
+	var qs []dnsQuestion
+	for i := 0; i < qd; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return 0, nil, false
+		}
+		qtype := binary.BigEndian.Uint16(msg[next:])
+		qclass := binary.BigEndian.Uint16(msg[next+2:])
+		qs = append(qs, dnsQuestion{name: strings.ToLower(name), qtype: qtype, unicast: qclass&0x8000 != 0})
+		off = next + 4
+	}
+	return id, qs, true
+}
+
+func buildDNSResponse(id uint16, questions []dnsQuestion, answers, extra []dnsRecord) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg, id)
+	binary.BigEndian.PutUint16(msg[2:], 0x8400) // 应答 + 权威
+	binary.BigEndian.PutUint16(msg[4:], uint16(len(questions)))
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(answers)))
+	binary.BigEndian.PutUint16(msg[10:], uint16(len(extra)))
+	for _, q := range questions {
+		msg = append(msg, encodeDNSName(q.name)...)
+		msg = binary.BigEndian.AppendUint16(msg, q.qtype)
+		msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	}
+	for _, rr := range append(answers, extra...) {
+		msg = append(msg, encodeDNSName(rr.name)...)
+		msg = binary.BigEndian.AppendUint16(msg, rr.rtype)
+		msg = binary.BigEndian.AppendUint16(msg, rr.class)
+		msg = binary.BigEndian.AppendUint32(msg, mdnsTTL)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(rr.data)))
+		msg = append(msg, rr.data...)
+	}
+	return msg
+}
+
+// ===== mDNS 应答 =====
+
+type mdnsZone struct {
+	hosts    []string // 应答 A 记录的主机名
+	service  string   // _http._tcp.local
+	instance string   // FireCloud (主机名)._http._tcp.local
+	port     uint16
+}
+
+func currentZone() mdnsZone {
+	host, _ := os.Hostname()
+	z := mdnsZone{hosts: []string{mdnsHost}, service: "_http._tcp.local"}
+	if host != "" {
+		z.hosts = append(z.hosts, strings.ToLower(host)+".local")
+	}
+	name := getConfig().Discovery.Name
+	if name == "" {
+		name = "FireCloud (" + host + ")"
+	}
+	z.instance = strings.ReplaceAll(name, ".", " ") + "." + z.service
+	port := 80
+	if _, p, err := net.SplitHostPort(listenAddr); err == nil {
+		fmt.Sscanf(p, "%d", &port)
+	}
+	z.port = uint16(port)
+	return z
+}
+
+func (z mdnsZone) records(ip net.IP) (a, ptr, srv, txt dnsRecord, enum dnsRecord) {
+	a = dnsRecord{name: z.hosts[0], rtype: dnsTypeA, class: dnsClassIN | dnsCacheFlush, data: ip.To4()}
+	ptr = dnsRecord{name: z.service, rtype: dnsTypePTR, class: dnsClassIN, data: encodeDNSName(z.instance)}
+	srvData := binary.BigEndian.AppendUint16(nil, 0)
+	srvData = binary.BigEndian.AppendUint16(srvData, 0)
+	srvData = binary.BigEndian.AppendUint16(srvData, z.port)
+	srv = dnsRecord{name: z.instance, rtype: dnsTypeSRV, class: dnsClassIN | dnsCacheFlush, data: append(srvData, encodeDNSName(z.hosts[0])...)}
+	txtValue := "path=/"
+	txt = dnsRecord{name: z.instance, rtype: dnsTypeTXT, class: dnsClassIN | dnsCacheFlush, data: append([]byte{byte(len(txtValue))}, txtValue...)}
+	enum = dnsRecord{name: "_services._dns-sd._udp.local", rtype: dnsTypePTR, class: dnsClassIN, data: encodeDNSName(z.service)}
+	return
+}
+
+// 根据提问生成应答记录
+func (z mdnsZone) answer(questions []dnsQuestion, ip net.IP) (answers, extra []dnsRecord, unicast bool) {
+	a, ptr, srv, txt, enum := z.records(ip)
+	instance := strings.ToLower(z.instance)
+	for _, q := range questions {
+		if q.unicast {
+			unicast = true
+		}
+		want := func(t uint16) bool { return q.qtype == t || q.qtype == dnsTypeANY }
+		switch {
+		case containsString(z.hosts, q.name) && want(dnsTypeA):
+			rec := a
+			rec.name = q.name
+			answers = append(answers, rec)
+		case q.name == z.service && want(dnsTypePTR):
+			answers = append(answers, ptr)
+			extra = append(extra, srv, txt, a)
+		case q.name == instance && (want(dnsTypeSRV) || want(dnsTypeTXT)):
+			if want(dnsTypeSRV) {
+				answers = append(answers, srv)
+				extra = append(extra, a)
+			}
+			if want(dnsTypeTXT) {
+				answers = append(answers, txt)
+			}
+		case q.name == "_services._dns-sd._udp.local" && want(dnsTypePTR):
+			answers = append(answers, enum)
+		}
+	}
+	return
+}
+
+// 在一个网卡上应答 mDNS 查询
+func serveMDNS(conn *net.UDPConn, ifi net.Interface) {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		id, questions, ok := parseDNSQuery(buf[:n])
+		if !ok || len(questions) == 0 {
+			continue
+		}
+		// 同一端口上的多个套接字都会收到组播，只处理本网卡网段内的提问
+		ip := addrOnIface(ifi, src.IP)
+		if ip == nil {
+			continue
+		}
+		answers, extra, unicast := currentZone().answer(questions, ip)
+		if len(answers) == 0 {
+			continue
+		}
+		legacy := src.Port != mdnsGroup.Port
+		if legacy {
+			// 普通 DNS 客户端直接发到 5353：沿用查询 ID 并回带问题，单播作答，且不带 cache-flush 位
+			for i := range answers {
+				answers[i].class &^= dnsCacheFlush
+			}
+			for i := range extra {
+				extra[i].class &^= dnsCacheFlush
+			}
+			conn.WriteToUDP(buildDNSResponse(id, questions, answers, extra), src)
+			continue
+		}
+		resp := buildDNSResponse(0, nil, answers, extra)
+		if unicast {
+			conn.WriteToUDP(resp, src)
+		} else {
+			conn.WriteToUDP(resp, mdnsGroup)
+		}
+	}
+}
+
+// 网卡上与 peer 同网段的 IPv4 地址
+func addrOnIface(ifi net.Interface, peer net.IP) net.IP {
+	addrs, _ := ifi.Addrs()
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil && ipnet.Contains(peer) {
+			return ipnet.IP.To4()
+		}
+	}
+	return nil
+}
+
+// 网卡的第一个 IPv4 地址，没有时返回 nil
+func ifaceIPv4(ifi net.Interface) net.IP {
+	addrs, _ := ifi.Addrs()
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.To4()
+		}
+	}
+	return nil
+}
+
+// 启动时主动宣告一次，让已打开的浏览器和发现工具立即看到本机
+func announceMDNS(conn *net.UDPConn, ip net.IP) {
+	a, ptr, srv, txt, _ := currentZone().records(ip)
+	conn.WriteToUDP(buildDNSResponse(0, nil, []dnsRecord{a, ptr, srv, txt}, nil), mdnsGroup)
+}
+
+// ===== UDP 探测 =====
+
+type DiscoveryReply struct {
+	Name string   `json:"name"`
+	URL  string   `json:"url"`  // 与探测方同一网段的地址
+	URLs []string `json:"urls"` // 全部候选地址
+	Host string   `json:"host"`
+}
+
+func serveDiscoveryProbe(conn *net.UDPConn) {
+	buf := make([]byte, 512)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if strings.TrimSpace(string(buf[:n])) != discoveryProbe {
+			continue
+		}
+		reply := DiscoveryReply{Name: strings.TrimSuffix(currentZone().instance, "._http._tcp.local"), Host: mdnsHost}
+		for _, a := range candidateAddresses(false) {
+			reply.URLs = append(reply.URLs, a.URL)
+		}
+		if ip := addrForPeer(src.IP); ip != nil {
+			reply.URL = serviceURL(ip.String())
+		} else if len(reply.URLs) > 0 {
+			reply.URL = reply.URLs[0]
+		}
+		data, _ := json.Marshal(reply)
+		conn.WriteToUDP(data, src)
+	}
+}
+
+// 启动 mDNS 应答与 UDP 探测（失败只记日志，不影响 HTTP 服务）。服务停止时关闭全部套接字，
+// 让出 5353 和发现端口
+func startDiscovery() {
+	if getConfig().Discovery.Disabled {
+		return
+	}
+	var conns []*net.UDPConn
+	ifaces, _ := net.Interfaces()
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ifi := ifi
+		ip := ifaceIPv4(ifi)
+		if ip == nil {
+			continue
+		}
+		conn, err := net.ListenMulticastUDP("udp4", &ifi, mdnsGroup)
+		if err != nil {
+			logError("mDNS 监听失败: "+ifi.Name, err)
+			continue
+		}
+		// 组播应答带的是本网卡的地址，必须从本网卡发出；否则多网卡教师机上
+		// 路由表可能把它从另一块网卡送出去，学生收到的是连不通的 IP
+		if err := setMulticastInterface(conn, ip); err != nil {
+			logError("mDNS 绑定发送网卡失败: "+ifi.Name, err)
+			conn.Close()
+			continue
+		}
+		announceMDNS(conn, ip)
+		conns = append(conns, conn)
+		goBackground(func(context.Context) { serveMDNS(conn, ifi) })
+	}
+
+	if conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: discoveryPort}); err != nil {
+		logError("UDP 发现端口监听失败", err)
+	} else {
+		conns = append(conns, conn)
+		goBackground(func(context.Context) { serveDiscoveryProbe(conn) })
+	}
+	goBackground(func(ctx context.Context) {
+		<-ctx.Done()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+}
@@ -0,0 +1,25 @@
+//go:build windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// 固定组播发送网卡（IP_MULTICAST_IF），应答和宣告只从 ip 所在的网卡发出
+func setMulticastInterface(conn *net.UDPConn, ip net.IP) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var addr [4]byte
+	copy(addr[:], ip.To4())
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		serr = syscall.Setsockopt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, &addr[0], 4)
+	}); err != nil {
+		return err
+	}
+	return serr
+}
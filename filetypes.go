@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ===== 文件类型 =====
+// 扩展名到 MIME、分类、预览方式和图标的唯一来源：
+//   - 启动时把 MIME 注册到 mime 包，http.ServeFile 不再依赖系统注册表（教室电脑上 .mkv、.m4a 常被报成错误类型）
+//   - /api/list 的每一项带上分类与预览方式，前端不再各自维护扩展名正则
+//   - /api/types 导出整张表，备课编辑器等按路径判断类型时使用
+// 没有扩展名或扩展名不认识的文件读取开头 512 字节嗅探。
+
+type FileType struct {
+	MIME     string `json:"mime,omitempty"`
+	Category string `json:"category"`          // video / audio / image / doc / slide / code / courseware / archive / app / folder / other
+	Preview  string `json:"preview,omitempty"` // 浏览器内的预览方式：video / audio / image / pdf / markdown / text / page，空表示下载
+	Icon     string `json:"icon"`              // 前端图标名
+}
+
+var typeCategories = []string{"video", "audio", "image", "doc", "slide", "code", "courseware", "archive", "app", "other"}
+
+// 同一组扩展名共用分类、预览方式和图标
+type typeGroup struct {
+	category, preview, icon string
+	exts                    map[string]string // 扩展名 -> MIME
+}
+
+var typeGroups = []typeGroup{
+	{"video", "video", "video", map[string]string{
+		".mp4": "video/mp4", ".m4v": "video/mp4", ".webm": "video/webm", ".ogv": "video/ogg",
+		".mkv": "video/x-matroska", ".mov": "video/quicktime",
+	}},
+	// 浏览器放不了的视频只归类，不提供预览
+	{"video", "", "video", map[string]string{
+		".avi": "video/x-msvideo", ".flv": "video/x-flv", ".wmv": "video/x-ms-wmv", ".ts": "video/mp2t",
+		".mpg": "video/mpeg", ".mpeg": "video/mpeg", ".3gp": "video/3gpp",
+	}},
+	{"audio", "audio", "audio", map[string]string{
+		".mp3": "audio/mpeg", ".m4a": "audio/mp4", ".aac": "audio/aac", ".wav": "audio/wav",
+		".ogg": "audio/ogg", ".oga": "audio/ogg", ".opus": "audio/ogg", ".flac": "audio/flac",
+	}},
+	{"audio", "", "audio", map[string]string{
+		".wma": "audio/x-ms-wma", ".mid": "audio/midi", ".midi": "audio/midi",
+	}},
+	{"image", "image", "image", map[string]string{
+		".jpg": "image/jpeg", ".jpeg": "image/jpeg", ".png": "image/png", ".gif": "image/gif",
+		".webp": "image/webp", ".bmp": "image/bmp", ".svg": "image/svg+xml", ".ico": "image/x-icon",
+		".avif": "image/avif",
+	}},
+	{"image", "", "image", map[string]string{
+		".tif": "image/tiff", ".tiff": "image/tiff", ".heic": "image/heic", ".psd": "image/vnd.adobe.photoshop",
+	}},
+	{"doc", "pdf", "pdf", map[string]string{".pdf": "application/pdf"}},
+	{"doc", "markdown", "text", map[string]string{".md": "text/markdown; charset=utf-8"}},
+	{"doc", "text", "text", map[string]string{".txt": "text/plain; charset=utf-8", ".log": "text/plain; charset=utf-8"}},
+	{"doc", "", "word", map[string]string{
+		".doc": "application/msword", ".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+		".wps": "application/vnd.ms-works", ".rtf": "application/rtf", ".odt": "application/vnd.oasis.opendocument.text",
+	}},
+	{"doc", "", "excel", map[string]string{
+		".xls": "application/vnd.ms-excel", ".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		".et": "application/vnd.ms-excel", ".ods": "application/vnd.oasis.opendocument.spreadsheet",
+	}},
+	{"doc", "text", "excel", map[string]string{".csv": "text/csv; charset=utf-8"}},
+	{"slide", "", "ppt", map[string]string{
+		".ppt": "application/vnd.ms-powerpoint", ".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+		".dps": "application/vnd.ms-powerpoint", ".odp": "application/vnd.oasis.opendocument.presentation", ".key": "application/vnd.apple.keynote",
+	}},
+	{"code", "text", "text", map[string]string{
+		".json": "application/json", ".js": "text/javascript; charset=utf-8", ".css": "text/css; charset=utf-8",
+		".go": "text/plain; charset=utf-8", ".py": "text/x-python; charset=utf-8", ".java": "text/plain; charset=utf-8",
+		".c": "text/plain; charset=utf-8", ".cpp": "text/plain; charset=utf-8", ".h": "text/plain; charset=utf-8",
+		".cs": "text/plain; charset=utf-8", ".sh": "text/plain; charset=utf-8", ".bat": "text/plain; charset=utf-8",
+		".ini": "text/plain; charset=utf-8", ".conf": "text/plain; charset=utf-8", ".xml": "text/xml; charset=utf-8",
+		".yaml": "text/yaml; charset=utf-8", ".yml": "text/yaml; charset=utf-8", ".ipynb": "application/json",
+		".sb3": "application/x.scratch.sb3",
+	}},
+	{"courseware", "page", "text", map[string]string{".html": "text/html; charset=utf-8", ".htm": "text/html; charset=utf-8"}},
+	{"courseware", "", "file", map[string]string{".h5p": "application/zip", ".swf": "application/x-shockwave-flash"}},
+	{"archive", "", "zip", map[string]string{
+		".zip": "application/zip", ".rar": "application/vnd.rar", ".7z": "application/x-7z-compressed",
+		".tar": "application/x-tar", ".gz": "application/gzip", ".bz2": "application/x-bzip2",
+	}},
+	{"app", "", "exe", map[string]string{
+		".exe": "application/vnd.microsoft.portable-executable", ".msi": "application/x-msi",
+		".apk": "application/vnd.android.package-archive", ".dmg": "application/x-apple-diskimage",
+	}},
+}
+
+var fileTypes = make(map[string]FileType)
+
+func init() {
+	for _, g := range typeGroups {
+		for ext, mt := range g.exts {
+			fileTypes[ext] = FileType{MIME: mt, Category: g.category, Preview: g.preview, Icon: g.icon}
+			mime.AddExtensionType(ext, mt)
+		}
+	}
+}
+
+var (
+	folderType  = FileType{Category: "folder", Icon: "folder"}
+	unknownType = FileType{MIME: "application/octet-stream", Category: "other", Icon: "file"}
+)
+
+// 按扩展名查类型
+func typeByName(name string) (FileType, bool) {
+	t, ok := fileTypes[strings.ToLower(filepath.Ext(name))]
+	return t, ok
+}
+
+// 嗅探结果中浏览器能直接预览的类型
+var sniffPreview = map[string]string{
+	"video/mp4": "video", "video/webm": "video",
+	"audio/mpeg": "audio", "audio/wave": "audio", "application/ogg": "audio",
+	"image/jpeg": "image", "image/png": "image", "image/gif": "image", "image/webp": "image", "image/bmp": "image",
+	"application/pdf": "pdf", "text/html": "page",
+}
+
+// 由嗅探到的 MIME 推断类型
+func typeByMIME(mt string) FileType {
+	base, _, _ := strings.Cut(mt, ";")
+	t := FileType{MIME: mt, Preview: sniffPreview[base]}
+	switch {
+	case base == "text/html":
+		t.Category, t.Icon = "courseware", "text"
+	case base == "application/pdf":
+		t.Category, t.Icon = "doc", "pdf"
+	case strings.HasPrefix(base, "text/"):
+		t.Category, t.Preview, t.Icon = "doc", "text", "text"
+	case strings.HasPrefix(base, "video/"):
+		t.Category, t.Icon = "video", "video"
+	case strings.HasPrefix(base, "audio/") || base == "application/ogg":
+		t.Category, t.Icon = "audio", "audio"
+	case strings.HasPrefix(base, "image/"):
+		t.Category, t.Icon = "image", "image"
+	case base == "application/zip" || base == "application/x-gzip" || base == "application/x-rar-compressed":
+		t.Category, t.Icon = "archive", "zip"
+	default:
+		return unknownType
+	}
+	return t
+}
+
+// 文件的类型：先看扩展名，认不出时嗅探内容
+func detectFileType(name, absPath string) FileType {
+	if t, ok := typeByName(name); ok {
+		return t
+	}
+	f, err := os.Open(absPath)
+	if err != nil {
+		return unknownType
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, _ := f.Read(buf)
+	if n == 0 {
+		return unknownType
+	}
+	return typeByMIME(http.DetectContentType(buf[:n]))
+}
+
+// 文件夹的类型：含 index.html 的是 H5 课件，访问时直接打开
+func detectFolderType(absPath string) FileType {
+	if _, err := os.Stat(filepath.Join(absPath, "index.html")); err == nil {
+		return FileType{Category: "courseware", Preview: "page", Icon: "folder"}
+	}
+	return folderType
+}
+
+// 可以放进备课素材树、加书签的媒体：浏览器能直接预览的视频和图片
+func isMediaType(name string) bool {
+	t, ok := typeByName(name)
+	return ok && (t.Category == "video" || t.Category == "image") && t.Preview != ""
+}
+
+type typesResponse struct {
+	Categories []string            `json:"categories"`
+	Types      map[string]FileType `json:"types"` // 扩展名（含点，小写） -> 类型
+}
+
+// 导出类型表
+func handleTypes(w http.ResponseWriter, r *http.Request) {
+	if notModified(w, r, makeETag("types", len(fileTypes)), time.Time{}) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(typesResponse{Categories: typeCategories, Types: fileTypes})
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== 隐藏规则 =====
+// 文件列表、备课素材树和教室间同步（只发布看得见的文件）共用同一套规则决定哪些文件「看不见」：
+//   - 配置文件 filter.hide 中的全局规则，默认隐藏以 . 开头的文件和文件夹
+//   - 每个文件夹下的 .fireignore，语法同 .gitignore（# 注释、! 取反、/ 结尾只匹配文件夹、/ 开头或中间带 / 时相对该文件夹、** 匹配任意层）
+// 规则按「全局 -> 根目录 -> 逐级子文件夹」的顺序求值，后匹配的生效，因此子文件夹可以用 ! 放出上级隐藏的内容。
+// 被隐藏的文件夹整个跳过，其中的内容无法再被放出。.fire_* 元数据无论规则如何都不会出现。
+// 隐藏只影响列出，不是访问控制：H5 课件照常可以按相对路径加载被隐藏的资源；
+// 内容索引、用量配额、重复检测和备份也不受其影响，只跳过 .fire_* 元数据。
+
+const ignoreFileName = ".fireignore"
+
+var defaultHidePatterns = []string{".*"}
+
+type FilterConfig struct {
+	Hide  []string `json:"hide"`  // 全局隐藏规则（.gitignore 语法），不填时为 [".*"]，填 [] 表示不隐藏
+	Media []string `json:"media"` // 媒体文件扩展名，不填时为文件类型表中浏览器能直接预览的视频和图片
+	Tree  []string `json:"tree"`  // 媒体文件之外也出现在备课素材树中的文件（.gitignore 语法），例如 "*.pdf"
+}
+
+func (c FilterConfig) hidePatterns() []string {
+	if c.Hide == nil {
+		return defaultHidePatterns
+	}
+	return c.Hide
+}
+
+// 是否媒体文件：配置了 media 时按扩展名列表，否则按文件类型表
+func (c FilterConfig) isMedia(name string) bool {
+	if c.Media == nil {
+		return isMediaType(name)
+	}
+	return hasExt(c.Media, name)
+}
+
+type ignoreRule struct {
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool // 含 /：相对规则所在文件夹匹配整段路径，否则只匹配名称
+}
+
+// 一组规则及其所在文件夹（虚拟相对路径，"" 为根目录）
+type ignoreScope struct {
+	base  string
+	rules []ignoreRule
+}
+
+func parseIgnoreRules(lines []string) []ignoreRule {
+	var rules []ignoreRule
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") {
+			rule.negate, line = true, line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:] // \# \! 转义
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly, line = true, strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			rule.anchored, line = true, strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// 按 / 分段匹配，** 匹配零或多段
+func globMatch(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pat, segs []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for i := 0; i <= len(segs); i++ {
+				if matchSegments(pat[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], segs[0]); !ok {
+			return false
+		}
+		pat, segs = pat[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
+
+// 规则组对该路径的判定：matched 为 false 表示没有规则命中
+func (s ignoreScope) match(rel string, isDir bool) (hidden, matched bool) {
+	sub := rel
+	if s.base != "" {
+		if !strings.HasPrefix(rel, s.base+"/") {
+			return false, false
+		}
+		sub = rel[len(s.base)+1:]
+	}
+	for _, rule := range s.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		target := path.Base(sub)
+		if rule.anchored {
+			target = sub
+		}
+		if globMatch(rule.pattern, target) {
+			hidden, matched = !rule.negate, true
+		}
+	}
+	return hidden, matched
+}
+
+// ===== .fireignore 缓存 =====
+
+type cachedIgnore struct {
+	modTime time.Time
+	size    int64
+	rules   []ignoreRule
+}
+
+var ignoreCache = struct {
+	sync.Mutex
+	files map[string]*cachedIgnore // 磁盘绝对路径 -> 规则，文件不存在时为 nil
+}{files: make(map[string]*cachedIgnore)}
+
+// 读取文件夹下的 .fireignore，按 mtime 和大小缓存；返回的签名用于判断规则是否变化
+func loadIgnoreFile(dirRel string) ([]ignoreRule, string) {
+	absDir, ok := resolvePath(dirRel)
+	if !ok {
+		return nil, "-"
+	}
+	file := filepath.Join(absDir, ignoreFileName)
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, "-"
+	}
+	sig := fmt.Sprintf("%d:%d", info.ModTime().UnixNano(), info.Size())
+	ignoreCache.Lock()
+	defer ignoreCache.Unlock()
+	c := ignoreCache.files[file]
+	if c == nil || !c.modTime.Equal(info.ModTime()) || c.size != info.Size() {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, "-"
+		}
+		var lines []string
+		sc := bufio.NewScanner(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+		for sc.Scan() {
+			lines = append(lines, sc.Text())
+		}
+		c = &cachedIgnore{modTime: info.ModTime(), size: info.Size(), rules: parseIgnoreRules(lines)}
+		ignoreCache.files[file] = c
+	}
+	return c.rules, sig
+}
+
+// ===== 共用的列出过滤器 =====
+
+type listFilter struct {
+	dir    string // 过滤器作用的文件夹，只判断其直接子项
+	scopes []ignoreScope
+	tree   ignoreScope
+	config FilterConfig
+	sig    string // 规则签名：全局配置和沿途各 .fireignore 的版本
+}
+
+// 为某个文件夹的直接子项构造过滤器，沿途读取根目录到该文件夹的每个 .fireignore
+func newListFilter(dirRel string) *listFilter {
+	fc := getConfig().Filter
+	hide := fc.hidePatterns()
+	f := &listFilter{
+		dir:    dirRel,
+		scopes: []ignoreScope{{rules: parseIgnoreRules(hide)}},
+		tree:   ignoreScope{rules: parseIgnoreRules(fc.Tree)},
+		config: fc,
+	}
+	sigs := []string{strings.Join(hide, "\x00"), strings.Join(fc.Tree, "\x00"), strings.Join(fc.Media, ",")}
+	bases := []string{""}
+	if dirRel != "" {
+		segs := strings.Split(dirRel, "/")
+		for i := range segs {
+			bases = append(bases, strings.Join(segs[:i+1], "/"))
+		}
+	}
+	for _, base := range bases {
+		rules, sig := loadIgnoreFile(base)
+		sigs = append(sigs, sig)
+		if len(rules) > 0 {
+			f.scopes = append(f.scopes, ignoreScope{base: base, rules: rules})
+		}
+	}
+	f.sig = strings.Join(sigs, "|")
+	return f
+}
+
+// 子项是否被隐藏
+func (f *listFilter) hidden(name string, isDir bool) bool {
+	if strings.HasPrefix(strings.ToLower(name), ".fire_") {
+		return true
+	}
+	rel := joinRel(f.dir, name)
+	hidden := false
+	for _, s := range f.scopes {
+		if h, ok := s.match(rel, isDir); ok {
+			hidden = h
+		}
+	}
+	return hidden
+}
+
+// 扩展名是否在列表中；列表项写不写开头的点都可以
+func hasExt(exts []string, name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range exts {
+		if ext != "" && "."+strings.TrimPrefix(strings.ToLower(e), ".") == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// 是否出现在备课素材树中：媒体文件，或命中 filter.tree 的文件
+func (f *listFilter) inTree(name string) bool {
+	if f.config.isMedia(name) {
+		return true
+	}
+	h, ok := f.tree.match(joinRel(f.dir, name), false)
+	return ok && h
+}
+
+// 逐个文件夹遍历时复用过滤器
+type filterSet map[string]*listFilter
+
+func (set filterSet) get(dirRel string) *listFilter {
+	f := set[dirRel]
+	if f == nil {
+		f = newListFilter(dirRel)
+		set[dirRel] = f
+	}
+	return f
+}
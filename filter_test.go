@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*.tmp", "a.tmp", true},
+		{"*.tmp", "a.tmpx", false},
+		{"a/*.md", "a/x.md", true},
+		{"a/*.md", "a/b/x.md", false}, // * 不跨越 /
+		{"**/cache", "cache", true},
+		{"**/cache", "a/b/cache", true},
+		{"a/**/z.txt", "a/z.txt", true},
+		{"a/**/z.txt", "a/b/c/z.txt", true},
+		{"a/**/z.txt", "b/z.txt", false},
+		{"logs/**", "logs/x/y", true},
+		{"logs/**", "logs", true},
+		{"logs/**", "log/x", false},
+		{"[ab].txt", "b.txt", true},
+		{"?.txt", "ab.txt", false},
+	}
+	for _, c := range cases {
+		if got := globMatch(c.pattern, c.name); got != c.want {
+			t.Errorf("globMatch(%q, %q) = %v，期望 %v", c.pattern, c.name, got, c.want)
+		}
+	}
+}
+
+func TestParseIgnoreRules(t *testing.T) {
+	rules := parseIgnoreRules([]string{
+		"# 注释",
+		"",
+		"  ",
+		"!keep.bak",
+		`\#hash`,
+		`\!bang`,
+		"build/",
+		"/todo.txt",
+		"docs/*.md",
+		"/",
+		"trailing.txt  ",
+	})
+	want := []ignoreRule{
+		{pattern: "keep.bak", negate: true},
+		{pattern: "#hash"},
+		{pattern: "!bang"},
+		{pattern: "build", dirOnly: true},
+		{pattern: "todo.txt", anchored: true},
+		{pattern: "docs/*.md", anchored: true},
+		{pattern: "trailing.txt"},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("解析出 %d 条规则，期望 %d 条: %+v", len(rules), len(want), rules)
+	}
+	for i := range want {
+		if rules[i] != want[i] {
+			t.Errorf("第 %d 条: %+v，期望 %+v", i, rules[i], want[i])
+		}
+	}
+}
+
+func TestListFilterHidden(t *testing.T) {
+	scopes := []ignoreScope{
+		{rules: parseIgnoreRules([]string{".*"})}, // 全局默认规则
+		{rules: parseIgnoreRules([]string{"*.bak", "!keep.bak", "build/", "/todo.txt", "docs/*.md", "**/cache", "*.tmp"})},
+		{base: "sub", rules: parseIgnoreRules([]string{"!*.bak", "/local.txt", "!.well-known"})},
+	}
+	cases := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{".git", true, true},
+		{"a.txt", false, false},
+		{"x.bak", false, true},
+		{"keep.bak", false, false},   // 取反
+		{"sub/x.bak", false, false},  // 子文件夹放出上级隐藏的内容
+		{"other/x.bak", false, true}, // 子文件夹的规则不影响同级文件夹
+		{"build", true, true},        // / 结尾只匹配文件夹
+		{"build", false, false},
+		{"todo.txt", false, true}, // / 开头只匹配规则所在文件夹
+		{"sub/todo.txt", false, false},
+		{"docs/a.md", false, true}, // 中间带 / 时相对规则所在文件夹
+		{"x/docs/a.md", false, false},
+		{"cache", true, true},          // ** 匹配零层
+		{"a/b/cache", true, true},      // ** 匹配多层
+		{"a/b/c.tmp", false, true},     // 不带 / 的规则匹配任意层的名称
+		{"sub/local.txt", false, true}, // 子文件夹中的 / 开头相对该子文件夹
+		{"sub/x/local.txt", false, false},
+		{"sub/.well-known", true, false},
+		{".fire_roster.json", false, true}, // 元数据无论规则如何都隐藏
+	}
+	for _, c := range cases {
+		dir, name := "", c.rel
+		if i := strings.LastIndex(c.rel, "/"); i >= 0 {
+			dir, name = c.rel[:i], c.rel[i+1:]
+		}
+		f := &listFilter{dir: dir, scopes: scopes}
+		if got := f.hidden(name, c.isDir); got != c.want {
+			t.Errorf("hidden(%q, dir=%v) = %v，期望 %v", c.rel, c.isDir, got, c.want)
+		}
+	}
+
+	// .fire_* 不能被 ! 放出
+	f := &listFilter{scopes: []ignoreScope{{rules: parseIgnoreRules([]string{"!.fire_*"})}}}
+	if !f.hidden(".fire_users.json", false) {
+		t.Error(".fire_users.json 被规则放出")
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ===== 内容哈希索引 =====
+// 后台定期扫描根目录，记录每个文件的大小、修改时间和 SHA-256。
+// 文件在资源管理器中被移动后，凭哈希把书签/标签/备课引用迁移到新路径；
+// 同一份索引还用来找出各班文件夹里重复存放的视频。
+
+const indexInterval = 10 * time.Minute
+
+type IndexEntry struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Hash    string `json:"hash"`
+}
+
+type IndexStatus struct {
+	Files     int               `json:"files"`
+	Updated   int64             `json:"updated"`
+	Running   bool              `json:"running"`
+	LastMoves map[string]string `json:"lastMoves"`
+}
+
+type DuplicateGroup struct {
+	Hash   string   `json:"hash"`
+	Size   int64    `json:"size"`
+	Paths  []string `json:"paths"`
+	Wasted int64    `json:"wasted"` // 除保留一份外多占用的字节数
+}
+
+type hashIndex struct {
+	mu        sync.Mutex
+	entries   map[string]IndexEntry
+	updated   int64
+	running   bool
+	lastMoves map[string]string
+}
+
+var fileIndex = &hashIndex{entries: make(map[string]IndexEntry)}
+
+func indexFile() string {
+	return metaPath(".fire_index.json")
+}
+
+func (idx *hashIndex) load() {
+	var stored struct {
+		Updated int64        `json:"updated"`
+		Entries []IndexEntry `json:"entries"`
+	}
+	if err := readJSONFile(indexFile(), &stored); err != nil {
+		return
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.updated = stored.Updated
+	idx.entries = make(map[string]IndexEntry, len(stored.Entries))
+	for _, e := range stored.Entries {
+		idx.entries[e.Path] = e
+	}
+}
+
+func (idx *hashIndex) save() error {
+	idx.mu.Lock()
+	stored := struct {
+		Updated int64        `json:"updated"`
+		Entries []IndexEntry `json:"entries"`
+	}{Updated: idx.updated}
+	for _, e := range idx.entries {
+		stored.Entries = append(stored.Entries, e)
+	}
+	idx.mu.Unlock()
+	sort.Slice(stored.Entries, func(i, j int) bool { return stored.Entries[i].Path < stored.Entries[j].Path })
+	return writeHiddenJSON(indexFile(), stored)
+}
+
+// 查询某个路径的索引记录
+func (idx *hashIndex) lookup(relPath string) (IndexEntry, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	e, ok := idx.entries[relPath]
+	return e, ok
+}
+
+// 找一个内容哈希相同的已索引文件
+func (idx *hashIndex) findByHash(hash string) (string, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for p, e := range idx.entries {
+		if e.Hash == hash {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// 扫描一次根目录和各挂载点。返回本次检测到并已迁移元数据的移动记录（旧路径 -> 新路径）。
+// 服务停止时中途放弃，不保存半截结果
+func (idx *hashIndex) scan() (map[string]string, error) {
+	ctx := backgroundCtx()
+	idx.mu.Lock()
+	if idx.running {
+		idx.mu.Unlock()
+		return nil, nil
+	}
+	idx.running = true
+	prev := make(map[string]IndexEntry, len(idx.entries))
+	for k, v := range idx.entries {
+		prev[k] = v
+	}
+	idx.mu.Unlock()
+	gen := storage.beginScan()
+	defer func() {
+		storage.endScan(gen)
+		idx.mu.Lock()
+		idx.running = false
+		idx.mu.Unlock()
+	}()
+
+	current := make(map[string]IndexEntry)
+	err := walkLibrary(func(rel, p string, d fs.DirEntry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		e := IndexEntry{Path: rel, Size: info.Size(), ModTime: info.ModTime().Unix()}
+		if old, ok := prev[rel]; ok && old.Size == e.Size && old.ModTime == e.ModTime && old.Hash != "" {
+			e.Hash = old.Hash
+		} else if h, err := hashFile(p); err == nil {
+			e.Hash = h
+		} else {
+			return nil
+		}
+		current[rel] = e
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 消失的旧路径与新出现的路径按哈希配对，唯一匹配才视为移动
+	appeared := make(map[string][]string)
+	for p, e := range current {
+		if _, ok := prev[p]; !ok {
+			appeared[e.Hash] = append(appeared[e.Hash], p)
+		}
+	}
+	moves := make(map[string]string)
+	var lost []IndexEntry
+	for p, e := range prev {
+		if _, ok := current[p]; ok {
+			continue
+		}
+		if cands := appeared[e.Hash]; len(cands) == 1 {
+			moves[p] = cands[0]
+		} else {
+			lost = append(lost, e)
+		}
+	}
+	if len(moves) > 0 {
+		if _, err := relinkReferences(moves); err != nil {
+			logError("按哈希迁移元数据失败", err)
+		}
+		for old, np := range moves {
+			appLog.write(LogEntry{Type: "audit", Action: "refs.relink", Target: old, Detail: "to=" + np + " source=index"})
+		}
+	}
+	rememberLostFingerprints(lost)
+
+	idx.mu.Lock()
+	idx.entries = current
+	idx.updated = time.Now().Unix()
+	idx.lastMoves = moves
+	idx.mu.Unlock()
+
+	list := make([]IndexEntry, 0, len(current))
+	for _, e := range current {
+		list = append(list, e)
+	}
+	storage.rebuild(gen, list)
+	return moves, idx.save()
+}
+
+// 仍被元数据引用却找不到去向的文件，把指纹留给失效引用检查器，
+// 之后文件重新出现（例如从 U 盘拷回）时仍能按哈希匹配
+func rememberLostFingerprints(lost []IndexEntry) {
+	if len(lost) == 0 {
+		return
+	}
+	referenced := make(map[string]bool)
+	for _, ref := range collectReferences() {
+		referenced[ref.Path] = true
+	}
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	fpFile := metaPath(".fire_fingerprints.json")
+	db := make(map[string]fileFingerprint)
+	readJSONFile(fpFile, &db)
+	changed := false
+	for _, e := range lost {
+		if referenced[e.Path] {
+			db[e.Path] = fileFingerprint{Size: e.Size, ModTime: e.ModTime, Hash: e.Hash}
+			changed = true
+		}
+	}
+	if changed {
+		writeHiddenJSON(fpFile, db)
+	}
+}
+
+func (idx *hashIndex) status() IndexStatus {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	moves := idx.lastMoves
+	if moves == nil {
+		moves = map[string]string{}
+	}
+	return IndexStatus{Files: len(idx.entries), Updated: idx.updated, Running: idx.running, LastMoves: moves}
+}
+
+// 按哈希分组找出重复文件，按浪费空间从大到小排序
+func (idx *hashIndex) duplicates() []DuplicateGroup {
+	idx.mu.Lock()
+	byHash := make(map[string][]IndexEntry)
+	for _, e := range idx.entries {
+		if e.Size > 0 && e.Hash != "" {
+			byHash[e.Hash] = append(byHash[e.Hash], e)
+		}
+	}
+	idx.mu.Unlock()
+
+	groups := []DuplicateGroup{}
+	for h, list := range byHash {
+		if len(list) < 2 {
+			continue
+		}
+		g := DuplicateGroup{Hash: h, Size: list[0].Size, Wasted: list[0].Size * int64(len(list)-1)}
+		for _, e := range list {
+			g.Paths = append(g.Paths, e.Path)
+		}
+		sort.Strings(g.Paths)
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Wasted != groups[j].Wasted {
+			return groups[i].Wasted > groups[j].Wasted
+		}
+		return groups[i].Paths[0] < groups[j].Paths[0]
+	})
+	return groups
+}
+
+// 启动后台索引：先加载上次结果，随后立即扫描一次并定期重扫，服务停止时退出
+func startIndexer() {
+	fileIndex.load()
+	goBackground(func(ctx context.Context) {
+		for {
+			fileIndex.scan()
+			if !sleepOrStop(ctx, indexInterval) {
+				return
+			}
+		}
+	})
+}
+
+// 在后台立即重扫一次
+func rescanIndex() {
+	goBackground(func(context.Context) { fileIndex.scan() })
+}
+
+// 索引状态 API。最近的移动记录可能含未发布和受限文件夹的路径，只给教师端
+func handleIndexStatus(w http.ResponseWriter, r *http.Request) {
+	st := fileIndex.status()
+	if !isTeacherRequest(r) {
+		st.LastMoves = map[string]string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// 立即触发一次后台重扫（全库重新计算哈希，仅限教师端）
+func handleIndexRebuild(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireTeacher(w, r) {
+		return
+	}
+	rescanIndex()
+	auditLog(r, "index.rebuild", "", "")
+	w.Write([]byte("OK"))
+}
+
+// 重复文件报告 API：报告覆盖整个资料库（含未发布和受限挂载点的路径），仅限教师端
+func handleDuplicates(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	groups := fileIndex.duplicates()
+	var wasted int64
+	for _, g := range groups {
+		wasted += g.Wasted
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"groups": groups,
+		"wasted": wasted,
+	})
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ===== HTTP 缓存与压缩 =====
+// 内嵌页面按内容哈希生成 ETag 并预先压缩；列表、目录树、标签接口支持条件请求。
+// 文本响应透明 gzip 压缩，带 Range 的视频请求原样透传。
+// 标准库没有 brotli 编码器，为保持零依赖只提供 gzip。
+
+var (
+	bootID = strconv.FormatInt(time.Now().UnixNano(), 36)
+	// 元数据或上传内容每变化一次加一，用于目录 mtime 反映不出的修改（例如覆盖上传）
+	dataVersion atomic.Int64
+)
+
+// 由若干版本信息拼出弱 ETag；带上启动标识，重启后计数器归零也不会误判
+func makeETag(parts ...interface{}) string {
+	h := sha256.New()
+	fmt.Fprint(h, bootID)
+	for _, p := range parts {
+		fmt.Fprintf(h, "|%v", p)
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:8]) + `"`
+}
+
+func etagMatch(header, etag string) bool {
+	trim := func(s string) string { return strings.TrimPrefix(strings.TrimSpace(s), "W/") }
+	for _, part := range strings.Split(header, ",") {
+		if p := strings.TrimSpace(part); p == "*" || trim(p) == trim(etag) {
+			return true
+		}
+	}
+	return false
+}
+
+// 写入校验头；客户端缓存仍然有效时直接回 304 并返回 true。
+// modTime 为零值表示该资源没有可靠的修改时间，只按 ETag 判断。
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time) bool {
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", "no-cache")
+	if !modTime.IsZero() {
+		h.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagMatch(inm, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modTime.IsZero() {
+		if !modTime.Truncate(time.Second).After(ims) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// 若干元数据文件的版本标识与最近修改时间
+func metaFilesVersion(paths ...string) (string, time.Time) {
+	var parts []string
+	var latest time.Time
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			parts = append(parts, "-")
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%d:%d", info.ModTime().UnixNano(), info.Size()))
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return strings.Join(parts, ","), latest
+}
+
+// ===== 内嵌页面 =====
+
+type embeddedAsset struct {
+	data   []byte
+	gz     []byte
+	etag   string
+	gzETag string
+}
+
+var (
+	assetsOnce sync.Once
+	assets     = make(map[string]*embeddedAsset)
+)
+
+func loadAssets() {
+	entries, _ := staticFS.ReadDir("static")
+	for _, e := range entries {
+		name := "static/" + e.Name()
+		data, err := staticFS.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(data)
+		tag := hex.EncodeToString(sum[:8])
+		a := &embeddedAsset{data: data, etag: `"` + tag + `"`}
+		var buf bytes.Buffer
+		zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		zw.Write(data)
+		zw.Close()
+		a.gz = buf.Bytes()
+		a.gzETag = `"` + tag + `-gz"`
+		assets[name] = a
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+		return q > 0
+	}
+	return false
+}
+
+// 输出内嵌的 HTML 页面，支持 ETag 协商和预压缩
+func serveEmbedded(w http.ResponseWriter, r *http.Request, name string) {
+	assetsOnce.Do(loadAssets)
+	a := assets[name]
+	if a == nil {
+		http.NotFound(w, r)
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Add("Vary", "Accept-Encoding")
+	body, etag := a.data, a.etag
+	gz := acceptsGzip(r)
+	if gz {
+		body, etag = a.gz, a.gzETag
+	}
+	if notModified(w, r, etag, time.Time{}) {
+		return
+	}
+	if gz {
+		h.Set("Content-Encoding", "gzip")
+	}
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// ===== 透明压缩 =====
+
+const gzipMinSize = 1024
+
+var gzipPool = sync.Pool{New: func() interface{} {
+	zw, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+	return zw
+}}
+
+func compressibleType(ct string) bool {
+	ct = strings.ToLower(strings.TrimSpace(strings.SplitN(ct, ";", 2)[0]))
+	switch {
+	case ct == "text/event-stream":
+		return false // 推送流逐条刷新，压缩反而增加延迟
+	case strings.HasPrefix(ct, "text/"):
+		return true
+	}
+	switch ct {
+	case "application/json", "application/javascript", "application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	decided bool
+}
+
+// 在写出响应头前决定是否压缩
+func (g *gzipResponseWriter) decide(code int) {
+	g.decided = true
+	h := g.Header()
+	if code != http.StatusOK || h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" ||
+		!compressibleType(h.Get("Content-Type")) {
+		return
+	}
+	if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil && n < gzipMinSize {
+		return
+	}
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	h.Set("Content-Encoding", "gzip")
+	h.Add("Vary", "Accept-Encoding")
+	g.gz = gzipPool.Get().(*gzip.Writer)
+	g.gz.Reset(g.ResponseWriter)
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if !g.decided {
+		g.decide(code)
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.decided {
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+func (g *gzipResponseWriter) Flush() {
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (g *gzipResponseWriter) close() {
+	if g.gz != nil {
+		g.gz.Close()
+		gzipPool.Put(g.gz)
+		g.gz = nil
+	}
+}
+
+// 压缩中间件：只处理声明支持 gzip、且不带 Range 的请求
+func withCompression(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || r.Header.Get("Range") != "" || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
@@ -0,0 +1,671 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ===== 备课模板注册表 =====
+
+// 模板槽位定义
+type SlotDef struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"` // "text", "media", "list", "marker", "markdown", "quiz"
+	Label    string `json:"label"`
+	Multiple bool   `json:"multiple,omitempty"`
+	Area     string `json:"area,omitempty"` // grid 布局中的区域名，默认等于 ID
+}
+
+// 自定义模板的网格布局，Areas 对应 CSS grid-template-areas 的每一行
+type TemplateGrid struct {
+	Columns string   `json:"columns"`
+	Rows    string   `json:"rows,omitempty"`
+	Areas   []string `json:"areas"`
+}
+
+// 幻灯片模板（前端 TEMPLATES 的服务端版本）
+type LessonTemplate struct {
+	ID      string        `json:"id"`
+	Name    string        `json:"name"`
+	Icon    string        `json:"icon"`
+	Layout  string        `json:"layout"` // "list", "vertical", "horizontal", "full", "grid"
+	Slots   []SlotDef     `json:"slots"`
+	Grid    *TemplateGrid `json:"grid,omitempty"`
+	Custom  bool          `json:"custom,omitempty"`
+	Version int           `json:"version,omitempty"`
+	Updated int64         `json:"updated,omitempty"`
+}
+
+// 内置模板，顺序即编辑器中的展示顺序
+var builtinTemplates = []LessonTemplate{
+	{ID: "simple", Name: "简单列表", Icon: "📝", Layout: "list", Slots: []SlotDef{
+		{ID: "items", Type: "list", Label: "内容列表", Multiple: true},
+	}},
+	{ID: "titleMedia", Name: "标题+媒体", Icon: "🖼️", Layout: "vertical", Slots: []SlotDef{
+		{ID: "title", Type: "text", Label: "标题"},
+		{ID: "media", Type: "media", Label: "图片/视频"},
+	}},
+	{ID: "titleMediaSummary", Name: "完整模板", Icon: "📋", Layout: "vertical", Slots: []SlotDef{
+		{ID: "title", Type: "text", Label: "标题"},
+		{ID: "media", Type: "media", Label: "图片/视频"},
+		{ID: "summary", Type: "text", Label: "总结"},
+	}},
+	{ID: "twoColumn", Name: "双栏布局", Icon: "⬜⬜", Layout: "horizontal", Slots: []SlotDef{
+		{ID: "left", Type: "media", Label: "左侧内容"},
+		{ID: "right", Type: "media", Label: "右侧内容"},
+	}},
+	{ID: "fullMedia", Name: "全屏媒体", Icon: "🎬", Layout: "full", Slots: []SlotDef{
+		{ID: "media", Type: "media", Label: "全屏图片/视频"},
+	}},
+	{ID: "titleTwoMedia", Name: "标题+双媒体", Icon: "📊", Layout: "vertical", Slots: []SlotDef{
+		{ID: "title", Type: "text", Label: "标题"},
+		{ID: "media1", Type: "media", Label: "媒体1"},
+		{ID: "media2", Type: "media", Label: "媒体2"},
+	}},
+}
+
+// 按 ID 查找模板，自定义模板返回最新版本
+func findTemplate(id string) (LessonTemplate, bool) {
+	for _, t := range builtinTemplates {
+		if t.ID == id {
+			return t, true
+		}
+	}
+	return loadCustomTemplate(id, 0)
+}
+
+// 查找幻灯片实际使用的模板：自定义模板按保存时固定的版本解析，
+// 这样模板后续被修改时旧方案仍按原布局渲染
+func resolveSlideTemplate(slide Slide) (LessonTemplate, bool) {
+	if slide.TemplateVersion > 0 {
+		if t, ok := loadCustomTemplate(slide.Template, slide.TemplateVersion); ok {
+			return t, true
+		}
+	}
+	return findTemplate(slide.Template)
+}
+
+// 为引用自定义模板但尚未固定版本的幻灯片记录当前最新版本
+func pinTemplateVersions(plan *LessonPlan) {
+	for i := range plan.Slides {
+		slide := &plan.Slides[i]
+		if slide.TemplateVersion > 0 {
+			continue
+		}
+		if t, ok := findTemplate(slide.Template); ok && t.Custom {
+			slide.TemplateVersion = t.Version
+		}
+	}
+}
+
+// 模板列表 API（内置 + 自定义最新版本）
+func handleListTemplates(w http.ResponseWriter, r *http.Request) {
+	list := append([]LessonTemplate{}, builtinTemplates...)
+	list = append(list, listCustomTemplates()...)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// ===== 自定义模板存储 =====
+// 每个模板一个目录 .fire_templates/<id>/，每次保存写入新的 v<N>.json，旧版本永不覆盖
+
+var slotTypes = map[string]bool{
+	"text": true, "media": true, "list": true, "marker": true, "markdown": true, "quiz": true,
+}
+
+func templateDir(id string) string {
+	return filepath.Join(rootDir, ".fire_templates", id)
+}
+
+func isValidTemplateID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// 列出某个模板已保存的全部版本号（升序）
+func templateVersions(id string) []int {
+	entries, err := os.ReadDir(templateDir(id))
+	if err != nil {
+		return nil
+	}
+	var versions []int
+	for _, e := range entries {
+		var v int
+		// 只认完整的 v<N>.json，忽略写入中的临时文件
+		if _, err := fmt.Sscanf(e.Name(), "v%d.json", &v); err == nil && v > 0 && e.Name() == fmt.Sprintf("v%d.json", v) {
+			versions = append(versions, v)
+		}
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// 读取自定义模板，version 为 0 时读取最新版本
+func loadCustomTemplate(id string, version int) (LessonTemplate, bool) {
+	if !isValidTemplateID(id) {
+		return LessonTemplate{}, false
+	}
+	if version == 0 {
+		versions := templateVersions(id)
+		if len(versions) == 0 {
+			return LessonTemplate{}, false
+		}
+		version = versions[len(versions)-1]
+	}
+	data, err := os.ReadFile(filepath.Join(templateDir(id), fmt.Sprintf("v%d.json", version)))
+	if err != nil {
+		return LessonTemplate{}, false
+	}
+	var t LessonTemplate
+	if err := json.Unmarshal(data, &t); err != nil {
+		return LessonTemplate{}, false
+	}
+	return t, true
+}
+
+func listCustomTemplates() []LessonTemplate {
+	entries, err := os.ReadDir(filepath.Join(rootDir, ".fire_templates"))
+	if err != nil {
+		return nil
+	}
+	var list []LessonTemplate
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if t, ok := loadCustomTemplate(e.Name(), 0); ok {
+			list = append(list, t)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name)
+	})
+	return list
+}
+
+func validateTemplate(t *LessonTemplate) []FieldError {
+	var errs []FieldError
+	if !isValidTemplateID(t.ID) {
+		errs = append(errs, FieldError{Field: "id", Message: "模板 ID 只能包含字母、数字、下划线和连字符"})
+	}
+	for _, b := range builtinTemplates {
+		if b.ID == t.ID {
+			errs = append(errs, FieldError{Field: "id", Message: "不能覆盖内置模板"})
+		}
+	}
+	if strings.TrimSpace(t.Name) == "" {
+		errs = append(errs, FieldError{Field: "name", Message: "模板名称不能为空"})
+	} else if utf8.RuneCountInString(t.Name) > 64 {
+		errs = append(errs, FieldError{Field: "name", Message: "模板名称不能超过 64 个字"})
+	}
+	if utf8.RuneCountInString(t.Icon) > 8 {
+		errs = append(errs, FieldError{Field: "icon", Message: "图标最多 8 个字符"})
+	}
+	if len(t.Slots) == 0 {
+		errs = append(errs, FieldError{Field: "slots", Message: "至少需要一个槽位"})
+	}
+
+	areas := make(map[string]bool)
+	for i := range t.Slots {
+		slot := &t.Slots[i]
+		field := fmt.Sprintf("slots[%d]", i)
+		if !isValidTemplateID(slot.ID) {
+			errs = append(errs, FieldError{Field: field + ".id", Message: "槽位 ID 不合法"})
+		}
+		if !slotTypes[slot.Type] {
+			errs = append(errs, FieldError{Field: field + ".type", Message: "未知槽位类型: " + slot.Type})
+		}
+		if utf8.RuneCountInString(slot.Label) > 64 {
+			errs = append(errs, FieldError{Field: field + ".label", Message: "槽位名称不能超过 64 个字"})
+		}
+		if slot.Type == "list" {
+			slot.Multiple = true
+		}
+		if slot.Area == "" {
+			slot.Area = slot.ID
+		}
+		if !isGridIdent(slot.Area) {
+			errs = append(errs, FieldError{Field: field + ".area", Message: "区域名只能包含字母、数字、下划线和连字符，且不能以数字开头: " + slot.Area})
+		}
+		if areas[slot.Area] {
+			errs = append(errs, FieldError{Field: field + ".area", Message: "区域重复: " + slot.Area})
+		}
+		areas[slot.Area] = true
+	}
+
+	if t.Grid == nil || len(t.Grid.Areas) == 0 {
+		errs = append(errs, FieldError{Field: "grid.areas", Message: "缺少网格布局"})
+		return errs
+	}
+	// 列宽、行高原样放进编辑器的 style 属性，只接受网格轨道语法
+	if t.Grid.Columns != "" && !isGridTrackList(t.Grid.Columns) {
+		errs = append(errs, FieldError{Field: "grid.columns", Message: "列宽只能使用 fr、px、%、auto、minmax() 和 repeat()，例如 1fr 2fr"})
+	}
+	if t.Grid.Rows != "" && !isGridTrackList(t.Grid.Rows) {
+		errs = append(errs, FieldError{Field: "grid.rows", Message: "行高只能使用 fr、px、%、auto、minmax() 和 repeat()，例如 auto 1fr"})
+	}
+	cols := -1
+	for i, row := range t.Grid.Areas {
+		cells := strings.Fields(row)
+		if cols >= 0 && len(cells) != cols {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("grid.areas[%d]", i), Message: "每行的列数必须一致"})
+		}
+		cols = len(cells)
+		for _, cell := range cells {
+			if cell != "." && !areas[cell] {
+				errs = append(errs, FieldError{Field: fmt.Sprintf("grid.areas[%d]", i), Message: "未定义的区域: " + cell})
+			}
+		}
+	}
+	return errs
+}
+
+// ===== 网格语法 =====
+
+// CSS 标识符的安全子集：字母或下划线开头，其后为字母、数字、下划线、连字符
+func isGridIdent(s string) bool {
+	if s == "" || len(s) > 64 {
+		return false
+	}
+	for i, c := range s {
+		letter := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+		if !letter && (i == 0 || !(c >= '0' && c <= '9' || c == '-')) {
+			return false
+		}
+	}
+	return true
+}
+
+// 单个尺寸：auto、0，或带 fr / px / % 单位的非负数
+func isGridSize(s string) bool {
+	if s == "auto" || s == "0" {
+		return true
+	}
+	num := s
+	for _, unit := range []string{"fr", "px", "%"} {
+		if strings.HasSuffix(s, unit) {
+			num = strings.TrimSuffix(s, unit)
+			break
+		}
+	}
+	if num == s || num == "" || strings.Count(num, ".") > 1 || strings.HasPrefix(num, ".") || strings.HasSuffix(num, ".") {
+		return false
+	}
+	for _, c := range num {
+		if !(c >= '0' && c <= '9' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// name(参数) 形式时返回括号内的参数
+func gridFunc(s, name string) (string, bool) {
+	if !strings.HasPrefix(s, name+"(") || !strings.HasSuffix(s, ")") {
+		return "", false
+	}
+	return s[len(name)+1 : len(s)-1], true
+}
+
+// 轨道：尺寸或 minmax(尺寸, 尺寸)
+func isGridTrack(s string) bool {
+	if args, ok := gridFunc(s, "minmax"); ok {
+		min, max, ok := strings.Cut(args, ",")
+		return ok && isGridSize(strings.TrimSpace(min)) && isGridSize(strings.TrimSpace(max))
+	}
+	return isGridSize(s)
+}
+
+// 按括号外的空白拆分轨道；括号不配对时返回 nil
+func splitTracks(s string) []string {
+	var tracks []string
+	depth, start := 0, -1
+	for i, c := range s {
+		switch {
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth < 0 {
+				return nil
+			}
+		case c == ' ' || c == '\t':
+			if depth == 0 {
+				if start >= 0 {
+					tracks = append(tracks, s[start:i])
+				}
+				start = -1
+				continue
+			}
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if depth != 0 {
+		return nil
+	}
+	if start >= 0 {
+		tracks = append(tracks, s[start:])
+	}
+	return tracks
+}
+
+// 轨道列表，例如 "1fr 2fr"、"200px repeat(3, minmax(0, 1fr))"；repeat 不能嵌套
+func isGridTrackList(s string) bool {
+	if len(s) > 200 {
+		return false
+	}
+	tracks := splitTracks(s)
+	if len(tracks) == 0 {
+		return false
+	}
+	for _, track := range tracks {
+		if args, ok := gridFunc(track, "repeat"); ok {
+			count, list, ok := strings.Cut(args, ",")
+			n, err := strconv.Atoi(strings.TrimSpace(count))
+			inner := splitTracks(strings.TrimSpace(list))
+			if !ok || err != nil || n < 1 || n > 24 || len(inner) == 0 {
+				return false
+			}
+			for _, t := range inner {
+				if !isGridTrack(t) {
+					return false
+				}
+			}
+			continue
+		}
+		if !isGridTrack(track) {
+			return false
+		}
+	}
+	return true
+}
+
+// 以新版本号写入模板。版本号在元数据锁内分配，并发保存不会拿到同一个号而互相覆盖
+func saveTemplateVersion(t *LessonTemplate) error {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	t.Version = nextTemplateVersion(t.ID)
+	t.Updated = time.Now().Unix()
+	return writeTemplateVersion(*t)
+}
+
+func nextTemplateVersion(id string) int {
+	versions := templateVersions(id)
+	if len(versions) == 0 {
+		return 1
+	}
+	return versions[len(versions)-1] + 1
+}
+
+// 模板内容指纹，不含版本号和保存时间：两台机器上各自编号的同一份模板指纹相同
+func templateHash(t LessonTemplate) string {
+	t.Version, t.Updated = 0, 0
+	data, _ := json.Marshal(t)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// 把模板写到 v<t.Version>.json（调用方持有 metaMu）
+func writeTemplateVersion(t LessonTemplate) error {
+	dir := templateDir(t.ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		exec.Command("attrib", "+h", filepath.Dir(dir)).Run()
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, fmt.Sprintf("v%d.json", t.Version)), 0644, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// 保存自定义模板（每次保存生成新版本）
+func handleSaveTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireTeacher(w, r) {
+		return
+	}
+	var t LessonTemplate
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "Bad JSON", 400)
+		return
+	}
+	t.Layout = "grid"
+	t.Custom = true
+	if t.Icon == "" {
+		t.Icon = "🧩"
+	}
+	if errs := validateTemplate(&t); len(errs) > 0 {
+		writeValidationErrors(w, "模板校验失败", errs)
+		return
+	}
+
+	if err := saveTemplateVersion(&t); err != nil {
+		logError("写入模板失败", err)
+		http.Error(w, "写入模板失败", http.StatusInternalServerError)
+		return
+	}
+	auditLog(r, "template.save", t.ID, auditDetail("version", t.Version))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// 获取指定模板（可指定版本），?history=1 时返回版本号列表
+func handleGetTemplate(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if r.URL.Query().Get("history") == "1" {
+		if !isValidTemplateID(id) {
+			http.Error(w, "模板 ID 非法", http.StatusBadRequest)
+			return
+		}
+		versions := templateVersions(id)
+		if versions == nil {
+			versions = []int{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(versions)
+		return
+	}
+	version, _ := strconv.Atoi(r.URL.Query().Get("version"))
+	var t LessonTemplate
+	var ok bool
+	if version > 0 {
+		t, ok = loadCustomTemplate(id, version)
+	} else {
+		t, ok = findTemplate(id)
+	}
+	if !ok {
+		http.Error(w, "Not found", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// ===== 备课方案校验 =====
+
+// 字段级校验错误，Field 形如 slides[2].slots.media.path
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type ValidationResponse struct {
+	Error  string       `json:"error"`
+	Fields []FieldError `json:"fields"`
+}
+
+func writeValidationErrors(w http.ResponseWriter, msg string, errs []FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(ValidationResponse{Error: msg, Fields: errs})
+}
+
+// 方案名直接作为文件名，不允许包含路径分隔符等非法字符
+func isValidLessonName(name string) bool {
+	if name == "" || name == "." || name == ".." || strings.HasPrefix(name, ".") {
+		return false
+	}
+	return !strings.ContainsAny(name, `/\:*?"<>|`)
+}
+
+func validateLessonPlan(plan *LessonPlan) []FieldError {
+	return validateLessonPlanWith(plan, resolveSlideTemplate, quizExists)
+}
+
+// 按给定的模板解析和测验查找校验方案；导入备课包时用来认可包内自带、尚未写入本机的模板和测验
+func validateLessonPlanWith(plan *LessonPlan, resolve func(Slide) (LessonTemplate, bool), quizOK func(string) bool) []FieldError {
+	var errs []FieldError
+	if !isValidLessonName(plan.Name) {
+		errs = append(errs, FieldError{Field: "name", Message: "方案名称为空或包含非法字符"})
+	}
+	for i, slide := range plan.Slides {
+		prefix := fmt.Sprintf("slides[%d]", i)
+		tpl, ok := resolve(slide)
+		if !ok {
+			errs = append(errs, FieldError{Field: prefix + ".template", Message: "未知模板: " + slide.Template})
+			continue
+		}
+		known := make(map[string]bool)
+		for _, def := range tpl.Slots {
+			known[def.ID] = true
+			errs = append(errs, validateSlot(prefix+".slots."+def.ID, def, slide.Slots[def.ID], quizOK)...)
+		}
+		for id := range slide.Slots {
+			if !known[id] {
+				errs = append(errs, FieldError{Field: prefix + ".slots." + id, Message: "模板中不存在该槽位"})
+			}
+		}
+	}
+	return errs
+}
+
+func validateSlot(field string, def SlotDef, raw interface{}, quizOK func(string) bool) []FieldError {
+	if raw == nil {
+		return nil
+	}
+	if def.Multiple {
+		list, ok := raw.([]interface{})
+		if !ok {
+			return []FieldError{{Field: field, Message: "应为列表"}}
+		}
+		var errs []FieldError
+		for i, v := range list {
+			errs = append(errs, validateSlideItem(fmt.Sprintf("%s[%d]", field, i), v, "text", "media", "marker")...)
+		}
+		return errs
+	}
+	switch def.Type {
+	case "text", "markdown":
+		if _, ok := raw.(string); !ok {
+			return []FieldError{{Field: field, Message: "应为文本"}}
+		}
+		return nil
+	case "media":
+		return validateSlideItem(field, raw, "media", "marker")
+	case "marker":
+		return validateSlideItem(field, raw, "marker")
+	case "quiz":
+		name, ok := raw.(string)
+		if !ok || strings.TrimSpace(name) == "" {
+			return []FieldError{{Field: field, Message: "应为测验名称"}}
+		}
+		if !quizOK(strings.TrimSpace(name)) {
+			return []FieldError{{Field: field, Message: "测验不存在"}}
+		}
+		return nil
+	}
+	return []FieldError{{Field: field, Message: "未知槽位类型: " + def.Type}}
+}
+
+// 校验单个素材项，allowed 为该位置允许出现的素材类型
+func validateSlideItem(field string, raw interface{}, allowed ...string) []FieldError {
+	obj, ok := raw.(map[string]interface{})
+	if !ok {
+		return []FieldError{{Field: field, Message: "应为素材对象"}}
+	}
+	data, _ := json.Marshal(obj)
+	var item SlideItem
+	if err := json.Unmarshal(data, &item); err != nil {
+		return []FieldError{{Field: field, Message: "素材格式错误"}}
+	}
+
+	typeOK := false
+	for _, t := range allowed {
+		if item.Type == t {
+			typeOK = true
+			break
+		}
+	}
+	if !typeOK {
+		return []FieldError{{Field: field + ".type", Message: "不允许的素材类型: " + item.Type}}
+	}
+
+	var errs []FieldError
+	switch item.Type {
+	case "text":
+		if strings.TrimSpace(item.Content) == "" {
+			errs = append(errs, FieldError{Field: field + ".content", Message: "文本内容为空"})
+		}
+	case "media", "marker":
+		if msg := checkMediaPath(item.Path); msg != "" {
+			errs = append(errs, FieldError{Field: field + ".path", Message: msg})
+		}
+		if item.Type == "marker" && item.StartTime < 0 {
+			errs = append(errs, FieldError{Field: field + ".startTime", Message: "开始时间不能为负数"})
+		}
+	}
+	return errs
+}
+
+// 检查素材路径是否规范、安全且文件存在，返回空串表示通过
+func checkMediaPath(relPath string) string {
+	if relPath == "" {
+		return "缺少素材路径"
+	}
+	if cleanRelPath(relPath) != relPath {
+		return "路径不规范"
+	}
+	absPath, ok := resolvePath(relPath)
+	if !ok {
+		return "禁止访问"
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return "文件不存在"
+	}
+	if info.IsDir() {
+		return "不能引用文件夹"
+	}
+	return ""
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ===== 文件列表查询 =====
+// /api/list 支持服务端排序、筛选和分页，大文件夹不必一次返回全部条目：
+//   sort=name|mtime|size|type  order=asc|desc  q=名称关键字  category=video,image,folder
+//   tag=标签  since=秒级时间戳（只要此后修改过的，用于「本周新增」）  offset=  limit=
+// 文件夹总在文件前面；total 为筛选后、分页前的条目数。
+
+const maxListLimit = 1000
+
+type listQuery struct {
+	sort       string
+	desc       bool
+	keyword    string
+	categories []string
+	tag        string
+	since      int64
+	offset     int
+	limit      int // 0 表示不分页
+}
+
+func parseListQuery(v url.Values) (listQuery, []FieldError) {
+	q := listQuery{sort: v.Get("sort"), keyword: strings.ToLower(strings.TrimSpace(v.Get("q"))), tag: v.Get("tag")}
+	var errs []FieldError
+	switch q.sort {
+	case "":
+		q.sort = "name"
+	case "name", "mtime", "size", "type":
+	default:
+		errs = append(errs, FieldError{Field: "sort", Message: "排序方式只能是 name、mtime、size 或 type"})
+	}
+	switch v.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.desc = true
+	default:
+		errs = append(errs, FieldError{Field: "order", Message: "顺序只能是 asc 或 desc"})
+	}
+	if c := v.Get("category"); c != "" {
+		for _, cat := range strings.Split(c, ",") {
+			if cat = strings.TrimSpace(cat); cat != "" {
+				q.categories = append(q.categories, cat)
+			}
+		}
+	}
+	intParam := func(name string, max int) int {
+		s := v.Get(name)
+		if s == "" {
+			return 0
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || (max > 0 && n > max) {
+			msg := "必须是非负整数"
+			if max > 0 {
+				msg = "必须是 0 到 " + strconv.Itoa(max) + " 之间的整数"
+			}
+			errs = append(errs, FieldError{Field: name, Message: msg})
+			return 0
+		}
+		return n
+	}
+	q.offset = intParam("offset", 0)
+	q.limit = intParam("limit", maxListLimit)
+	if s := v.Get("since"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			errs = append(errs, FieldError{Field: "since", Message: "必须是秒级时间戳"})
+		}
+		q.since = n
+	}
+	return q, errs
+}
+
+func (q listQuery) match(f FileInfo) bool {
+	if q.keyword != "" && !strings.Contains(strings.ToLower(f.Name), q.keyword) {
+		return false
+	}
+	if len(q.categories) > 0 && !containsString(q.categories, f.Category) {
+		return false
+	}
+	if q.tag != "" && !containsString(f.Tags, q.tag) {
+		return false
+	}
+	return q.since == 0 || f.ModTime >= q.since
+}
+
+// 筛选、排序、分页，返回当前页和筛选后的总数
+func (q listQuery) apply(files []FileInfo) ([]FileInfo, int) {
+	matched := []FileInfo{}
+	for _, f := range files {
+		if q.match(f) {
+			matched = append(matched, f)
+		}
+	}
+	byName := func(a, b FileInfo) bool { return strings.ToLower(a.Name) < strings.ToLower(b.Name) }
+	less := byName
+	switch q.sort {
+	case "mtime":
+		less = func(a, b FileInfo) bool {
+			if a.ModTime != b.ModTime {
+				return a.ModTime < b.ModTime
+			}
+			return byName(a, b)
+		}
+	case "size":
+		less = func(a, b FileInfo) bool {
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+			return byName(a, b)
+		}
+	case "type":
+		less = func(a, b FileInfo) bool {
+			if a.Category != b.Category {
+				return a.Category < b.Category
+			}
+			return byName(a, b)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		if q.desc {
+			return less(b, a)
+		}
+		return less(a, b)
+	})
+	total := len(matched)
+	if q.offset >= total {
+		return []FileInfo{}, total
+	}
+	matched = matched[q.offset:]
+	if q.limit > 0 && len(matched) > q.limit {
+		matched = matched[:q.limit]
+	}
+	return matched, total
+}
+
+// 文件夹中对该请求可见的直接子项数
+func countVisible(r *http.Request, relDir, absDir string) int {
+	entries, err := os.ReadDir(absDir)
+	if err != nil {
+		return 0
+	}
+	filter := newListFilter(relDir)
+	n := 0
+	for _, e := range entries {
+		if !filter.hidden(e.Name(), e.IsDir()) && !hiddenFrom(r, joinRel(relDir, e.Name())) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== 结构化日志 =====
+// 以 JSON Lines 写入 .fire_logs/firecloud.log，超过大小后滚动为 .1 ~ .N。
+// 三类记录：request（每个 HTTP 请求）、error（服务端错误）、audit（所有修改操作）。
+
+const (
+	logMaxSize  = 5 << 20
+	logMaxFiles = 5
+)
+
+type LogEntry struct {
+	Time     string `json:"time"`
+	Type     string `json:"type"` // "request", "error", "audit"
+	IP       string `json:"ip,omitempty"`
+	User     string `json:"user,omitempty"`
+	Method   string `json:"method,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Status   int    `json:"status,omitempty"`
+	Duration int64  `json:"ms,omitempty"`
+	Bytes    int64  `json:"bytes,omitempty"`
+	Action   string `json:"action,omitempty"`
+	Target   string `json:"target,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type rotatingLog struct {
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	gen  int // 每轮转一次加一，查询据此判断读取期间文件是否换了编号
+}
+
+var appLog = &rotatingLog{}
+
+func logDir() string {
+	return metaPath(".fire_logs")
+}
+
+func logFileName(n int) string {
+	name := filepath.Join(logDir(), "firecloud.log")
+	if n > 0 {
+		name += "." + strconv.Itoa(n)
+	}
+	return name
+}
+
+func (l *rotatingLog) open() error {
+	dir := logDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		exec.Command("attrib", "+h", dir).Run()
+	}
+	f, err := os.OpenFile(logFileName(0), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, _ := f.Stat()
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+func (l *rotatingLog) rotate() {
+	l.file.Close()
+	l.file = nil
+	os.Remove(logFileName(logMaxFiles))
+	for i := logMaxFiles - 1; i >= 0; i-- {
+		os.Rename(logFileName(i), logFileName(i+1))
+	}
+	l.gen++
+}
+
+func (l *rotatingLog) generation() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.gen
+}
+
+func (l *rotatingLog) write(e LogEntry) {
+	if e.Time == "" {
+		e.Time = time.Now().Format(time.RFC3339Nano)
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			return
+		}
+	}
+	if l.size+int64(len(data)) > logMaxSize {
+		l.rotate()
+		if err := l.open(); err != nil {
+			return
+		}
+	}
+	n, _ := l.file.Write(data)
+	l.size += int64(n)
+}
+
+// ===== 请求身份 =====
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// 请求对应的用户名，匿名访问或凭据错误时返回空串；加入了班级的学生返回「班级/姓名#学号」
+func requestUser(r *http.Request) string {
+	if acct, ok := authenticate(r); ok {
+		return acct.Name
+	}
+	if id, ok := studentIdentity(r); ok {
+		return id.label()
+	}
+	return ""
+}
+
+func logError(msg string, err error) {
+	e := LogEntry{Type: "error", Detail: msg}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	appLog.write(e)
+}
+
+// 记录一次修改操作
+func auditLog(r *http.Request, action, target, detail string) {
+	appLog.write(LogEntry{
+		Type:   "audit",
+		IP:     clientIP(r),
+		User:   requestUser(r),
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Action: action,
+		Target: target,
+		Detail: detail,
+	})
+}
+
+// 记录响应状态码和字节数，同时透传 Flush 以支持流式响应
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// 请求日志中间件
+func withRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		e := LogEntry{
+			Type:     "request",
+			IP:       clientIP(r),
+			User:     requestUser(r),
+			Method:   r.Method,
+			Path:     r.URL.RequestURI(),
+			Status:   rec.status,
+			Duration: time.Since(start).Milliseconds(),
+			Bytes:    rec.bytes,
+		}
+		if rec.status >= 500 {
+			e.Type = "error"
+		}
+		appLog.write(e)
+	})
+}
+
+// ===== 日志查询 API =====
+// GET /api/logs?type=audit&user=&action=&since=&until=&limit=100
+// since/until 支持 RFC3339 或 Unix 秒，结果按时间倒序
+
+func parseLogTime(s string) (time.Time, bool) {
+	if s == "" {
+		return time.Time{}, false
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), true
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// 读取时不持有 appLog.mu，查询几十 MB 的旧日志也不会卡住其他请求写日志。
+// 读取期间发生轮转时文件编号整体后移，结果可能重复或缺漏，重新读一遍
+func queryLogs(typ, user, action string, since, until time.Time, limit int) []LogEntry {
+	var out []LogEntry
+	for try := 0; try < 3; try++ {
+		gen := appLog.generation()
+		out = scanLogs(typ, user, action, since, until, limit)
+		if appLog.generation() == gen {
+			break
+		}
+	}
+	return out
+}
+
+func scanLogs(typ, user, action string, since, until time.Time, limit int) []LogEntry {
+	var out []LogEntry
+	for n := 0; n <= logMaxFiles && len(out) < limit; n++ {
+		f, err := os.Open(logFileName(n))
+		if err != nil {
+			continue
+		}
+		var entries []LogEntry
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 1<<20)
+		for sc.Scan() {
+			var e LogEntry
+			if json.Unmarshal(sc.Bytes(), &e) != nil {
+				continue
+			}
+			if typ != "" && e.Type != typ || user != "" && e.User != user || action != "" && e.Action != action {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339Nano, e.Time)
+			if err != nil || !since.IsZero() && t.Before(since) || !until.IsZero() && t.After(until) {
+				continue
+			}
+			entries = append(entries, e)
+		}
+		f.Close()
+		for i := len(entries) - 1; i >= 0 && len(out) < limit; i-- {
+			out = append(out, entries[i])
+		}
+	}
+	return out
+}
+
+func handleQueryLogs(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	since, _ := parseLogTime(q.Get("since"))
+	until, _ := parseLogTime(q.Get("until"))
+	entries := queryLogs(q.Get("type"), q.Get("user"), q.Get("action"), since, until, limit)
+	if entries == nil {
+		entries = []LogEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// 审计详情的小工具：把键值对拼成 "k=v k=v"
+func auditDetail(kv ...interface{}) string {
+	var parts []string
+	for i := 0; i+1 < len(kv); i += 2 {
+		parts = append(parts, fmt.Sprintf("%v=%v", kv[i], kv[i+1]))
+	}
+	return strings.Join(parts, " ")
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"embed"
 	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
@@ -13,46 +16,63 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
-	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"net"
 
-	"github.com/getlantern/systray"
 	"github.com/skip2/go-qrcode"
 )
 
 //go:embed static/*
 var staticFS embed.FS
 
-const (
+// 默认值，可由 serve 命令的 -root / -addr 覆盖
+var (
 	listenAddr = ":80"
 	rootDir    = `D:\Fire`
 )
 
+// 退出时等待进行中请求的最长时间
+const shutdownTimeout = 15 * time.Second
+
 var server *http.Server
 
 // ===== 数据结构 =====
 type FileInfo struct {
-	Name  string `json:"name"`
-	IsDir bool   `json:"isDir"`
-	Size  int64  `json:"size"`
+	Name         string     `json:"name"`
+	IsDir        bool       `json:"isDir"`
+	Size         int64      `json:"size"`
+	ModTime      int64      `json:"mtime"`                  // 秒级时间戳
+	Count        int        `json:"count,omitempty"`        // 文件夹中的项目数
+	Tags         []string   `json:"tags,omitempty"`         // 文件或文件夹的标签
+	Markers      int        `json:"markers,omitempty"`      // 书签数
+	BadMarkers   int        `json:"badMarkers,omitempty"`   // 超出视频时长的书签数
+	IsCourseware bool       `json:"isCourseware,omitempty"` // 文件夹内有 index.html，访问时直接打开 H5 课件
+	Media        *MediaInfo `json:"media,omitempty"`        // 音视频的时长、分辨率、编码和标题
+	FileType
 }
 type ListResponse struct {
-	Files []FileInfo `json:"files"`
-	Path  string     `json:"path"`
+	Files    []FileInfo `json:"files"`
+	Path     string     `json:"path"`
+	ReadOnly bool       `json:"readOnly,omitempty"` // 位于只读挂载点内
+	Total    int        `json:"total"`              // 筛选后、分页前的条目数
 }
 
 // 视频书签数据结构
 type Marker struct {
-	Time  float64 `json:"time"`
-	Label string  `json:"label"`
+	Time      float64 `json:"time"`
+	Label     string  `json:"label"`
+	BeyondEnd bool    `json:"beyondEnd,omitempty"` // 超出视频时长，只在响应中标记，不保存
 }
 type MarkersResponse struct {
-	Markers []Marker `json:"markers"`
+	Markers  []Marker `json:"markers"`
+	Duration float64  `json:"duration,omitempty"` // 视频时长（秒），未知时为 0
 }
 
 // ===== 备课系统数据结构 =====
@@ -65,9 +85,10 @@ type SlideItem struct {
 }
 
 type Slide struct {
-	Name     string                 `json:"name"`
-	Template string                 `json:"template"`
-	Slots    map[string]interface{} `json:"slots"`
+	Name            string                 `json:"name"`
+	Template        string                 `json:"template"`
+	TemplateVersion int                    `json:"templateVersion,omitempty"` // 自定义模板固定的版本
+	Slots           map[string]interface{} `json:"slots"`
 }
 
 type LessonPlan struct {
@@ -83,93 +104,22 @@ type TreeNode struct {
 	IsDir    bool       `json:"isDir"`
 	Tags     []string   `json:"tags"`
 	Markers  []Marker   `json:"markers,omitempty"`
+	Media    *MediaInfo `json:"media,omitempty"`
 	Children []TreeNode `json:"children,omitempty"`
+	Lazy     bool       `json:"lazy,omitempty"` // 子节点未加载，展开时按 path 再取
 }
 
 func main() {
-	os.MkdirAll(rootDir, 0755)
-	systray.Run(onReady, onExit)
-}
-
-func onReady() {
-	systray.SetIcon(createFireIcon())
-	systray.SetTitle("FireCloud")
-	systray.SetTooltip("FireCloud 教学云盘 · 运行中")
-
-	mOpen := systray.AddMenuItem("🌐 打开浏览器", "打开管理页面")
-	mDir := systray.AddMenuItem("📁 打开 D:\\Fire", "打开文件目录")
-	systray.AddSeparator()
-	mAutoStart := systray.AddMenuItemCheckbox("🚀 开机启动", "设置程序开机自动运行", isAutoStartEnabled())
-	systray.AddSeparator()
-	mInfo := systray.AddMenuItem("📡 "+getLocalIP()+listenAddr, "服务地址")
-	mInfo.Disable()
-	systray.AddSeparator()
-	mQuit := systray.AddMenuItem("❌ 退出", "关闭服务并退出")
-
-	go startServer()
-	go func() {
-		time.Sleep(500 * time.Millisecond)
-		openBrowser(fmt.Sprintf("http://localhost%s", listenAddr))
-	}()
-
-	go func() {
-		for {
-			select {
-			case <-mOpen.ClickedCh:
-				openBrowser(fmt.Sprintf("http://localhost%s", listenAddr))
-			case <-mDir.ClickedCh:
-				exec.Command("explorer", rootDir).Start()
-			case <-mAutoStart.ClickedCh:
-				if mAutoStart.Checked() {
-					if disableAutoStart() {
-						mAutoStart.Uncheck()
-					}
-				} else {
-					if enableAutoStart() {
-						mAutoStart.Check()
-					}
-				}
-			case <-mQuit.ClickedCh:
-				systray.Quit()
-			}
-		}
-	}()
-}
-
-func onExit() {
-	if server != nil {
-		server.Close()
-	}
-	os.Exit(0)
-}
-
-// ===== Windows 开机启动管理 =====
-const runKey = `Software\Microsoft\Windows\CurrentVersion\Run`
-const appName = "FireCloud"
-
-func isAutoStartEnabled() bool {
-	if runtime.GOOS != "windows" {
-		return false
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:]))
 	}
-	cmd := exec.Command("reg", "query", "HKCU\\"+runKey, "/v", appName)
-	return cmd.Run() == nil
-}
-
-func enableAutoStart() bool {
-	exe, err := os.Executable()
-	if err != nil {
-		return false
-	}
-	cmd := exec.Command("reg", "add", "HKCU\\"+runKey, "/v", appName, "/t", "REG_SZ", "/d", exe, "/f")
-	return cmd.Run() == nil
-}
-
-func disableAutoStart() bool {
-	cmd := exec.Command("reg", "delete", "HKCU\\"+runKey, "/v", appName, "/f")
-	return cmd.Run() == nil
+	os.MkdirAll(rootDir, 0755)
+	runTray()
 }
 
-func startServer() {
+// 注册全部路由并创建 HTTP 服务
+func newServer() *http.Server {
+	loadConfig()
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/share", handleShare)
 	mux.HandleFunc("/api/list", handleList)
@@ -186,24 +136,245 @@ func startServer() {
 	mux.HandleFunc("/api/lesson/save", handleSaveLesson)
 	mux.HandleFunc("/api/lesson/list", handleListLessons)
 	mux.HandleFunc("/api/lesson/get", handleGetLesson)
+	mux.HandleFunc("/api/lesson/templates", handleListTemplates)
+	mux.HandleFunc("/api/lesson/templates/get", handleGetTemplate)
+	mux.HandleFunc("/api/lesson/templates/save", handleSaveTemplate)
 	mux.HandleFunc("/api/tree", handleGetTree)
+	mux.HandleFunc("/api/check", handleCheck)
+	mux.HandleFunc("/api/check/fix", handleCheckFix)
+	mux.HandleFunc("/api/index/status", handleIndexStatus)
+	mux.HandleFunc("/api/index/rebuild", handleIndexRebuild)
+	mux.HandleFunc("/api/index/duplicates", handleDuplicates)
+	mux.HandleFunc("/api/storage", handleStorage)
+	mux.HandleFunc("/api/storage/quotas", handleSaveQuotas)
+	mux.HandleFunc("/api/logs", handleQueryLogs)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/api/tls", handleTLSInfo)
+	mux.HandleFunc("/api/mounts", handleMounts)
+	mux.HandleFunc("/api/sync/manifest", handleSyncManifest)
+	mux.HandleFunc("/api/sync/status", handleSyncStatus)
+	mux.HandleFunc("/api/sync/subscriptions", handleSyncSubscriptions)
+	mux.HandleFunc("/api/sync/run", handleSyncRun)
+	mux.HandleFunc("/api/backup", handleBackups)
+	mux.HandleFunc("/api/backup/download", handleBackupDownload)
+	mux.HandleFunc("/api/backup/restore", handleBackupRestore)
+	mux.HandleFunc("/api/quiz/save", handleSaveQuiz)
+	mux.HandleFunc("/api/quiz/list", handleListQuizzes)
+	mux.HandleFunc("/api/quiz/get", handleGetQuiz)
+	mux.HandleFunc("/api/quiz/run", handleRunQuiz)
+	mux.HandleFunc("/api/quiz/stop", handleStopQuiz)
+	mux.HandleFunc("/api/quiz/current", handleQuizCurrent)
+	mux.HandleFunc("/api/quiz/answer", handleQuizAnswer)
+	mux.HandleFunc("/api/quiz/results", handleQuizResults)
+	mux.HandleFunc("/api/quiz/sessions", handleQuizSessions)
+	mux.HandleFunc("/api/quiz/export", handleQuizExport)
+	mux.HandleFunc("/api/roster", handleRoster)
+	mux.HandleFunc("/api/roster/import", handleRosterImport)
+	mux.HandleFunc("/api/roster/pin", handleRosterPIN)
+	mux.HandleFunc("/api/roster/qr", handleRosterQR)
+	mux.HandleFunc("/api/roster/export", handleRosterExport)
+	mux.HandleFunc("/api/roster/class", handleRosterClass)
+	mux.HandleFunc("/api/roster/join", handleRosterJoin)
+	mux.HandleFunc("/api/roster/me", handleRosterMe)
+	mux.HandleFunc("/api/attendance/start", handleAttendanceStart)
+	mux.HandleFunc("/api/attendance/stop", handleAttendanceStop)
+	mux.HandleFunc("/api/attendance/live", handleAttendanceLive)
+	mux.HandleFunc("/api/attendance/checkin", handleAttendanceCheckin)
+	mux.HandleFunc("/api/attendance/sessions", handleAttendanceSessions)
+	mux.HandleFunc("/api/attendance/export", handleAttendanceExport)
+	mux.HandleFunc("/api/visibility", handleVisibility)
+	mux.HandleFunc("/api/types", handleTypes)
+	mux.HandleFunc(caCertPath, handleCACert)
 
 	mux.HandleFunc("/lesson", func(w http.ResponseWriter, r *http.Request) {
-		data, _ := staticFS.ReadFile("static/lesson.html")
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.Write(data)
+		serveEmbedded(w, r, "static/lesson.html")
 	})
 	mux.HandleFunc("/reader", func(w http.ResponseWriter, r *http.Request) {
-		data, _ := staticFS.ReadFile("static/reader.html")
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.Write(data)
+		serveEmbedded(w, r, "static/reader.html")
+	})
+	mux.HandleFunc("/quiz", func(w http.ResponseWriter, r *http.Request) {
+		serveEmbedded(w, r, "static/quiz.html")
+	})
+	mux.HandleFunc("/join", func(w http.ResponseWriter, r *http.Request) {
+		serveEmbedded(w, r, "static/join.html")
+	})
+	mux.HandleFunc("/attendance", func(w http.ResponseWriter, r *http.Request) {
+		serveEmbedded(w, r, "static/attendance.html")
+	})
+	mux.HandleFunc("/checkin", func(w http.ResponseWriter, r *http.Request) {
+		serveEmbedded(w, r, "static/checkin.html")
+	})
+	mux.HandleFunc("/release", func(w http.ResponseWriter, r *http.Request) {
+		serveEmbedded(w, r, "static/release.html")
 	})
 
 	mux.HandleFunc("/files/", handleFileServe)
 	mux.HandleFunc("/", handleMain)
 
-	server = &http.Server{Addr: listenAddr, Handler: mux}
-	server.ListenAndServe()
+	return &http.Server{Addr: listenAddr, Handler: withRequestLog(withTLSRedirect(withCompression(withMetrics(mux))))}
+}
+
+// 创建服务并开始监听。端口被占用、无权限等错误在这里直接返回，不再静默失败
+func startServer() (net.Listener, error) {
+	server = newServer()
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		err = describeListenError(listenAddr, err)
+		logError("HTTP 服务启动失败", err)
+		return nil, err
+	}
+	startIndexer()
+	appLog.write(LogEntry{Type: "audit", Action: "server.start", Detail: auditDetail("addr", listenAddr, "root", rootDir)})
+	startTLS(server.Handler)
+	startDiscovery()
+	startSync()
+	startBackupScheduler()
+	return ln, nil
+}
+
+// 在已监听的端口上提供服务，直到 shutdownServer 被调用
+func serve(ln net.Listener) error {
+	if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+		logError("HTTP 服务异常退出", err)
+		return err
+	}
+	return nil
+}
+
+// 优雅退出：停止接收新连接，等待进行中的请求（包括正在播放的视频流）在超时内结束，
+// 再停下索引、同步、定时备份和局域网发现
+func shutdownServer() {
+	if server == nil {
+		return
+	}
+	closeQuizStreams()
+	closeAttendanceStreams()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	defer stopBackground()
+	for _, srv := range []*http.Server{server, tlsServer.Swap(nil)} {
+		if srv == nil {
+			continue
+		}
+		if err := srv.Shutdown(ctx); err != nil {
+			logError("等待请求结束超时，强制关闭连接", err)
+			srv.Close()
+		}
+	}
+	appLog.write(LogEntry{Type: "audit", Action: "server.stop", Detail: auditDetail("addr", listenAddr)})
+}
+
+// ===== 后台任务 =====
+// 索引、同步、定时备份、证书续期和局域网发现跟随 HTTP 服务启停。托盘切换为系统服务前
+// 必须全部停下，否则两个进程会同时扫描、同步和备份同一个根目录，并争用发现端口
+
+type workerGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var background struct {
+	sync.Mutex
+	cur *workerGroup
+}
+
+func currentWorkers() *workerGroup {
+	if background.cur == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		background.cur = &workerGroup{ctx: ctx, cancel: cancel}
+	}
+	return background.cur
+}
+
+// 当前这一轮后台任务的 ctx，服务停止时被取消；命令行工具中从不取消
+func backgroundCtx() context.Context {
+	background.Lock()
+	defer background.Unlock()
+	return currentWorkers().ctx
+}
+
+// 启动一个后台任务，stopBackground 会取消 ctx 并等它退出
+func goBackground(fn func(ctx context.Context)) {
+	background.Lock()
+	g := currentWorkers()
+	g.wg.Add(1)
+	background.Unlock()
+	go func() {
+		defer g.wg.Done()
+		fn(g.ctx)
+	}()
+}
+
+// 取消当前一轮后台任务，最多等 shutdownTimeout；之后再启动的任务属于新的一轮
+func stopBackground() {
+	background.Lock()
+	g := background.cur
+	background.cur = nil
+	background.Unlock()
+	if g == nil {
+		return
+	}
+	g.cancel()
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		logError("等待后台任务退出超时", nil)
+	}
+}
+
+// 等待 d；期间服务停止则立即返回 false
+func sleepOrStop(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func describeListenError(addr string, err error) error {
+	switch {
+	case errors.Is(err, errAddrInUse):
+		return fmt.Errorf("端口 %s 已被占用（可能已有 FireCloud 或其他网站服务在运行）: %w", addr, err)
+	case errors.Is(err, errAddrAccess):
+		return fmt.Errorf("没有权限监听 %s（Linux 下 1024 以下端口需要 root 或 CAP_NET_BIND_SERVICE）: %w", addr, err)
+	}
+	return err
+}
+
+// 无托盘运行，收到 Ctrl+C 或 SIGTERM 时优雅退出
+func runHeadless() int {
+	ln, err := startServer()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "启动失败:", err)
+		return 1
+	}
+	fmt.Printf("FireCloud 已启动: http://%s%s  根目录 %s\n", getLocalIP(), listenAddr, rootDir)
+	errCh := make(chan error, 1)
+	go func() { errCh <- serve(ln) }()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	select {
+	case s := <-sig:
+		fmt.Printf("收到 %v，正在等待进行中的请求结束…\n", s)
+		shutdownServer()
+		return 0
+	case err := <-errCh:
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "服务异常退出:", err)
+			return 1
+		}
+		return 0
+	}
 }
 
 // ===== 主路由 =====
@@ -226,9 +397,8 @@ func handleMain(w http.ResponseWriter, r *http.Request) {
 		serveEmbeddedIndex(w, r)
 		return
 	}
-	absPath := filepath.Join(rootDir, filepath.FromSlash(cleanPath))
-	if !isPathSafe(absPath) {
-		http.Error(w, "禁止访问", http.StatusForbidden)
+	absPath, ok := resolveForRead(w, r, cleanPath)
+	if !ok {
 		return
 	}
 	info, err := os.Stat(absPath)
@@ -241,57 +411,133 @@ func handleMain(w http.ResponseWriter, r *http.Request) {
 		if manage != "1" {
 			indexPath := filepath.Join(absPath, "index.html")
 			if _, err := os.Stat(indexPath); err == nil {
-				http.StripPrefix(urlPath, http.FileServer(http.Dir(absPath))).ServeHTTP(w, r)
+				sw, done := shapeResponse(w, r)
+				defer done()
+				http.StripPrefix(urlPath, http.FileServer(http.Dir(absPath))).ServeHTTP(sw, r)
 				return
 			}
 		}
 		serveEmbeddedIndex(w, r)
 	} else {
-		http.ServeFile(w, r, absPath)
+		// 与 /files/ 一样参与带宽分配，换个地址不能绕过限速
+		sw, done := shapeResponse(w, r)
+		defer done()
+		http.ServeFile(sw, r, absPath)
 	}
 }
 
 func serveEmbeddedIndex(w http.ResponseWriter, r *http.Request) {
-	data, _ := staticFS.ReadFile("static/index.html")
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Write(data)
+	serveEmbedded(w, r, "static/index.html")
 }
 
 // ===== API =====
 func handleList(w http.ResponseWriter, r *http.Request) {
 	relPath := cleanRelPath(r.URL.Query().Get("path"))
-	absPath := filepath.Join(rootDir, filepath.FromSlash(relPath))
-	if !isPathSafe(absPath) {
-		http.Error(w, "禁止访问", http.StatusForbidden)
+	absPath, ok := resolveForRead(w, r, relPath)
+	if !ok {
+		return
+	}
+	query, errs := parseListQuery(r.URL.Query())
+	if len(errs) > 0 {
+		writeValidationErrors(w, "列表参数有误", errs)
 		return
 	}
-	entries, err := os.ReadDir(absPath)
+	readOnly := !canWrite(r, relPath)
+	info, err := os.Stat(absPath)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(ListResponse{Files: []FileInfo{}, Path: relPath})
+		json.NewEncoder(w).Encode(ListResponse{Files: []FileInfo{}, Path: relPath, ReadOnly: readOnly})
 		return
 	}
+	entries, _ := os.ReadDir(absPath)
+	// 原地修改的文件不改变父目录的 mtime，子文件夹的项目数也随其内容变化，ETag 带上每一项的 mtime 和大小
+	infos := make(map[string]os.FileInfo, len(entries))
+	var stamps strings.Builder
+	for _, e := range entries {
+		if fi, err := e.Info(); err == nil {
+			infos[e.Name()] = fi
+			fmt.Fprintf(&stamps, "%s:%d:%d/", e.Name(), fi.ModTime().UnixNano(), fi.Size())
+		}
+	}
+	filter := newListFilter(relPath)
+	etag := makeETag("list", relPath, r.URL.RawQuery, info.ModTime().UnixNano(), stamps.String(), dataVersion.Load(),
+		strings.Join(requestIdentities(r), ","), visibilityState(r), filter.sig)
+	if notModified(w, r, etag, time.Time{}) {
+		return
+	}
+
+	tagDB := make(map[string][]string)
+	readJSONFile(metaPath(".fire_tags.json"), &tagDB)
+
+	// 先只用目录项和标签筛选、排序、分页；项目数、媒体信息这类要打开文件的字段只为当前页计算。
+	// 按分类筛选或排序时才需要类型，已知扩展名直接查表，不读文件
+	needType := len(query.categories) > 0 || query.sort == "type"
+	absPaths := make(map[string]string)
 	var files []FileInfo
+	add := func(name, p string, fi os.FileInfo) {
+		absPaths[name] = p
+		f := FileInfo{Name: name, IsDir: fi.IsDir(), ModTime: fi.ModTime().Unix(), Tags: tagDB[joinRel(relPath, name)]}
+		if !f.IsDir {
+			f.Size = fi.Size()
+		}
+		if needType {
+			f.FileType = listEntryType(name, p, f.IsDir)
+		}
+		files = append(files, f)
+	}
+	if relPath == "" {
+		for _, m := range activeMounts() {
+			if mi, err := os.Stat(m.Path); err == nil && canRead(r, m.Name) {
+				infos[m.Name] = mi
+				add(m.Name, m.Path, mi)
+			}
+		}
+	}
 	for _, e := range entries {
 		name := e.Name()
-		// 过滤：所有 .json 文件，以及以 . 开头的隐藏项
-		if strings.HasSuffix(strings.ToLower(name), ".json") || strings.HasPrefix(name, ".") {
+		if filter.hidden(name, e.IsDir()) {
 			continue
 		}
-		info, err := e.Info()
-		if err != nil {
+		if relPath == "" && e.IsDir() && shadowedByMount(name) {
 			continue
 		}
-		files = append(files, FileInfo{Name: name, IsDir: e.IsDir(), Size: info.Size()})
+		if hiddenFrom(r, joinRel(relPath, name)) {
+			continue
+		}
+		if fi, ok := infos[name]; ok {
+			add(name, filepath.Join(absPath, name), fi)
+		}
 	}
-	sort.Slice(files, func(i, j int) bool {
-		if files[i].IsDir != files[j].IsDir {
-			return files[i].IsDir
+	page, total := query.apply(files)
+
+	markerDB := make(map[string][]Marker)
+	if len(page) > 0 {
+		readJSONFile(metaPath(".fire_markers.json"), &markerDB)
+	}
+	for i := range page {
+		f := &page[i]
+		rel, p := joinRel(relPath, f.Name), absPaths[f.Name]
+		if !needType {
+			f.FileType = listEntryType(f.Name, p, f.IsDir)
 		}
-		return strings.ToLower(files[i].Name) < strings.ToLower(files[j].Name)
-	})
+		if f.IsDir {
+			f.Count = countVisible(r, rel, p)
+			f.IsCourseware = f.Category == "courseware"
+			continue
+		}
+		f.Media = mediaInfoFor(rel, p, infos[f.Name])
+		f.Markers, f.BadMarkers = len(markerDB[rel]), markersBeyondEnd(markerDB[rel], f.Media)
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(ListResponse{Files: files, Path: relPath})
+	json.NewEncoder(w).Encode(ListResponse{Files: page, Path: relPath, ReadOnly: readOnly, Total: total})
+}
+
+// 列表项的类型：文件夹看是否 H5 课件，文件按扩展名，未知扩展名时读文件头判断
+func listEntryType(name, absPath string, isDir bool) FileType {
+	if isDir {
+		return detectFolderType(absPath)
+	}
+	return detectFileType(name, absPath)
 }
 
 func handleUpload(w http.ResponseWriter, r *http.Request) {
@@ -304,11 +550,25 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "缺少路径参数", http.StatusBadRequest)
 		return
 	}
-	absPath := filepath.Join(rootDir, filepath.FromSlash(relPath))
-	if !isPathSafe(absPath) {
-		http.Error(w, "禁止访问", http.StatusForbidden)
+	absPath, ok := resolveForWrite(w, r, relPath)
+	if !ok {
+		return
+	}
+	var existing int64
+	info, statErr := os.Stat(absPath)
+	if statErr == nil {
+		existing = info.Size()
+	}
+	if r.ContentLength < 0 && quotaApplies(relPath) {
+		http.Error(w, "需要 Content-Length 才能检查配额", http.StatusLengthRequired)
 		return
 	}
+	quota, msg := checkQuota(relPath, r.ContentLength, existing)
+	if msg != "" {
+		http.Error(w, msg, http.StatusInsufficientStorage)
+		return
+	}
+	defer quota.release()
 	os.MkdirAll(filepath.Dir(absPath), 0755)
 	outFile, err := os.Create(absPath)
 	if err != nil {
@@ -316,7 +576,18 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer outFile.Close()
-	io.Copy(outFile, r.Body)
+	shaper.uploads.Add(1)
+	written, err := io.Copy(outFile, r.Body)
+	shaper.uploads.Add(-1)
+	storage.add(relPath, written-existing, statErr != nil)
+	treeCache.touch(relPath)
+	dataVersion.Add(1)
+	if err != nil {
+		logError("上传中断: "+relPath, err)
+		http.Error(w, "写入文件失败", http.StatusInternalServerError)
+		return
+	}
+	auditLog(r, "upload", relPath, auditDetail("bytes", written, "overwrite", statErr == nil))
 	w.Write([]byte("OK"))
 }
 
@@ -327,24 +598,39 @@ func handleFileServe(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "路径无效", http.StatusBadRequest)
 		return
 	}
-	absPath := filepath.Join(rootDir, filepath.FromSlash(relPath))
-	if !isPathSafe(absPath) {
-		http.Error(w, "禁止访问", http.StatusForbidden)
+	absPath, ok := resolveForRead(w, r, relPath)
+	if !ok {
 		return
 	}
-	http.ServeFile(w, r, absPath)
+	sw, done := shapeResponse(w, r)
+	defer done()
+	http.ServeFile(sw, r, absPath)
 }
 
 // 服务状态 API
 func handleStatus(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	ip := getLocalIP()
-	json.NewEncoder(w).Encode(map[string]string{
+	status := map[string]interface{}{
 		"status":  "running",
 		"address": ip + listenAddr,
 		"ip":      ip,
 		"rootDir": rootDir,
-	})
+	}
+	if total, free, err := diskSpace(rootDir); err == nil {
+		status["diskTotal"] = total
+		status["diskFree"] = free
+	}
+	for k, v := range liveStats() {
+		status[k] = v
+	}
+	status["throttle"] = shaper.status()
+	status["tls"] = getConfig().TLS.Enabled
+	status["addresses"] = candidateAddresses(true)
+	if !getConfig().Discovery.Disabled {
+		status["mdns"] = serviceURL(mdnsHost)
+	}
+	json.NewEncoder(w).Encode(status)
 }
 
 // 视频书签 API
@@ -354,17 +640,13 @@ func handleGetMarkers(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "缺少路径参数", http.StatusBadRequest)
 		return
 	}
-
-	markerDBPath := filepath.Join(rootDir, ".fire_markers.json")
-	data, err := os.ReadFile(markerDBPath)
-	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(MarkersResponse{Markers: []Marker{}})
+	abs, ok := resolveForRead(w, r, relPath)
+	if !ok {
 		return
 	}
 
 	var db map[string][]Marker
-	if err := json.Unmarshal(data, &db); err != nil {
+	if err := readJSONFile(metaPath(".fire_markers.json"), &db); err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(MarkersResponse{Markers: []Marker{}})
 		return
@@ -375,8 +657,16 @@ func handleGetMarkers(w http.ResponseWriter, r *http.Request) {
 		markers = []Marker{}
 	}
 
+	// 有时长信息时标出超出视频结尾的书签（视频被剪短或替换后会出现）
+	resp := MarkersResponse{Markers: markers}
+	if info, err := os.Stat(abs); err == nil {
+		if media := mediaInfoFor(relPath, abs, info); media != nil {
+			resp.Markers, resp.Duration = flagMarkers(markers, media), media.Duration
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(MarkersResponse{Markers: markers})
+	json.NewEncoder(w).Encode(resp)
 }
 
 func handleSaveMarkers(w http.ResponseWriter, r *http.Request) {
@@ -389,15 +679,18 @@ func handleSaveMarkers(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "缺少路径参数", http.StatusBadRequest)
 		return
 	}
+	if !canRead(r, relPath) {
+		http.Error(w, "禁止访问", http.StatusForbidden)
+		return
+	}
 
 	markerDBPath := filepath.Join(rootDir, ".fire_markers.json")
+	metaMu.Lock()
+	defer metaMu.Unlock()
 
 	// 读取现有数据库
 	db := make(map[string][]Marker)
-	data, err := os.ReadFile(markerDBPath)
-	if err == nil {
-		json.Unmarshal(data, &db)
-	}
+	readJSONFile(markerDBPath, &db)
 
 	// 修正：解析前端传来的结构化数据 (封装在 markers 字段中)
 	var req MarkersResponse
@@ -406,24 +699,18 @@ func handleSaveMarkers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 更新并保存
-	db[relPath] = req.Markers
-	newData, err := json.Marshal(db)
-	if err != nil {
-		http.Error(w, "序列化失败", http.StatusInternalServerError)
-		return
+	// 更新并保存（Windows 下数据库文件设为隐藏）；超出时长的标记每次读取时重新计算
+	for i := range req.Markers {
+		req.Markers[i].BeyondEnd = false
 	}
-
-	err = os.WriteFile(markerDBPath, newData, 0644)
-	if err != nil {
+	db[relPath] = req.Markers
+	if err := writeHiddenJSON(markerDBPath, db); err != nil {
+		logError("写入书签数据库失败", err)
 		http.Error(w, "写入数据库失败", http.StatusInternalServerError)
 		return
 	}
-
-	// 在 Windows 下将数据库文件设置为隐藏
-	if runtime.GOOS == "windows" {
-		exec.Command("attrib", "+h", markerDBPath).Run()
-	}
+	go recordFingerprints(relPath)
+	auditLog(r, "markers.save", relPath, auditDetail("count", len(req.Markers)))
 
 	w.Write([]byte("OK"))
 }
@@ -435,113 +722,31 @@ func handleGetAllTags(w http.ResponseWriter, r *http.Request) {
 	tagFile := filepath.Join(rootDir, ".fire_tags.json")
 	markerFile := filepath.Join(rootDir, ".fire_markers.json")
 
+	version, modTime := metaFilesVersion(tagFile, markerFile)
+	if notModified(w, r, makeETag("tags", version, strings.Join(requestIdentities(r), ","), visibilityState(r)), modTime) {
+		return
+	}
+
 	db := make(map[string][]string)
 
 	// 1. 读取标签文件
-	if data, err := os.ReadFile(tagFile); err == nil {
-		json.Unmarshal(data, &db)
-	}
+	readJSONFile(tagFile, &db)
 
 	// 2. 读取书签文件（作为自动标签 "已标注"）
-	if data, err := os.ReadFile(markerFile); err == nil {
-		var mdb map[string]interface{}
-		if err := json.Unmarshal(data, &mdb); err == nil {
-			for path := range mdb {
-				db[path] = append(db[path], "已标注")
-			}
+	var mdb map[string]interface{}
+	if err := readJSONFile(markerFile, &mdb); err == nil {
+		for path := range mdb {
+			db[path] = append(db[path], "已标注")
 		}
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(db)
-}
-
-// 获取带标签的目录树
-func handleGetTree(w http.ResponseWriter, r *http.Request) {
-	tagFile := filepath.Join(rootDir, ".fire_tags.json")
-	markerFile := filepath.Join(rootDir, ".fire_markers.json")
-
-	tagDB := make(map[string][]string)
-	if data, err := os.ReadFile(tagFile); err == nil {
-		json.Unmarshal(data, &tagDB)
-	}
-
-	markerDB := make(map[string][]Marker)
-	if data, err := os.ReadFile(markerFile); err == nil {
-		json.Unmarshal(data, &markerDB)
-		for path := range markerDB {
-			tagDB[path] = append(tagDB[path], "已标注")
+	for path := range db {
+		if !canRead(r, path) {
+			delete(db, path)
 		}
 	}
 
-	tree := buildTree(rootDir, "", tagDB, markerDB)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(tree)
-}
-
-func isMediaFile(name string) bool {
-	ext := strings.ToLower(filepath.Ext(name))
-	mediaExts := map[string]bool{
-		".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".bmp": true,
-		".mp4": true, ".webm": true, ".mkv": true, ".mov": true, ".avi": true,
-	}
-	return mediaExts[ext]
-}
-
-func buildTree(basePath, relPath string, tagDB map[string][]string, markerDB map[string][]Marker) []TreeNode {
-	absPath := filepath.Join(basePath, filepath.FromSlash(relPath))
-	entries, err := os.ReadDir(absPath)
-	if err != nil {
-		return nil
-	}
-
-	var nodes []TreeNode
-	for _, e := range entries {
-		name := e.Name()
-		if strings.HasPrefix(name, ".") {
-			continue
-		}
-
-		childRelPath := name
-		if relPath != "" {
-			childRelPath = relPath + "/" + name
-		}
-
-		if e.IsDir() {
-			children := buildTree(basePath, childRelPath, tagDB, markerDB)
-			if len(children) > 0 {
-				node := TreeNode{
-					Name:     name,
-					Path:     childRelPath,
-					IsDir:    true,
-					Tags:     tagDB[childRelPath],
-					Children: children,
-				}
-				nodes = append(nodes, node)
-			}
-		} else {
-			if !isMediaFile(name) {
-				continue
-			}
-			node := TreeNode{
-				Name:    name,
-				Path:    childRelPath,
-				IsDir:   false,
-				Tags:    tagDB[childRelPath],
-				Markers: markerDB[childRelPath],
-			}
-			nodes = append(nodes, node)
-		}
-	}
-
-	sort.Slice(nodes, func(i, j int) bool {
-		if nodes[i].IsDir != nodes[j].IsDir {
-			return nodes[i].IsDir
-		}
-		return strings.ToLower(nodes[i].Name) < strings.ToLower(nodes[j].Name)
-	})
-
-	return nodes
+	json.NewEncoder(w).Encode(db)
 }
 
 // 保存文件标签
@@ -552,24 +757,36 @@ func handleSaveFileTags(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Bad JSON", 400)
 		return
 	}
+	for k := range newTags {
+		if !canRead(r, k) {
+			http.Error(w, "禁止访问: "+k, http.StatusForbidden)
+			return
+		}
+	}
 
+	metaMu.Lock()
+	defer metaMu.Unlock()
 	db := make(map[string][]string)
-	if data, err := os.ReadFile(tagFile); err == nil {
-		json.Unmarshal(data, &db)
-	}
+	readJSONFile(tagFile, &db)
 
+	var tagged []string
 	for k, v := range newTags {
 		if len(v) == 0 {
 			delete(db, k)
 		} else {
 			db[k] = v
+			tagged = append(tagged, k)
 		}
 	}
 
-	data, _ := json.Marshal(db)
-	os.WriteFile(tagFile, data, 0644)
-	if runtime.GOOS == "windows" {
-		exec.Command("attrib", "+h", tagFile).Run()
+	if err := writeHiddenJSON(tagFile, db); err != nil {
+		logError("写入标签数据库失败", err)
+		http.Error(w, "写入数据库失败", http.StatusInternalServerError)
+		return
+	}
+	go recordFingerprints(tagged...)
+	for k, v := range newTags {
+		auditLog(r, "tags.save", k, strings.Join(v, " "))
 	}
 	w.Write([]byte("OK"))
 }
@@ -585,6 +802,11 @@ func handleSaveLesson(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Name required", 400)
 		return
 	}
+	pinTemplateVersions(&plan)
+	if errs := validateLessonPlan(&plan); len(errs) > 0 {
+		writeValidationErrors(w, "备课方案校验失败", errs)
+		return
+	}
 	plan.Updated = time.Now().Unix()
 
 	lessonDir := filepath.Join(rootDir, ".fire_lessons")
@@ -594,8 +816,16 @@ func handleSaveLesson(w http.ResponseWriter, r *http.Request) {
 	}
 
 	fileName := filepath.Join(lessonDir, plan.Name+".json")
-	data, _ := json.Marshal(plan)
-	os.WriteFile(fileName, data, 0644)
+	metaMu.Lock()
+	err := writeHiddenJSON(fileName, plan)
+	metaMu.Unlock()
+	if err != nil {
+		logError("写入备课方案失败", err)
+		http.Error(w, "写入备课方案失败", http.StatusInternalServerError)
+		return
+	}
+	go recordFingerprints(lessonPaths(plan)...)
+	auditLog(r, "lesson.save", plan.Name, auditDetail("slides", len(plan.Slides)))
 	w.Write([]byte("OK"))
 }
 
@@ -610,8 +840,9 @@ func handleListLessons(w http.ResponseWriter, r *http.Request) {
 	}
 	var list []string
 	for _, e := range entries {
-		if strings.HasSuffix(e.Name(), ".json") {
-			list = append(list, strings.TrimSuffix(e.Name(), ".json"))
+		name := strings.TrimSuffix(e.Name(), ".json")
+		if strings.HasSuffix(e.Name(), ".json") && !lessonHiddenFrom(r, name) {
+			list = append(list, name)
 		}
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -625,9 +856,14 @@ func handleGetLesson(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Name required", 400)
 		return
 	}
+	if !isValidLessonName(name) {
+		http.Error(w, "Invalid name", 400)
+		return
+	}
 	filePath := filepath.Join(rootDir, ".fire_lessons", name+".json")
 	data, err := os.ReadFile(filePath)
-	if err != nil {
+	metaOps.inc("read")
+	if err != nil || lessonHiddenFrom(r, name) {
 		http.Error(w, "Not found", 404)
 		return
 	}
@@ -635,27 +871,110 @@ func handleGetLesson(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
+// 学生最可能访问到的本机地址：优先默认路由所在网卡，其次按网段和网卡名排序（虚拟网卡靠后）
 func getLocalIP() string {
+	addrs := lanAddrs()
+	if ip := routedIP(); ip != nil {
+		for _, a := range addrs {
+			if a.ipnet.IP.Equal(ip) && a.score > 0 {
+				return ip.String()
+			}
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs[0].ipnet.IP.String()
+	}
+	return "127.0.0.1"
+}
+
+// 本机所有非回环的单播地址（IPv4 在前）
+func localIPs() []net.IP {
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
-		return "127.0.0.1"
+		return nil
 	}
+	var v4, v6 []net.IP
 	for _, address := range addrs {
-		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil && strings.HasPrefix(ipnet.IP.String(), "192.168.") {
-				return ipnet.IP.String()
-			}
+		ipnet, ok := address.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			v4 = append(v4, ipnet.IP.To4())
+		} else {
+			v6 = append(v6, ipnet.IP)
 		}
 	}
-	// 如果没找到 192.168 开头的，返回第一个非回环 IPv4
-	for _, address := range addrs {
-		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				return ipnet.IP.String()
-			}
+	return append(v4, v6...)
+}
+
+// ===== 元数据读写 =====
+
+// 串行化 .fire_* 元数据文件的读-改-写，避免并发保存互相覆盖
+var metaMu sync.Mutex
+
+func metaPath(name string) string {
+	return filepath.Join(rootDir, name)
+}
+
+// 读取 JSON 元数据文件，文件不存在时保持 v 不变
+func readJSONFile(path string, v interface{}) error {
+	metaOps.inc("read")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
 		}
+		return err
 	}
-	return "127.0.0.1"
+	return json.Unmarshal(data, v)
+}
+
+// 写入 JSON 元数据文件，并在 Windows 下设为隐藏
+func writeHiddenJSON(path string, v interface{}) error {
+	metaOps.inc("write")
+	dataVersion.Add(1)
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(path, 0644, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		exec.Command("attrib", "+h", path).Run()
+	}
+	return nil
+}
+
+// 先写同目录的临时文件（*.tmp），落盘后再改名替换，中途出错或断电不会留下截断的文件
+func writeFileAtomic(path string, mode os.FileMode, write func(w io.Writer) error) error {
+	out, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := out.Name()
+	err = write(out)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, mode)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
 }
 
 // ===== 安全工具 =====
@@ -675,8 +994,58 @@ func cleanRelPath(p string) string {
 	return strings.Join(clean, "/")
 }
 
-func isPathSafe(absPath string) bool {
-	return strings.HasPrefix(strings.ToLower(filepath.Clean(absPath)), strings.ToLower(filepath.Clean(rootDir)))
+// 教师机本机访问，或以教师账号登录
+func isTeacherRequest(r *http.Request) bool {
+	if ip := net.ParseIP(clientIP(r)); ip != nil && ip.IsLoopback() {
+		return true
+	}
+	acct, ok := authenticate(r)
+	return ok && acct.Role == "teacher"
+}
+
+// 其他机器上没带凭据（或凭据错误）时返回 401 要求 BasicAuth，浏览器随即弹出登录框；
+// 已登录但不是教师账号时返回 403
+func requireTeacher(w http.ResponseWriter, r *http.Request) bool {
+	if isTeacherRequest(r) {
+		return true
+	}
+	if _, ok := authenticate(r); !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="FireCloud", charset="UTF-8"`)
+		http.Error(w, "请以教师账号登录", http.StatusUnauthorized)
+		return false
+	}
+	http.Error(w, "仅限教师端访问", http.StatusForbidden)
+	return false
+}
+
+// 导出给 Excel 打开的 CSV。学生自填的姓名等内容以 = + - @ 开头时会被 Excel 当作公式执行，
+// 这类单元格前加 ' 按文本显示
+type excelCSV struct{ *csv.Writer }
+
+func newExcelCSV(w io.Writer) excelCSV {
+	w.Write([]byte("\xEF\xBB\xBF")) // Excel 需要 BOM 才能正确识别 UTF-8
+	return excelCSV{csv.NewWriter(w)}
+}
+
+func (c excelCSV) Write(row []string) error {
+	safe := make([]string, len(row))
+	for i, cell := range row {
+		if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+			cell = "'" + cell
+		}
+		safe[i] = cell
+	}
+	return c.Writer.Write(safe)
+}
+
+func (c excelCSV) WriteAll(rows [][]string) error {
+	for _, row := range rows {
+		if err := c.Write(row); err != nil {
+			return err
+		}
+	}
+	c.Flush()
+	return c.Error()
 }
 
 func openBrowser(url string) {
@@ -823,9 +1192,8 @@ func handleGetMD(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "缺少路径参数", http.StatusBadRequest)
 		return
 	}
-	absPath := filepath.Join(rootDir, filepath.FromSlash(relPath))
-	if !isPathSafe(absPath) {
-		http.Error(w, "禁止访问", http.StatusForbidden)
+	absPath, ok := resolveForRead(w, r, relPath)
+	if !ok {
 		return
 	}
 	data, err := os.ReadFile(absPath)
@@ -856,11 +1224,14 @@ func isInsidePolygon(x, y float64, points [][2]float64) bool {
 }
 
 func handleShare(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Query().Get("path")
+	path := cleanRelPath(r.URL.Query().Get("path"))
 	if path == "" {
 		http.Error(w, "Path required", 400)
 		return
 	}
+	if _, ok := resolveForRead(w, r, path); !ok {
+		return
+	}
 
 	// Encode path segments properly
 	parts := strings.Split(path, "/")
@@ -871,7 +1242,11 @@ func handleShare(w http.ResponseWriter, r *http.Request) {
 	encodedPath := strings.Join(encodedParts, "/")
 
 	// Use r.Host to respect the actual hostname/IP used by the client
-	fullURL := fmt.Sprintf("http://%s/files/%s", r.Host, encodedPath)
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	fullURL := fmt.Sprintf("%s://%s/files/%s", scheme, r.Host, encodedPath)
 
 	png, err := qrcode.Encode(fullURL, qrcode.Medium, 256)
 	if err != nil {
@@ -881,7 +1256,8 @@ func handleShare(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
-		"url": fullURL,
-		"qr":  base64.StdEncoding.EncodeToString(png),
+		"url":    fullURL,
+		"qr":     base64.StdEncoding.EncodeToString(png),
+		"notice": releaseNotice(path),
 	})
 }
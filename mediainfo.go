@@ -0,0 +1,775 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// ===== 媒体信息 =====
+// 视频播放列表和备课素材树需要时长、分辨率、编码和内嵌标题。教室电脑上没有 ffmpeg，
+// 这里直接读容器头部：MP4/MOV/M4A 读 moov 盒子，WebM/MKV 读 EBML 的 Info 和 Tracks，
+// MP3 读 ID3 标签和第一帧（有 Xing/VBRI 头按总帧数计算，否则按码率估算）。
+// 只读取头部几个 KB，样本表等大块数据直接跳过。
+// 结果按文件大小和修改时间缓存在 .fire_mediainfo.json，文件变化后重新解析；解析失败也会记下，避免反复读取。
+
+type MediaInfo struct {
+	Duration   float64 `json:"duration,omitempty"` // 秒
+	Width      int     `json:"width,omitempty"`
+	Height     int     `json:"height,omitempty"`
+	VideoCodec string  `json:"videoCodec,omitempty"`
+	AudioCodec string  `json:"audioCodec,omitempty"`
+	Title      string  `json:"title,omitempty"`
+}
+
+var mediaParsers = map[string]func(f *os.File, size int64) (*MediaInfo, error){
+	".mp4": parseMP4, ".m4v": parseMP4, ".mov": parseMP4, ".m4a": parseMP4,
+	".webm": parseMatroska, ".mkv": parseMatroska,
+	".mp3": parseMP3,
+}
+
+var errNotMedia = errors.New("无法识别的媒体文件")
+
+// 解析单个文件的媒体信息
+func probeMedia(absPath string) (*MediaInfo, error) {
+	parse := mediaParsers[strings.ToLower(filepath.Ext(absPath))]
+	if parse == nil {
+		return nil, errNotMedia
+	}
+	f, err := os.Open(absPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	m, err := parse(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	m.Title = strings.TrimSpace(strings.TrimRight(m.Title, "\x00"))
+	if math.IsNaN(m.Duration) || math.IsInf(m.Duration, 0) || m.Duration < 0 {
+		m.Duration = 0
+	}
+	m.Duration = math.Round(m.Duration*1000) / 1000
+	return m, nil
+}
+
+// ===== MP4 / MOV =====
+
+// 遍历 [start, end) 范围内的盒子，fn 收到类型和内容范围
+func walkBoxes(r io.ReaderAt, start, end int64, fn func(typ string, body, bodyEnd int64) error) error {
+	var hdr [16]byte
+	for pos := start; pos+8 <= end; {
+		if _, err := r.ReadAt(hdr[:8], pos); err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[:4]))
+		typ := string(hdr[4:8])
+		body := pos + 8
+		switch size {
+		case 0:
+			size = end - pos
+		case 1:
+			if _, err := r.ReadAt(hdr[8:16], pos+8); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			body += 8
+		}
+		if size < body-pos || pos+size > end {
+			return nil // 截断或损坏的盒子，保留已读到的信息
+		}
+		if err := fn(typ, body, pos+size); err != nil {
+			return err
+		}
+		pos += size
+	}
+	return nil
+}
+
+// 读取盒子内容开头最多 n 字节
+func readBox(r io.ReaderAt, body, bodyEnd int64, n int) []byte {
+	if avail := bodyEnd - body; int64(n) > avail {
+		n = int(avail)
+	}
+	buf := make([]byte, n)
+	read, _ := r.ReadAt(buf, body)
+	return buf[:read]
+}
+
+var mp4Codecs = map[string]string{
+	"avc1": "H.264", "avc3": "H.264", "hvc1": "H.265", "hev1": "H.265", "av01": "AV1", "vp09": "VP9",
+	"mp4v": "MPEG-4", "mp4a": "AAC", "ac-3": "AC-3", "ec-3": "E-AC-3", ".mp3": "MP3", "Opus": "Opus",
+	"alac": "ALAC", "fLaC": "FLAC", "apcn": "ProRes", "apch": "ProRes", "apcs": "ProRes", "jpeg": "MJPEG",
+}
+
+func parseMP4(f *os.File, size int64) (*MediaInfo, error) {
+	m := &MediaInfo{}
+	found := false
+	err := walkBoxes(f, 0, size, func(typ string, body, end int64) error {
+		if typ == "moov" {
+			found = true
+			return parseMoov(f, body, end, m)
+		}
+		return nil
+	})
+	if err != nil && !found {
+		return nil, err
+	}
+	if !found {
+		return nil, errNotMedia
+	}
+	return m, nil
+}
+
+func parseMoov(r io.ReaderAt, start, end int64, m *MediaInfo) error {
+	return walkBoxes(r, start, end, func(typ string, body, bodyEnd int64) error {
+		switch typ {
+		case "mvhd":
+			b := readBox(r, body, bodyEnd, 32)
+			if len(b) >= 20 && b[0] == 0 {
+				if scale := binary.BigEndian.Uint32(b[12:16]); scale > 0 {
+					m.Duration = float64(binary.BigEndian.Uint32(b[16:20])) / float64(scale)
+				}
+			} else if len(b) >= 32 && b[0] == 1 {
+				if scale := binary.BigEndian.Uint32(b[20:24]); scale > 0 {
+					m.Duration = float64(binary.BigEndian.Uint64(b[24:32])) / float64(scale)
+				}
+			}
+		case "trak":
+			parseTrak(r, body, bodyEnd, m)
+		case "udta":
+			if title := parseUdta(r, body, bodyEnd); title != "" {
+				m.Title = title
+			}
+		case "meta":
+			if title := parseMeta(r, body, bodyEnd); title != "" {
+				m.Title = title
+			}
+		}
+		return nil
+	})
+}
+
+// trak 内需要进入的容器盒子：父盒子 -> 子盒子
+var trakPath = map[string]string{"trak": "mdia", "mdia": "minf", "minf": "stbl"}
+
+func parseTrak(r io.ReaderAt, start, end int64, m *MediaInfo) {
+	var width, height int
+	var handler, codec string
+	// 只沿 trak -> mdia -> minf -> stbl 固定路径下降，每层最多一次：
+	// 任意嵌套会被构造的文件拿来耗尽栈空间，而栈溢出无法 recover，会带走整个服务
+	var visit func(parent string, start, end int64)
+	visit = func(parent string, start, end int64) {
+		walkBoxes(r, start, end, func(typ string, body, bodyEnd int64) error {
+			switch typ {
+			case "tkhd":
+				// 宽高为 16.16 定点数，位于矩阵之后
+				b := readBox(r, body, bodyEnd, 96)
+				off := 76
+				if len(b) > 0 && b[0] == 1 {
+					off = 88
+				}
+				if len(b) >= off+8 {
+					width = int(binary.BigEndian.Uint32(b[off:]) >> 16)
+					height = int(binary.BigEndian.Uint32(b[off+4:]) >> 16)
+				}
+			case "hdlr":
+				if b := readBox(r, body, bodyEnd, 12); len(b) == 12 {
+					handler = string(b[8:12])
+				}
+			case "stsd":
+				if b := readBox(r, body, bodyEnd, 16); len(b) == 16 {
+					codec = string(b[12:16])
+				}
+			default:
+				if trakPath[parent] == typ {
+					visit(typ, body, bodyEnd)
+				}
+			}
+			return nil
+		})
+	}
+	visit("trak", start, end)
+	name := mp4Codecs[codec]
+	if name == "" {
+		name = strings.TrimSpace(codec)
+	}
+	switch handler {
+	case "vide":
+		if m.VideoCodec == "" {
+			m.VideoCodec, m.Width, m.Height = name, width, height
+		}
+	case "soun":
+		if m.AudioCodec == "" {
+			m.AudioCodec = name
+		}
+	}
+}
+
+// QuickTime 的 udta 直接存 ©nam；iTunes 风格的标题在 udta/meta/ilst 下
+func parseUdta(r io.ReaderAt, start, end int64) string {
+	title := ""
+	walkBoxes(r, start, end, func(typ string, body, bodyEnd int64) error {
+		switch typ {
+		case "\xa9nam":
+			// 2 字节长度 + 2 字节语言 + 文本
+			if b := readBox(r, body, bodyEnd, 1024); len(b) > 4 {
+				n := int(binary.BigEndian.Uint16(b[:2]))
+				if n > len(b)-4 {
+					n = len(b) - 4
+				}
+				title = string(b[4 : 4+n])
+			}
+		case "meta":
+			if t := parseMeta(r, body, bodyEnd); t != "" {
+				title = t
+			}
+		}
+		return nil
+	})
+	return title
+}
+
+func parseMeta(r io.ReaderAt, start, end int64) string {
+	// MP4 中 meta 是带版本号的 full box，QuickTime 中不是：开头 4 字节为 0 时跳过
+	if b := readBox(r, start, end, 4); len(b) == 4 && binary.BigEndian.Uint32(b) == 0 {
+		start += 4
+	}
+	title := ""
+	walkBoxes(r, start, end, func(typ string, body, bodyEnd int64) error {
+		if typ != "ilst" {
+			return nil
+		}
+		walkBoxes(r, body, bodyEnd, func(typ string, body, bodyEnd int64) error {
+			if typ != "\xa9nam" {
+				return nil
+			}
+			walkBoxes(r, body, bodyEnd, func(typ string, body, bodyEnd int64) error {
+				// data 盒子：4 字节类型 + 4 字节区域 + UTF-8 文本
+				if b := readBox(r, body, bodyEnd, 1024); typ == "data" && len(b) > 8 {
+					title = string(b[8:])
+				}
+				return nil
+			})
+			return nil
+		})
+		return nil
+	})
+	return title
+}
+
+// ===== WebM / MKV =====
+
+const (
+	ebmlHeaderID    = 0x1A45DFA3
+	ebmlSegment     = 0x18538067
+	ebmlInfo        = 0x1549A966
+	ebmlTimecode    = 0x2AD7B1
+	ebmlDuration    = 0x4489
+	ebmlTitle       = 0x7BA9
+	ebmlTracks      = 0x1654AE6B
+	ebmlTrackEntry  = 0xAE
+	ebmlTrackType   = 0x83
+	ebmlCodecID     = 0x86
+	ebmlVideo       = 0xE0
+	ebmlPixelWidth  = 0xB0
+	ebmlPixelHeight = 0xBA
+	ebmlCluster     = 0x1F43B675
+	ebmlMaxElement  = 1 << 20 // Info、Tracks 超过 1MB 视为损坏
+)
+
+// 读取 EBML 变长整数；keepMarker 为 true 时保留长度标记位（元素 ID 的写法）
+func readVint(r io.ReaderAt, pos int64, keepMarker bool) (uint64, int, error) {
+	var b [8]byte
+	if _, err := r.ReadAt(b[:1], pos); err != nil {
+		return 0, 0, err
+	}
+	n := 1
+	for mask := byte(0x80); n <= 8 && b[0]&mask == 0; mask >>= 1 {
+		n++
+	}
+	if n > 8 {
+		return 0, 0, errNotMedia
+	}
+	if n > 1 {
+		if _, err := r.ReadAt(b[1:n], pos+1); err != nil {
+			return 0, 0, err
+		}
+	}
+	v := uint64(b[0])
+	if !keepMarker {
+		v &= uint64(0xFF >> n)
+	}
+	allOnes := v == uint64(0xFF>>n)
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(b[i])
+		allOnes = allOnes && b[i] == 0xFF
+	}
+	if !keepMarker && allOnes {
+		v = math.MaxUint64 // 未知长度
+	}
+	return v, n, nil
+}
+
+// 遍历 [start, end) 内的 EBML 元素；fn 返回 false 时停止
+func walkEBML(r io.ReaderAt, start, end int64, fn func(id uint64, body, bodyEnd int64) bool) error {
+	for pos := start; pos < end; {
+		id, n, err := readVint(r, pos, true)
+		if err != nil {
+			return err
+		}
+		size, m, err := readVint(r, pos+int64(n), false)
+		if err != nil {
+			return err
+		}
+		body := pos + int64(n+m)
+		if body > end {
+			return nil // 截断的元素头
+		}
+		bodyEnd := end
+		if size != math.MaxUint64 && size <= uint64(end-body) {
+			bodyEnd = body + int64(size)
+		}
+		if !fn(id, body, bodyEnd) {
+			return nil
+		}
+		pos = bodyEnd
+	}
+	return nil
+}
+
+func ebmlUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func ebmlFloat(b []byte) float64 {
+	switch len(b) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// 把 Info、Tracks 这样的小元素整体读入内存
+func loadElement(r io.ReaderAt, body, bodyEnd int64) *bytes.Reader {
+	n := bodyEnd - body
+	if n > ebmlMaxElement {
+		n = ebmlMaxElement
+	}
+	buf := make([]byte, n)
+	read, _ := r.ReadAt(buf, body)
+	return bytes.NewReader(buf[:read])
+}
+
+func parseMatroska(f *os.File, size int64) (*MediaInfo, error) {
+	id, _, err := readVint(f, 0, true)
+	if err != nil || id != ebmlHeaderID {
+		return nil, errNotMedia
+	}
+	m := &MediaInfo{}
+	var segStart, segEnd int64 = -1, 0
+	walkEBML(f, 0, size, func(id uint64, body, bodyEnd int64) bool {
+		if id == ebmlSegment {
+			segStart, segEnd = body, bodyEnd
+			return false
+		}
+		return true
+	})
+	if segStart < 0 {
+		return nil, errNotMedia
+	}
+	var haveInfo, haveTracks bool
+	walkEBML(f, segStart, segEnd, func(id uint64, body, bodyEnd int64) bool {
+		switch id {
+		case ebmlInfo:
+			haveInfo = true
+			parseMatroskaInfo(loadElement(f, body, bodyEnd), m)
+		case ebmlTracks:
+			haveTracks = true
+			parseMatroskaTracks(loadElement(f, body, bodyEnd), m)
+		case ebmlCluster:
+			return false // 之后都是音视频数据
+		}
+		return !(haveInfo && haveTracks)
+	})
+	if !haveInfo && !haveTracks {
+		return nil, errNotMedia
+	}
+	return m, nil
+}
+
+func parseMatroskaInfo(r *bytes.Reader, m *MediaInfo) {
+	scale := uint64(1000000) // 默认 1ms
+	var duration float64
+	walkEBML(r, 0, r.Size(), func(id uint64, body, bodyEnd int64) bool {
+		b := readBox(r, body, bodyEnd, 4096)
+		switch id {
+		case ebmlTimecode:
+			if v := ebmlUint(b); v > 0 {
+				scale = v
+			}
+		case ebmlDuration:
+			duration = ebmlFloat(b)
+		case ebmlTitle:
+			m.Title = string(b)
+		}
+		return true
+	})
+	m.Duration = duration * float64(scale) / 1e9
+}
+
+var matroskaCodecs = map[string]string{
+	"V_MPEG4/ISO/AVC": "H.264", "V_MPEGH/ISO/HEVC": "H.265", "V_VP8": "VP8", "V_VP9": "VP9", "V_AV1": "AV1",
+	"A_OPUS": "Opus", "A_VORBIS": "Vorbis", "A_AAC": "AAC", "A_MPEG/L3": "MP3", "A_AC3": "AC-3", "A_FLAC": "FLAC",
+}
+
+func parseMatroskaTracks(r *bytes.Reader, m *MediaInfo) {
+	walkEBML(r, 0, r.Size(), func(id uint64, body, bodyEnd int64) bool {
+		if id != ebmlTrackEntry {
+			return true
+		}
+		var kind uint64
+		var codec string
+		var width, height int
+		walkEBML(r, body, bodyEnd, func(id uint64, body, bodyEnd int64) bool {
+			switch id {
+			case ebmlTrackType:
+				kind = ebmlUint(readBox(r, body, bodyEnd, 8))
+			case ebmlCodecID:
+				codec = string(readBox(r, body, bodyEnd, 64))
+			case ebmlVideo:
+				walkEBML(r, body, bodyEnd, func(id uint64, body, bodyEnd int64) bool {
+					switch id {
+					case ebmlPixelWidth:
+						width = int(ebmlUint(readBox(r, body, bodyEnd, 8)))
+					case ebmlPixelHeight:
+						height = int(ebmlUint(readBox(r, body, bodyEnd, 8)))
+					}
+					return true
+				})
+			}
+			return true
+		})
+		name := matroskaCodecs[codec]
+		if name == "" {
+			name = strings.TrimPrefix(strings.TrimPrefix(codec, "V_"), "A_")
+		}
+		switch kind {
+		case 1:
+			if m.VideoCodec == "" {
+				m.VideoCodec, m.Width, m.Height = name, width, height
+			}
+		case 2:
+			if m.AudioCodec == "" {
+				m.AudioCodec = name
+			}
+		}
+		return true
+	})
+}
+
+// ===== MP3 =====
+
+var (
+	mp3Bitrates = [2][16]int{
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0}, // MPEG-1
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},     // MPEG-2/2.5
+	}
+	mp3SampleRates = map[uint32][3]int{
+		3: {44100, 48000, 32000}, // MPEG-1
+		2: {22050, 24000, 16000}, // MPEG-2
+		0: {11025, 12000, 8000},  // MPEG-2.5
+	}
+)
+
+const mp3SyncScan = 64 << 10 // 标签之后最多找这么远的帧头
+
+func parseMP3(f *os.File, size int64) (*MediaInfo, error) {
+	m := &MediaInfo{AudioCodec: "MP3"}
+	var audioStart int64
+	var hdr [10]byte
+	if n, _ := f.ReadAt(hdr[:], 0); n == 10 && string(hdr[:3]) == "ID3" {
+		tagSize := int64(hdr[6]&0x7F)<<21 | int64(hdr[7]&0x7F)<<14 | int64(hdr[8]&0x7F)<<7 | int64(hdr[9]&0x7F)
+		audioStart = 10 + tagSize
+		if hdr[5]&0x10 != 0 {
+			audioStart += 10
+		}
+		if tagSize <= ebmlMaxElement {
+			tag := make([]byte, tagSize)
+			n, _ := f.ReadAt(tag, 10)
+			m.Title = id3Title(tag[:n], hdr[3])
+		}
+	}
+	audioEnd := size
+	var v1 [128]byte
+	if size >= 128 {
+		if n, _ := f.ReadAt(v1[:], size-128); n == 128 && string(v1[:3]) == "TAG" {
+			audioEnd -= 128
+			if t := strings.TrimRight(string(v1[3:33]), "\x00 "); m.Title == "" && utf8.ValidString(t) {
+				m.Title = t
+			}
+		}
+	}
+
+	buf := make([]byte, mp3SyncScan)
+	n, _ := f.ReadAt(buf, audioStart)
+	buf = buf[:n]
+	for i := 0; i+4 <= len(buf); i++ {
+		if buf[i] != 0xFF || buf[i+1]&0xE0 != 0xE0 {
+			continue
+		}
+		h := binary.BigEndian.Uint32(buf[i:])
+		version, layer := (h>>19)&3, (h>>17)&3
+		brIndex, srIndex := (h>>12)&0xF, (h>>10)&3
+		if version == 1 || layer != 1 || brIndex == 0 || brIndex == 15 || srIndex == 3 {
+			continue // 只认 Layer III，跳过保留值
+		}
+		mpeg1 := version == 3
+		table, samples, side := 1, 576, 17
+		if mpeg1 {
+			table, samples, side = 0, 1152, 32
+		}
+		mono := (h>>6)&3 == 3
+		if mono {
+			side = 9
+			if mpeg1 {
+				side = 17
+			}
+		}
+		rate := mp3SampleRates[version][srIndex]
+		bitrate := mp3Bitrates[table][brIndex] * 1000
+		frames := 0
+		if x := i + 4 + side; x+12 <= len(buf) && (string(buf[x:x+4]) == "Xing" || string(buf[x:x+4]) == "Info") {
+			if binary.BigEndian.Uint32(buf[x+4:])&1 != 0 {
+				frames = int(binary.BigEndian.Uint32(buf[x+8:]))
+			}
+		} else if v := i + 4 + 32; v+18 <= len(buf) && string(buf[v:v+4]) == "VBRI" {
+			frames = int(binary.BigEndian.Uint32(buf[v+14:]))
+		}
+		if frames > 0 {
+			m.Duration = float64(frames) * float64(samples) / float64(rate)
+		} else {
+			m.Duration = float64(audioEnd-audioStart-int64(i)) * 8 / float64(bitrate)
+		}
+		return m, nil
+	}
+	if m.Title != "" {
+		return m, nil
+	}
+	return nil, errNotMedia
+}
+
+// 从 ID3v2 标签中取标题（v2.2 的 TT2 或 v2.3/v2.4 的 TIT2）
+func id3Title(tag []byte, major byte) string {
+	idLen, hdrLen := 4, 10
+	if major == 2 {
+		idLen, hdrLen = 3, 6
+	}
+	for pos := 0; pos+hdrLen <= len(tag); {
+		id := string(tag[pos : pos+idLen])
+		if id[0] == 0 {
+			break // 填充区
+		}
+		var size int
+		switch major {
+		case 2:
+			size = int(tag[pos+3])<<16 | int(tag[pos+4])<<8 | int(tag[pos+5])
+		case 4:
+			size = int(tag[pos+4]&0x7F)<<21 | int(tag[pos+5]&0x7F)<<14 | int(tag[pos+6]&0x7F)<<7 | int(tag[pos+7]&0x7F)
+		default:
+			size = int(binary.BigEndian.Uint32(tag[pos+4:]))
+		}
+		body := pos + hdrLen
+		if size <= 0 || body+size > len(tag) {
+			break
+		}
+		if id == "TIT2" || id == "TT2" {
+			return decodeID3Text(tag[body : body+size])
+		}
+		pos = body + size
+	}
+	return ""
+}
+
+// 文本帧：首字节为编码（0 Latin-1、1 带 BOM 的 UTF-16、2 UTF-16BE、3 UTF-8）
+func decodeID3Text(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	enc, b := b[0], b[1:]
+	switch enc {
+	case 1, 2:
+		order := binary.ByteOrder(binary.BigEndian)
+		if len(b) >= 2 && b[0] == 0xFF && b[1] == 0xFE {
+			order, b = binary.LittleEndian, b[2:]
+		} else if len(b) >= 2 && b[0] == 0xFE && b[1] == 0xFF {
+			b = b[2:]
+		}
+		units := make([]uint16, 0, len(b)/2)
+		for i := 0; i+1 < len(b); i += 2 {
+			u := order.Uint16(b[i:])
+			if u == 0 {
+				break
+			}
+			units = append(units, u)
+		}
+		return string(utf16.Decode(units))
+	case 3:
+		s, _, _ := strings.Cut(string(b), "\x00")
+		return s
+	default:
+		runes := make([]rune, 0, len(b))
+		for _, c := range b {
+			if c == 0 {
+				break
+			}
+			runes = append(runes, rune(c))
+		}
+		return string(runes)
+	}
+}
+
+// ===== 媒体信息缓存 =====
+
+type mediaEntry struct {
+	Size    int64      `json:"size"`
+	ModTime int64      `json:"mtime"`          // 纳秒
+	Info    *MediaInfo `json:"info,omitempty"` // 为空表示解析失败，文件变化前不再重试
+}
+
+const mediaSaveDelay = 3 * time.Second
+
+var mediaCache = struct {
+	sync.Mutex
+	loaded  bool
+	entries map[string]mediaEntry // 素材库相对路径 -> 解析结果
+	timer   *time.Timer
+}{}
+
+func mediaInfoFile() string {
+	return metaPath(".fire_mediainfo.json")
+}
+
+// 文件是否属于能解析媒体信息的格式
+func hasMediaInfo(name string) bool {
+	return mediaParsers[strings.ToLower(filepath.Ext(name))] != nil
+}
+
+// 取文件的媒体信息：缓存命中直接返回，否则解析并稍后写回元数据文件
+func mediaInfoFor(relPath, absPath string, info os.FileInfo) *MediaInfo {
+	if !hasMediaInfo(relPath) {
+		return nil
+	}
+	mediaCache.Lock()
+	if !mediaCache.loaded {
+		entries := make(map[string]mediaEntry)
+		if err := readJSONFile(mediaInfoFile(), &entries); err != nil {
+			logError("读取媒体信息缓存失败", err)
+		}
+		mediaCache.entries, mediaCache.loaded = entries, true
+	}
+	e, ok := mediaCache.entries[relPath]
+	mediaCache.Unlock()
+	if ok && e.Size == info.Size() && e.ModTime == info.ModTime().UnixNano() {
+		return e.Info
+	}
+
+	e = mediaEntry{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+	if m, err := probeMedia(absPath); err == nil {
+		e.Info = m
+	}
+	mediaCache.Lock()
+	mediaCache.entries[relPath] = e
+	if mediaCache.timer == nil {
+		// 一次列出整个文件夹时会连续解析很多文件，合并成一次写入
+		mediaCache.timer = time.AfterFunc(mediaSaveDelay, saveMediaCache)
+	}
+	mediaCache.Unlock()
+	return e.Info
+}
+
+// 写回缓存，顺带清掉已不存在的文件
+func saveMediaCache() {
+	mediaCache.Lock()
+	mediaCache.timer = nil
+	paths := make([]string, 0, len(mediaCache.entries))
+	for p := range mediaCache.entries {
+		paths = append(paths, p)
+	}
+	mediaCache.Unlock()
+	sort.Strings(paths)
+	var gone []string
+	for _, p := range paths {
+		abs, ok := resolvePath(p)
+		if !ok {
+			gone = append(gone, p)
+			continue
+		}
+		if _, err := os.Stat(abs); os.IsNotExist(err) {
+			gone = append(gone, p)
+		}
+	}
+
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	mediaCache.Lock()
+	for _, p := range gone {
+		delete(mediaCache.entries, p)
+	}
+	entries := make(map[string]mediaEntry, len(mediaCache.entries))
+	for p, e := range mediaCache.entries {
+		entries[p] = e
+	}
+	mediaCache.Unlock()
+	if err := writeHiddenJSON(mediaInfoFile(), entries); err != nil {
+		logError("写入媒体信息缓存失败", err)
+	}
+}
+
+// ===== 书签校验 =====
+
+// 超出时长的书签数；时长未知时不判断
+func markersBeyondEnd(markers []Marker, m *MediaInfo) int {
+	n := 0
+	if m != nil && m.Duration > 0 {
+		for _, mk := range markers {
+			if mk.Time > m.Duration {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// 返回带 beyondEnd 标记的副本，不修改缓存中的书签
+func flagMarkers(markers []Marker, m *MediaInfo) []Marker {
+	if markersBeyondEnd(markers, m) == 0 {
+		return markers
+	}
+	out := make([]Marker, len(markers))
+	for i, mk := range markers {
+		mk.BeyondEnd = mk.Time > m.Duration
+		out[i] = mk
+	}
+	return out
+}
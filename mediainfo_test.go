@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func mp4Box(typ string, body ...[]byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(8+len(bytes.Join(body, nil))))
+	b = append(b, typ...)
+	return append(b, bytes.Join(body, nil)...)
+}
+
+// 层层嵌套的同名容器盒子，只有头部没有内容
+func nestedBoxes(typ string, depth int) []byte {
+	b := make([]byte, 0, 8*depth)
+	for i := 0; i < depth; i++ {
+		b = binary.BigEndian.AppendUint32(b, uint32(8*(depth-i)))
+		b = append(b, typ...)
+	}
+	return b
+}
+
+func TestParseTrakNestedBoxes(t *testing.T) {
+	// 曾经会沿嵌套的 stbl/mdia 一直递归直到栈溢出，整个进程退出
+	for _, typ := range []string{"stbl", "mdia", "minf", "trak"} {
+		data := mp4Box("mdia", mp4Box("minf", mp4Box("stbl", nestedBoxes(typ, 200000))))
+		var m MediaInfo
+		parseTrak(bytes.NewReader(data), 0, int64(len(data)), &m)
+		if m.VideoCodec != "" || m.AudioCodec != "" {
+			t.Errorf("%s: 意外解析出编码 %+v", typ, m)
+		}
+	}
+}
+
+func TestProbeMediaNestedMP4(t *testing.T) {
+	moov := mp4Box("moov", mp4Box("trak", nestedBoxes("stbl", 100000)))
+	file := filepath.Join(t.TempDir(), "nested.mp4")
+	if err := os.WriteFile(file, append(mp4Box("ftyp", []byte("isom")), moov...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := probeMedia(file); err != nil {
+		t.Fatalf("probeMedia: %v", err)
+	}
+}
+
+func writeMedia(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// 盒子头部：声明的长度和类型，不带内容
+func boxHeader(size uint32, typ string) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, size), typ...)
+}
+
+func TestWalkBoxes(t *testing.T) {
+	ftyp := mp4Box("ftyp", []byte("isom"))
+	cases := []struct {
+		name string
+		data []byte
+		want []string
+	}{
+		{"正常", append(append([]byte{}, ftyp...), mp4Box("free")...), []string{"ftyp", "free"}},
+		{"声明超出文件", append(append([]byte{}, ftyp...), boxHeader(1000, "moov")...), []string{"ftyp"}},
+		{"长度小于头部", boxHeader(4, "moov"), nil},
+		{"长度为 0 延伸到结尾", append(boxHeader(0, "mdat"), "data"...), []string{"mdat"}},
+		{"64 位长度", binary.BigEndian.AppendUint64(boxHeader(1, "wide"), 16), []string{"wide"}},
+		{"64 位长度超出文件", binary.BigEndian.AppendUint64(boxHeader(1, "wide"), 1<<62), nil},
+		{"64 位长度小于头部", binary.BigEndian.AppendUint64(boxHeader(1, "wide"), 8), nil},
+		{"结尾不足一个头部", append(append([]byte{}, ftyp...), 0, 0, 0), []string{"ftyp"}},
+	}
+	for _, c := range cases {
+		var got []string
+		walkBoxes(bytes.NewReader(c.data), 0, int64(len(c.data)), func(typ string, body, bodyEnd int64) error {
+			if body > bodyEnd || bodyEnd > int64(len(c.data)) {
+				t.Errorf("%s: %s 的内容范围 [%d, %d) 越界", c.name, typ, body, bodyEnd)
+			}
+			got = append(got, typ)
+			return nil
+		})
+		if strings.Join(got, ",") != strings.Join(c.want, ",") {
+			t.Errorf("%s: 遍历到 %v，期望 %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestProbeMP4(t *testing.T) {
+	mvhd := make([]byte, 20)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 5000)
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:], 1280<<16)
+	binary.BigEndian.PutUint32(tkhd[80:], 720<<16)
+	trak := mp4Box("trak", mp4Box("tkhd", tkhd),
+		mp4Box("mdia", mp4Box("hdlr", []byte("\x00\x00\x00\x00\x00\x00\x00\x00vide")),
+			mp4Box("minf", mp4Box("stbl", mp4Box("stsd", []byte("\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x10avc1"))))))
+	ftyp := mp4Box("ftyp", []byte("isom"))
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	cases := []struct {
+		name string
+		data []byte
+		want *MediaInfo // nil 表示应当报错
+	}{
+		{"完整", join(ftyp, mp4Box("moov", mp4Box("mvhd", mvhd), trak)),
+			&MediaInfo{Duration: 5, Width: 1280, Height: 720, VideoCodec: "H.264"}},
+		{"mvhd 声明超出 moov", join(ftyp, mp4Box("moov", boxHeader(500, "mvhd"), mvhd)), &MediaInfo{}},
+		{"mvhd 内容过短", join(ftyp, mp4Box("moov", mp4Box("mvhd", mvhd[:8]), trak)),
+			&MediaInfo{Width: 1280, Height: 720, VideoCodec: "H.264"}},
+		{"moov 被截断", join(ftyp, boxHeader(4096, "moov"), mp4Box("mvhd", mvhd)), nil},
+		{"没有 moov", join(ftyp, mp4Box("mdat", []byte("data"))), nil},
+		{"空文件", nil, nil},
+	}
+	for _, c := range cases {
+		m, err := probeMedia(writeMedia(t, "a.mp4", c.data))
+		switch {
+		case c.want == nil && err == nil:
+			t.Errorf("%s: 期望报错，得到 %+v", c.name, m)
+		case c.want != nil && err != nil:
+			t.Errorf("%s: %v", c.name, err)
+		case c.want != nil && *m != *c.want:
+			t.Errorf("%s: 得到 %+v，期望 %+v", c.name, m, c.want)
+		}
+	}
+}
+
+// ===== EBML =====
+
+// 元素：ID（含长度标记）+ 8 字节长度 + 内容
+func ebmlElem(id uint64, body ...[]byte) []byte {
+	data := bytes.Join(body, nil)
+	return append(append(ebmlID(id), binary.BigEndian.AppendUint64(nil, uint64(len(data))|1<<56)...), data...)
+}
+
+// 长度未知的元素（长度字段全为 1）
+func ebmlUnknown(id uint64, body ...[]byte) []byte {
+	return append(append(ebmlID(id), 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF), bytes.Join(body, nil)...)
+}
+
+func ebmlID(id uint64) []byte {
+	b := binary.BigEndian.AppendUint64(nil, id)
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+func TestReadVint(t *testing.T) {
+	cases := []struct {
+		data       []byte
+		keepMarker bool
+		want       uint64
+		n          int
+		err        bool
+	}{
+		{[]byte{0x81}, false, 1, 1, false},
+		{[]byte{0x40, 0x02}, false, 2, 2, false},
+		{[]byte{0x1A, 0x45, 0xDF, 0xA3}, true, ebmlHeaderID, 4, false},
+		{[]byte{0xFF}, false, math.MaxUint64, 1, false}, // 未知长度
+		{[]byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, false, math.MaxUint64, 8, false},
+		{[]byte{0xFF}, true, 0xFF, 1, false}, // ID 不做未知长度处理
+		{[]byte{0x00, 0x01}, false, 0, 0, true},
+		{[]byte{0x40}, false, 0, 0, true}, // 截断
+		{nil, false, 0, 0, true},
+	}
+	for _, c := range cases {
+		v, n, err := readVint(bytes.NewReader(c.data), 0, c.keepMarker)
+		if (err != nil) != c.err || (!c.err && (v != c.want || n != c.n)) {
+			t.Errorf("readVint(% x, %v) = %#x, %d, %v；期望 %#x, %d, 出错=%v", c.data, c.keepMarker, v, n, err, c.want, c.n, c.err)
+		}
+	}
+}
+
+func TestWalkEBML(t *testing.T) {
+	type span struct{ body, bodyEnd int64 }
+	cases := []struct {
+		name string
+		data []byte
+		want []span
+	}{
+		{"正常", append(ebmlElem(0x83, []byte{1}), ebmlElem(0x86, []byte("ab"))...), []span{{9, 10}, {19, 21}}},
+		{"长度未知延伸到结尾", ebmlUnknown(0xAE, ebmlElem(0x83, []byte{1})), []span{{9, 19}}},
+		{"长度超出父元素", append([]byte{0x83, 0x90}, 1, 2), []span{{2, 4}}},
+		{"元素头被截断", []byte{0x83, 0x01, 0xFF}, nil},
+	}
+	for _, c := range cases {
+		var got []span
+		walkEBML(bytes.NewReader(c.data), 0, int64(len(c.data)), func(id uint64, body, bodyEnd int64) bool {
+			got = append(got, span{body, bodyEnd})
+			return true
+		})
+		if len(got) != len(c.want) {
+			t.Errorf("%s: 得到 %v，期望 %v", c.name, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%s: 得到 %v，期望 %v", c.name, got, c.want)
+				break
+			}
+		}
+	}
+}
+
+func TestProbeMatroska(t *testing.T) {
+	header := ebmlElem(ebmlHeaderID, ebmlElem(0x4282, []byte("webm")))
+	duration := binary.BigEndian.AppendUint64(nil, math.Float64bits(2500))
+	info := ebmlElem(ebmlInfo, ebmlElem(ebmlTimecode, []byte{0x0F, 0x42, 0x40}), ebmlElem(ebmlDuration, duration),
+		ebmlElem(ebmlTitle, []byte("第一课")))
+	tracks := ebmlElem(ebmlTracks,
+		ebmlElem(ebmlTrackEntry, ebmlElem(ebmlTrackType, []byte{1}), ebmlElem(ebmlCodecID, []byte("V_VP9")),
+			ebmlElem(ebmlVideo, ebmlElem(ebmlPixelWidth, []byte{0x02, 0x80}), ebmlElem(ebmlPixelHeight, []byte{0x01, 0x68}))),
+		ebmlElem(ebmlTrackEntry, ebmlElem(ebmlTrackType, []byte{2}), ebmlElem(ebmlCodecID, []byte("A_OPUS"))))
+	full := &MediaInfo{Duration: 2.5, Width: 640, Height: 360, VideoCodec: "VP9", AudioCodec: "Opus", Title: "第一课"}
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+
+	cases := []struct {
+		name string
+		data []byte
+		want *MediaInfo
+	}{
+		{"完整", join(header, ebmlElem(ebmlSegment, info, tracks)), full},
+		{"Segment 长度未知（直播录制）", join(header, ebmlUnknown(ebmlSegment, info, tracks, ebmlUnknown(ebmlCluster))), full},
+		{"Info 长度未知", join(header, ebmlElem(ebmlSegment, ebmlUnknown(ebmlInfo, info[12:]), tracks)),
+			&MediaInfo{Duration: 2.5, Title: "第一课"}},
+		{"Segment 声明超出文件", join(header, ebmlID(ebmlSegment), []byte{0x01, 0, 0, 0, 0, 0x10, 0, 0}, info), &MediaInfo{Duration: 2.5, Title: "第一课"}},
+		{"没有 Segment", header, nil},
+		{"不是 EBML", []byte("RIFF....WAVE"), nil},
+	}
+	for _, c := range cases {
+		m, err := probeMedia(writeMedia(t, "a.webm", c.data))
+		switch {
+		case c.want == nil && err == nil:
+			t.Errorf("%s: 期望报错，得到 %+v", c.name, m)
+		case c.want != nil && err != nil:
+			t.Errorf("%s: %v", c.name, err)
+		case c.want != nil && *m != *c.want:
+			t.Errorf("%s: 得到 %+v，期望 %+v", c.name, m, c.want)
+		}
+	}
+}
+
+// ===== ID3 / MP3 =====
+
+func id3Frame(id string, major byte, body []byte) []byte {
+	b := []byte(id)
+	switch major {
+	case 2:
+		return append(append(b, byte(len(body)>>16), byte(len(body)>>8), byte(len(body))), body...)
+	case 4:
+		b = append(b, syncsafe(len(body))...)
+	default:
+		b = binary.BigEndian.AppendUint32(b, uint32(len(body)))
+	}
+	return append(append(b, 0, 0), body...)
+}
+
+func syncsafe(n int) []byte {
+	return []byte{byte(n >> 21 & 0x7F), byte(n >> 14 & 0x7F), byte(n >> 7 & 0x7F), byte(n & 0x7F)}
+}
+
+func TestID3Title(t *testing.T) {
+	long := append([]byte{0}, bytes.Repeat([]byte("a"), 199)...)
+	cases := []struct {
+		name  string
+		major byte
+		tag   []byte
+		want  string
+	}{
+		{"v2.3 Latin-1", 3, id3Frame("TIT2", 3, []byte("\x00Hello")), "Hello"},
+		{"v2.3 跳过其他帧", 3, append(id3Frame("TPE1", 3, []byte("\x00Who")), id3Frame("TIT2", 3, []byte("\x03标题"))...), "标题"},
+		{"v2.3 UTF-16 带 BOM", 3, id3Frame("TIT2", 3, []byte("\x01\xFF\xFE\x07\x68\x98\x98")), "标题"},
+		{"v2.4 同步安全长度", 4, id3Frame("TIT2", 4, long), string(long[1:])},
+		{"v2.2", 2, id3Frame("TT2", 2, []byte("\x00Old")), "Old"},
+		{"帧长度超出标签", 3, id3Frame("TIT2", 3, []byte("\x00Hello"))[:12], ""},
+		{"帧长度为 0", 3, append(id3Frame("TPE1", 3, nil), id3Frame("TIT2", 3, []byte("\x00x"))...), ""},
+		{"帧长度为负", 3, append([]byte("TIT2\xFF\xFF\xFF\xFF\x00\x00"), "\x00Hello"...), ""},
+		{"填充区", 3, make([]byte, 32), ""},
+		{"不足一个帧头", 3, []byte("TIT2"), ""},
+	}
+	for _, c := range cases {
+		if got := id3Title(c.tag, c.major); got != c.want {
+			t.Errorf("%s: 得到 %q，期望 %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestProbeMP3(t *testing.T) {
+	id3 := func(size []byte, body []byte) []byte {
+		return append(append([]byte("ID3\x03\x00\x00"), size...), body...)
+	}
+	title := id3Frame("TIT2", 3, []byte("\x00Song"))
+	frame := append([]byte{0xFF, 0xFB, 0x90, 0x00}, make([]byte, 15996)...) // MPEG-1 Layer III 128kbps，共 16000 字节
+	cases := []struct {
+		name string
+		data []byte
+		want *MediaInfo
+	}{
+		{"标签加一帧", append(id3(syncsafe(len(title)), title), frame...), &MediaInfo{Duration: 1, AudioCodec: "MP3", Title: "Song"}},
+		{"没有标签", frame, &MediaInfo{Duration: 1, AudioCodec: "MP3"}},
+		{"标签长度超出文件", id3(syncsafe(100000), title), &MediaInfo{AudioCodec: "MP3", Title: "Song"}},
+		{"标签长度超过上限", id3([]byte{0x7F, 0x7F, 0x7F, 0x7F}, title), nil},
+		{"长度不是同步安全整数", id3([]byte{0xFF, 0xFF, 0xFF, 0xFF}, title), nil},
+		{"只有标签头", []byte("ID3\x03\x00"), nil},
+	}
+	for _, c := range cases {
+		m, err := probeMedia(writeMedia(t, "a.mp3", c.data))
+		switch {
+		case c.want == nil && err == nil:
+			t.Errorf("%s: 期望报错，得到 %+v", c.name, m)
+		case c.want != nil && err != nil:
+			t.Errorf("%s: %v", c.name, err)
+		case c.want != nil && *m != *c.want:
+			t.Errorf("%s: 得到 %+v，期望 %+v", c.name, m, c.want)
+		}
+	}
+}
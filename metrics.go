@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ===== 运行指标 =====
+// 手写的 Prometheus 文本格式导出，不引入额外依赖。
+// /metrics 默认关闭，在 .fire_config.json 中 "metrics": {"enabled": true, "token": "..."} 开启；
+// 教师机本机访问或携带 Bearer token 才能读取。
+
+type MetricsConfig struct {
+	Enabled bool   `json:"enabled"`
+	Token   string `json:"token"`
+}
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type routeStats struct {
+	codes   map[int]uint64
+	buckets []uint64 // 与 latencyBuckets 一一对应的累计计数
+	sum     float64
+	count   uint64
+}
+
+// 按秒分桶的滑动窗口速率计
+type rateMeter struct {
+	mu      sync.Mutex
+	seconds [10]int64
+	bytes   [10]int64
+}
+
+func (m *rateMeter) add(n int64) {
+	now := time.Now().Unix()
+	i := now % int64(len(m.bytes))
+	m.mu.Lock()
+	if m.seconds[i] != now {
+		m.seconds[i] = now
+		m.bytes[i] = 0
+	}
+	m.bytes[i] += n
+	m.mu.Unlock()
+}
+
+// 最近 5 个完整秒的平均字节速率
+func (m *rateMeter) rate() int64 {
+	now := time.Now().Unix()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var total int64
+	for i := range m.bytes {
+		if age := now - m.seconds[i]; age >= 1 && age <= 5 {
+			total += m.bytes[i]
+		}
+	}
+	return total / 5
+}
+
+type metaOpCounter struct {
+	mu  sync.Mutex
+	ops map[string]uint64
+}
+
+func (c *metaOpCounter) inc(op string) {
+	c.mu.Lock()
+	c.ops[op]++
+	c.mu.Unlock()
+}
+
+var (
+	routeMu       sync.Mutex
+	routeMetrics  = make(map[string]*routeStats)
+	filesServed   atomic.Int64
+	uploadedBytes atomic.Int64
+	activeStreams atomic.Int64
+	egressMeter   = &rateMeter{}
+	uploadMeter   = &rateMeter{}
+	metaOps       = &metaOpCounter{ops: make(map[string]uint64)}
+
+	clientsMu   sync.Mutex
+	clientsSeen = make(map[string]time.Time)
+)
+
+const clientWindow = 2 * time.Minute
+
+func observeRequest(route string, code int, d time.Duration) {
+	routeMu.Lock()
+	defer routeMu.Unlock()
+	st := routeMetrics[route]
+	if st == nil {
+		st = &routeStats{codes: make(map[int]uint64), buckets: make([]uint64, len(latencyBuckets))}
+		routeMetrics[route] = st
+	}
+	st.codes[code]++
+	sec := d.Seconds()
+	for i, b := range latencyBuckets {
+		if sec <= b {
+			st.buckets[i]++
+		}
+	}
+	st.sum += sec
+	st.count++
+}
+
+// 记录访问过的学生端 IP（本机不计入）
+func touchClient(ip string) {
+	if parsed := net.ParseIP(ip); parsed == nil || parsed.IsLoopback() {
+		return
+	}
+	clientsMu.Lock()
+	clientsSeen[ip] = time.Now()
+	clientsMu.Unlock()
+}
+
+// 最近两分钟内有请求的学生端数量
+func connectedClients() int {
+	cutoff := time.Now().Add(-clientWindow)
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	n := 0
+	for ip, t := range clientsSeen {
+		if t.Before(cutoff) {
+			delete(clientsSeen, ip)
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// 统计写出的字节数，透传 Flush
+type meteredWriter struct {
+	http.ResponseWriter
+	status int
+	files  bool
+}
+
+func (m *meteredWriter) WriteHeader(code int) {
+	if m.status == 0 {
+		m.status = code
+	}
+	m.ResponseWriter.WriteHeader(code)
+}
+
+func (m *meteredWriter) Write(b []byte) (int, error) {
+	if m.status == 0 {
+		m.status = http.StatusOK
+	}
+	n, err := m.ResponseWriter.Write(b)
+	egressMeter.add(int64(n))
+	if m.files {
+		filesServed.Add(int64(n))
+	}
+	return n, err
+}
+
+func (m *meteredWriter) Flush() {
+	if f, ok := m.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// 统计读入的上传字节数
+type meteredBody struct {
+	io.ReadCloser
+}
+
+func (b meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	uploadedBytes.Add(int64(n))
+	uploadMeter.add(int64(n))
+	return n, err
+}
+
+// 指标采集中间件，以 ServeMux 匹配到的路由模式作为 route 标签
+func withMetrics(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "other"
+		}
+		touchClient(clientIP(r))
+
+		mw := &meteredWriter{ResponseWriter: w, files: route == "/files/"}
+		if mw.files && r.Header.Get("Range") != "" {
+			activeStreams.Add(1)
+			defer activeStreams.Add(-1)
+		}
+		if route == "/api/upload" && r.Body != nil {
+			r.Body = meteredBody{r.Body}
+		}
+		mux.ServeHTTP(mw, r)
+		if mw.status == 0 {
+			mw.status = http.StatusOK
+		}
+		observeRequest(route, mw.status, time.Since(start))
+	})
+}
+
+func writeMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP firecloud_http_requests_total HTTP requests by route and status code.")
+	fmt.Fprintln(w, "# TYPE firecloud_http_requests_total counter")
+	routeMu.Lock()
+	routes := make([]string, 0, len(routeMetrics))
+	for r := range routeMetrics {
+		routes = append(routes, r)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		st := routeMetrics[route]
+		codes := make([]int, 0, len(st.codes))
+		for c := range st.codes {
+			codes = append(codes, c)
+		}
+		sort.Ints(codes)
+		for _, c := range codes {
+			fmt.Fprintf(w, "firecloud_http_requests_total{route=%q,code=\"%d\"} %d\n", route, c, st.codes[c])
+		}
+	}
+	fmt.Fprintln(w, "# HELP firecloud_http_request_duration_seconds HTTP request latency by route.")
+	fmt.Fprintln(w, "# TYPE firecloud_http_request_duration_seconds histogram")
+	for _, route := range routes {
+		st := routeMetrics[route]
+		for i, b := range latencyBuckets {
+			fmt.Fprintf(w, "firecloud_http_request_duration_seconds_bucket{route=%q,le=\"%g\"} %d\n", route, b, st.buckets[i])
+		}
+		fmt.Fprintf(w, "firecloud_http_request_duration_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", route, st.count)
+		fmt.Fprintf(w, "firecloud_http_request_duration_seconds_sum{route=%q} %g\n", route, st.sum)
+		fmt.Fprintf(w, "firecloud_http_request_duration_seconds_count{route=%q} %d\n", route, st.count)
+	}
+	routeMu.Unlock()
+
+	gauge := func(name, help, typ string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, typ, name, v)
+	}
+	gauge("firecloud_files_served_bytes_total", "Bytes served from /files/.", "counter", filesServed.Load())
+	gauge("firecloud_egress_bytes_per_second", "Outgoing bytes per second over the last 5s.", "gauge", egressMeter.rate())
+	gauge("firecloud_active_streams", "In-flight Range requests on /files/.", "gauge", activeStreams.Load())
+	gauge("firecloud_upload_bytes_total", "Bytes received by /api/upload.", "counter", uploadedBytes.Load())
+	gauge("firecloud_upload_bytes_per_second", "Upload bytes per second over the last 5s.", "gauge", uploadMeter.rate())
+	gauge("firecloud_connected_clients", "Distinct student IPs seen in the last 2 minutes.", "gauge", int64(connectedClients()))
+
+	fmt.Fprintln(w, "# HELP firecloud_metadata_ops_total Metadata store reads and writes.")
+	fmt.Fprintln(w, "# TYPE firecloud_metadata_ops_total counter")
+	metaOps.mu.Lock()
+	ops := make([]string, 0, len(metaOps.ops))
+	for op := range metaOps.ops {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		fmt.Fprintf(w, "firecloud_metadata_ops_total{op=%q} %d\n", op, metaOps.ops[op])
+	}
+	metaOps.mu.Unlock()
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	cfg := getConfig().Metrics
+	if !cfg.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !isTeacherRequest(r) && (cfg.Token == "" || !secureEqual(token, cfg.Token)) {
+		http.Error(w, "未授权", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w)
+}
+
+// 托盘提示与状态接口共用的实时数字
+func liveStats() map[string]interface{} {
+	return map[string]interface{}{
+		"clients":       connectedClients(),
+		"activeStreams": activeStreams.Load(),
+		"egressRate":    egressMeter.rate(),
+		"uploadRate":    uploadMeter.rate(),
+	}
+}
+
+func liveTooltip() string {
+	return fmt.Sprintf("FireCloud 教学云盘 · %d 名学生在线 · %s/s", connectedClients(), formatBytes(egressMeter.rate()))
+}
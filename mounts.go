@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ===== 挂载点 =====
+// 根目录之外的文件夹（第二块硬盘、临时插入的 U 盘）以名称挂到素材库顶层：
+// 相对路径的第一段与挂载名相同时，其余部分落在挂载目录下，例如 videos/第一课.mp4 -> E:\Videos\第一课.mp4。
+// 书签、标签和备课引用仍保存在根目录的 .fire_* 中，键就是这样的虚拟路径，因此跨挂载点照常工作。
+// 挂载点保存在 .fire_config.json 的 mounts 中，可通过 /api/mounts 在运行时增删。
+
+type Mount struct {
+	Name     string   `json:"name"`
+	Path     string   `json:"path"`
+	ReadOnly bool     `json:"readOnly"`
+	Allow    []string `json:"allow,omitempty"` // 可访问的用户名、角色（teacher / student）或名册中的班级，为空表示所有人
+}
+
+type MountStatus struct {
+	Mount
+	Available bool `json:"available"` // 目录当前是否存在（U 盘拔出后为 false）
+}
+
+// 路径是否位于 base 之内（含 base 本身）
+func isWithin(base, absPath string) bool {
+	base = strings.ToLower(filepath.Clean(base))
+	p := strings.ToLower(filepath.Clean(absPath))
+	return p == base || strings.HasPrefix(p, strings.TrimSuffix(base, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// 相对路径所属的挂载点及其在挂载目录内的剩余部分；不属于任何挂载点时返回 nil
+func splitMount(relPath string) (*Mount, string) {
+	top, rest, _ := strings.Cut(relPath, "/")
+	if top == "" {
+		return nil, relPath
+	}
+	for _, m := range getConfig().Mounts {
+		if strings.EqualFold(m.Name, top) {
+			m := m
+			return &m, rest
+		}
+	}
+	return nil, relPath
+}
+
+// 路径中是否含有 .fire_* 元数据（账号、名册等），这些文件只能经由各自的 API 访问
+func isMetaPath(relPath string) bool {
+	for _, part := range strings.Split(relPath, "/") {
+		if strings.HasPrefix(strings.ToLower(part), ".fire_") {
+			return true
+		}
+	}
+	return false
+}
+
+// 把素材库中的相对路径解析为磁盘上的绝对路径，越界或指向元数据时返回 false
+func resolvePath(relPath string) (string, bool) {
+	if isMetaPath(relPath) {
+		return "", false
+	}
+	base := rootDir
+	rest := relPath
+	if m, sub := splitMount(relPath); m != nil {
+		base, rest = m.Path, sub
+	}
+	absPath := filepath.Join(base, filepath.FromSlash(rest))
+	return absPath, isWithin(base, absPath)
+}
+
+// 元数据、索引等内部来源的路径直接换算为磁盘路径
+func libraryPath(relPath string) string {
+	absPath, _ := resolvePath(relPath)
+	return absPath
+}
+
+// 路径所在的磁盘目录（根目录或挂载目录），用于查询剩余空间
+func libraryBase(relPath string) string {
+	if m, _ := splitMount(relPath); m != nil {
+		return m.Path
+	}
+	return rootDir
+}
+
+// 请求方可匹配 ACL 的身份：用户名与角色；名册中的学生还可按班级匹配
+func requestIdentities(r *http.Request) []string {
+	var ids []string
+	if isTeacherRequest(r) {
+		ids = append(ids, "teacher")
+	}
+	if acct, ok := authenticate(r); ok {
+		ids = append(ids, acct.Name, acct.Role)
+	} else if id, ok := studentIdentity(r); ok {
+		ids = append(ids, id.label(), id.Class, "student")
+	}
+	return ids
+}
+
+func (m *Mount) allows(r *http.Request) bool {
+	if len(m.Allow) == 0 || isTeacherRequest(r) {
+		return true
+	}
+	for _, id := range requestIdentities(r) {
+		if containsString(m.Allow, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// 读权限：根目录下的路径所有人可读，挂载点按 ACL；尚未发布或已撤下的内容对学生不可读
+func canRead(r *http.Request, relPath string) bool {
+	if hiddenFrom(r, relPath) {
+		return false
+	}
+	m, _ := splitMount(relPath)
+	return m == nil || m.allows(r)
+}
+
+// 写权限：只读挂载点拒绝一切写入
+func canWrite(r *http.Request, relPath string) bool {
+	m, _ := splitMount(relPath)
+	return m == nil || (!m.ReadOnly && m.allows(r))
+}
+
+// 解析路径并检查读权限，失败时直接写出错误响应
+func resolveForRead(w http.ResponseWriter, r *http.Request, relPath string) (string, bool) {
+	if hiddenFrom(r, relPath) {
+		http.NotFound(w, r) // 不透露未发布的内容是否存在
+		return "", false
+	}
+	absPath, ok := resolvePath(relPath)
+	if !ok || !canRead(r, relPath) {
+		http.Error(w, "禁止访问", http.StatusForbidden)
+		return "", false
+	}
+	return absPath, true
+}
+
+// 解析路径并检查写权限
+func resolveForWrite(w http.ResponseWriter, r *http.Request, relPath string) (string, bool) {
+	absPath, ok := resolvePath(relPath)
+	if !ok || !canRead(r, relPath) {
+		http.Error(w, "禁止访问", http.StatusForbidden)
+		return "", false
+	}
+	if !canWrite(r, relPath) {
+		http.Error(w, "该挂载点为只读", http.StatusForbidden)
+		return "", false
+	}
+	return absPath, true
+}
+
+// 当前可用（目录存在）的挂载点
+func activeMounts() []Mount {
+	var list []Mount
+	for _, m := range getConfig().Mounts {
+		if info, err := os.Stat(m.Path); err == nil && info.IsDir() {
+			list = append(list, m)
+		}
+	}
+	return list
+}
+
+// 根目录下被挂载点遮盖的同名文件夹
+func shadowedByMount(name string) bool {
+	for _, m := range getConfig().Mounts {
+		if strings.EqualFold(m.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// 遍历整个素材库（根目录和所有可用挂载点）中的全部文件，rel 为虚拟相对路径。
+// 内容索引、用量统计和重复检测都基于它，只跳过 .fire_* 元数据，不受列出用的隐藏规则影响
+func walkLibrary(fn func(rel, absPath string, d fs.DirEntry) error) error {
+	walk := func(base, prefix string) error {
+		return filepath.WalkDir(base, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if p == base {
+				return nil
+			}
+			rel, _ := filepath.Rel(base, p)
+			rel = filepath.ToSlash(rel)
+			if prefix == "" && d.IsDir() && !strings.Contains(rel, "/") && shadowedByMount(rel) {
+				return filepath.SkipDir
+			}
+			if isMetaPath(d.Name()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.IsDir() {
+				return nil
+			}
+			return fn(joinRel(prefix, rel), p, d)
+		})
+	}
+	if err := walk(rootDir, ""); err != nil {
+		return err
+	}
+	for _, m := range activeMounts() {
+		if err := walk(m.Path, m.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateMount(m Mount, existing []Mount) error {
+	if m.Name == "" || strings.HasPrefix(m.Name, ".") || strings.ContainsAny(m.Name, `/\:*?"<>|`) {
+		return errors.New("挂载名为空或包含非法字符")
+	}
+	for _, e := range existing {
+		if strings.EqualFold(e.Name, m.Name) {
+			return errors.New("挂载名已存在: " + m.Name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(rootDir, m.Name)); err == nil {
+		return errors.New("根目录下已有同名文件夹: " + m.Name)
+	}
+	if !filepath.IsAbs(m.Path) {
+		return errors.New("挂载目录必须是绝对路径")
+	}
+	info, err := os.Stat(m.Path)
+	if err != nil || !info.IsDir() {
+		return errors.New("挂载目录不存在: " + m.Path)
+	}
+	if isWithin(rootDir, m.Path) || isWithin(m.Path, rootDir) {
+		return errors.New("挂载目录不能与根目录互相包含")
+	}
+	return nil
+}
+
+func addMount(m Mount) error {
+	m.Path = filepath.Clean(m.Path)
+	var verr error
+	err := updateConfig(func(c *Config) {
+		if verr = validateMount(m, c.Mounts); verr == nil {
+			c.Mounts = append(append([]Mount(nil), c.Mounts...), m)
+		}
+	})
+	if verr != nil {
+		return verr
+	}
+	if err == nil {
+		mountsChanged()
+	}
+	return err
+}
+
+func removeMount(name string) error {
+	found := false
+	err := updateConfig(func(c *Config) {
+		var kept []Mount
+		for _, m := range c.Mounts {
+			if strings.EqualFold(m.Name, name) {
+				found = true
+				continue
+			}
+			kept = append(kept, m)
+		}
+		c.Mounts = kept
+	})
+	if err == nil && !found {
+		return errors.New("挂载点不存在: " + name)
+	}
+	if err == nil {
+		mountsChanged()
+	}
+	return err
+}
+
+// 挂载变化后让目录树、列表缓存和索引看到新的顶层
+func mountsChanged() {
+	treeCache.mu.Lock()
+	treeCache.dropSubtree("")
+	treeCache.mu.Unlock()
+	dataVersion.Add(1)
+	rescanIndex()
+}
+
+func mountStatuses(r *http.Request) []MountStatus {
+	list := []MountStatus{}
+	for _, m := range getConfig().Mounts {
+		if !m.allows(r) {
+			continue
+		}
+		info, err := os.Stat(m.Path)
+		list = append(list, MountStatus{Mount: m, Available: err == nil && info.IsDir()})
+	}
+	return list
+}
+
+// 挂载点 API：GET 列出，POST 添加，DELETE ?name= 移除（增删仅限教师端）
+func handleMounts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list := mountStatuses(r)
+		if !isTeacherRequest(r) {
+			for i := range list {
+				list[i].Path = "" // 不向学生暴露教师机的磁盘路径
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case http.MethodPost:
+		if !requireTeacher(w, r) {
+			return
+		}
+		var m Mount
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			http.Error(w, "Bad JSON", 400)
+			return
+		}
+		if err := addMount(m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		auditLog(r, "mount.add", m.Name, auditDetail("path", m.Path, "readOnly", m.ReadOnly, "allow", strings.Join(m.Allow, ",")))
+		w.Write([]byte("OK"))
+	case http.MethodDelete:
+		if !requireTeacher(w, r) {
+			return
+		}
+		name := r.URL.Query().Get("name")
+		if err := removeMount(name); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		auditLog(r, "mount.remove", name, "")
+		w.Write([]byte("OK"))
+	default:
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+	}
+}
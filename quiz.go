@@ -0,0 +1,729 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// ===== 课堂测验与投票 =====
+// 测验和备课方案一样以名称保存为 .fire_quizzes/<名称>.json；没有标准答案的题目就是投票。
+// 教师端开始一场作答（session）后，学生扫码进入 /quiz 在手机上作答，
+// 投影端通过 SSE 实时收到汇总结果。作答结束后完整记录写入 .fire_quizzes/results/<场次>.json，可导出 CSV。
+
+type QuizQuestion struct {
+	Text     string   `json:"text"`
+	Options  []string `json:"options"`
+	Answer   []int    `json:"answer,omitempty"` // 正确选项的下标，为空表示投票题
+	Multiple bool     `json:"multiple,omitempty"`
+}
+
+type Quiz struct {
+	Name      string         `json:"name"`
+	Questions []QuizQuestion `json:"questions"`
+	TimeLimit int            `json:"timeLimit"` // 作答时限（秒），0 表示由教师手动结束
+	Updated   int64          `json:"updated"`
+}
+
+// 一名学生的作答，Choices[i] 为第 i 题选中的选项（未答为 nil）
+type QuizResponse struct {
+	ID      string  `json:"id"`
+	Name    string  `json:"name"`
+	Class   string  `json:"class,omitempty"` // 名册中的学生才有班级和学号
+	Number  string  `json:"number,omitempty"`
+	Choices [][]int `json:"choices"`
+	Updated int64   `json:"updated"`
+}
+
+// 一场作答的完整记录
+type QuizRecord struct {
+	ID        string         `json:"id"`
+	Quiz      Quiz           `json:"quiz"`
+	Started   int64          `json:"started"`
+	Deadline  int64          `json:"deadline,omitempty"` // 截止时间（Unix 毫秒），0 表示不限时
+	Ended     int64          `json:"ended,omitempty"`
+	Responses []QuizResponse `json:"responses"`
+}
+
+type QuestionResult struct {
+	Text     string   `json:"text"`
+	Options  []string `json:"options"`
+	Multiple bool     `json:"multiple,omitempty"`
+	Counts   []int    `json:"counts"`
+	Answered int      `json:"answered"`
+	Answer   []int    `json:"answer,omitempty"`  // 仅教师端或作答结束后返回
+	Correct  int      `json:"correct,omitempty"` // 答对人数
+	Poll     bool     `json:"poll,omitempty"`
+}
+
+type QuizResults struct {
+	Session      string           `json:"session"`
+	Quiz         string           `json:"quiz"`
+	Open         bool             `json:"open"`
+	Deadline     int64            `json:"deadline,omitempty"`
+	Participants int              `json:"participants"`
+	Questions    []QuestionResult `json:"questions"`
+}
+
+type quizSession struct {
+	QuizRecord
+	byID    map[string]int // 学生标识 -> Responses 下标
+	timer   *time.Timer
+	watches map[chan struct{}]bool
+}
+
+// 进行中和本次运行内结束的场次；current 为学生扫码进入时默认打开的场次
+var quizzes = struct {
+	sync.Mutex
+	sessions map[string]*quizSession
+	current  string
+	stop     chan struct{} // 关闭时让所有推送流退出，避免拖住优雅退出
+}{sessions: make(map[string]*quizSession)}
+
+const quizCookie = "fire_quiz_id"
+
+func quizDir() string {
+	return metaPath(".fire_quizzes")
+}
+
+func quizResultDir() string {
+	return filepath.Join(quizDir(), "results")
+}
+
+func loadQuiz(name string) (Quiz, bool) {
+	var q Quiz
+	if !isValidLessonName(name) {
+		return q, false
+	}
+	if err := readJSONFile(filepath.Join(quizDir(), name+".json"), &q); err != nil || q.Name == "" {
+		return q, false
+	}
+	return q, true
+}
+
+func quizExists(name string) bool {
+	_, err := os.Stat(filepath.Join(quizDir(), name+".json"))
+	return isValidLessonName(name) && err == nil
+}
+
+func validateQuiz(q *Quiz) []FieldError {
+	var errs []FieldError
+	if !isValidLessonName(q.Name) {
+		errs = append(errs, FieldError{Field: "name", Message: "测验名称为空或包含非法字符"})
+	}
+	if len(q.Questions) == 0 {
+		errs = append(errs, FieldError{Field: "questions", Message: "至少需要一道题"})
+	}
+	if q.TimeLimit < 0 {
+		errs = append(errs, FieldError{Field: "timeLimit", Message: "时限不能为负数"})
+	}
+	for i, qu := range q.Questions {
+		prefix := fmt.Sprintf("questions[%d]", i)
+		if strings.TrimSpace(qu.Text) == "" {
+			errs = append(errs, FieldError{Field: prefix + ".text", Message: "题干不能为空"})
+		}
+		if len(qu.Options) < 2 || len(qu.Options) > 26 {
+			errs = append(errs, FieldError{Field: prefix + ".options", Message: "选项数量应在 2 到 26 之间"})
+		}
+		for j, opt := range qu.Options {
+			if strings.TrimSpace(opt) == "" {
+				errs = append(errs, FieldError{Field: fmt.Sprintf("%s.options[%d]", prefix, j), Message: "选项不能为空"})
+			}
+		}
+		for _, a := range qu.Answer {
+			if a < 0 || a >= len(qu.Options) {
+				errs = append(errs, FieldError{Field: prefix + ".answer", Message: "正确答案超出选项范围"})
+				break
+			}
+		}
+		if len(qu.Answer) > 1 && !qu.Multiple {
+			errs = append(errs, FieldError{Field: prefix + ".answer", Message: "单选题只能有一个正确答案"})
+		}
+	}
+	return errs
+}
+
+// 学生端看到的题目不含正确答案
+func (q Quiz) public() Quiz {
+	out := q
+	out.Questions = make([]QuizQuestion, len(q.Questions))
+	for i, qu := range q.Questions {
+		qu.Answer = nil
+		out.Questions[i] = qu
+	}
+	return out
+}
+
+func newQuizSessionID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(b[:3])
+}
+
+// 学生标识：登录用户名优先，否则用 Cookie 中的随机 ID（首次作答时下发）
+func quizParticipant(w http.ResponseWriter, r *http.Request) string {
+	if user := requestUser(r); user != "" {
+		return "user:" + user
+	}
+	if c, err := r.Cookie(quizCookie); err == nil && len(c.Value) == 16 {
+		return "anon:" + c.Value
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{Name: quizCookie, Value: id, Path: "/", MaxAge: 365 * 24 * 3600, SameSite: http.SameSiteLaxMode})
+	return "anon:" + id
+}
+
+func sameChoices(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	x := append([]int(nil), a...)
+	y := append([]int(nil), b...)
+	sort.Ints(x)
+	sort.Ints(y)
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// 汇总结果；reveal 为 false 时不返回正确答案
+func (rec *QuizRecord) results(open, reveal bool) QuizResults {
+	res := QuizResults{Session: rec.ID, Quiz: rec.Quiz.Name, Open: open, Deadline: rec.Deadline, Participants: len(rec.Responses)}
+	for i, qu := range rec.Quiz.Questions {
+		qr := QuestionResult{Text: qu.Text, Options: qu.Options, Multiple: qu.Multiple, Counts: make([]int, len(qu.Options)), Poll: len(qu.Answer) == 0}
+		for _, resp := range rec.Responses {
+			if i >= len(resp.Choices) || resp.Choices[i] == nil {
+				continue
+			}
+			qr.Answered++
+			for _, c := range resp.Choices[i] {
+				if c >= 0 && c < len(qr.Counts) {
+					qr.Counts[c]++
+				}
+			}
+			if !qr.Poll && sameChoices(resp.Choices[i], qu.Answer) {
+				qr.Correct++
+			}
+		}
+		if reveal {
+			qr.Answer = qu.Answer
+		} else {
+			qr.Correct = 0
+		}
+		res.Questions = append(res.Questions, qr)
+	}
+	return res
+}
+
+// 通知订阅者结果有变化（调用方持有 quizzes 锁）
+func (s *quizSession) notify() {
+	for ch := range s.watches {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *quizSession) open() bool {
+	return s.Ended == 0
+}
+
+func startQuizSession(q Quiz) *quizSession {
+	quizzes.Lock()
+	defer quizzes.Unlock()
+	s := &quizSession{
+		QuizRecord: QuizRecord{ID: newQuizSessionID(), Quiz: q, Started: time.Now().Unix(), Responses: []QuizResponse{}},
+		byID:       make(map[string]int),
+		watches:    make(map[chan struct{}]bool),
+	}
+	if q.TimeLimit > 0 {
+		limit := time.Duration(q.TimeLimit) * time.Second
+		s.Deadline = time.Now().Add(limit).UnixMilli()
+		id := s.ID
+		s.timer = time.AfterFunc(limit, func() { stopQuizSession(id) })
+	}
+	quizzes.sessions[s.ID] = s
+	quizzes.current = s.ID
+	return s
+}
+
+// 结束作答并保存记录；重复调用无副作用
+func stopQuizSession(id string) (*QuizRecord, error) {
+	quizzes.Lock()
+	s := quizzes.sessions[id]
+	if s == nil {
+		quizzes.Unlock()
+		return nil, errors.New("场次不存在或已结束: " + id)
+	}
+	if !s.open() {
+		rec := s.QuizRecord
+		quizzes.Unlock()
+		return &rec, nil
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.Ended = time.Now().Unix()
+	s.notify()
+	rec := s.QuizRecord
+	rec.Responses = append([]QuizResponse(nil), s.Responses...)
+	quizzes.Unlock()
+
+	os.MkdirAll(quizResultDir(), 0755)
+	metaMu.Lock()
+	err := writeHiddenJSON(filepath.Join(quizResultDir(), rec.ID+".json"), rec)
+	metaMu.Unlock()
+	if err != nil {
+		logError("保存测验结果失败", err)
+	}
+	appLog.write(LogEntry{Type: "audit", Action: "quiz.stop", Target: rec.Quiz.Name, Detail: auditDetail("session", rec.ID, "responses", len(rec.Responses))})
+	return &rec, err
+}
+
+// 场次记录：进行中的从内存取，已结束的从结果文件取
+func findQuizRecord(id string) (QuizRecord, bool, bool) {
+	quizzes.Lock()
+	if s := quizzes.sessions[id]; s != nil {
+		rec := s.QuizRecord
+		rec.Responses = append([]QuizResponse(nil), s.Responses...)
+		open := s.open()
+		quizzes.Unlock()
+		return rec, open, true
+	}
+	quizzes.Unlock()
+	var rec QuizRecord
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return rec, false, false
+	}
+	if err := readJSONFile(filepath.Join(quizResultDir(), id+".json"), &rec); err != nil || rec.ID == "" {
+		return rec, false, false
+	}
+	return rec, false, true
+}
+
+// 让所有结果推送流结束（服务退出时调用）
+func closeQuizStreams() {
+	quizzes.Lock()
+	defer quizzes.Unlock()
+	if quizzes.stop != nil {
+		close(quizzes.stop)
+		quizzes.stop = nil
+	}
+}
+
+// 保存测验（仅限教师端，题目中含正确答案）
+func handleSaveQuiz(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	var q Quiz
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		http.Error(w, "Bad JSON", 400)
+		return
+	}
+	if errs := validateQuiz(&q); len(errs) > 0 {
+		writeValidationErrors(w, "测验校验失败", errs)
+		return
+	}
+	q.Updated = time.Now().Unix()
+	os.MkdirAll(quizDir(), 0755)
+	metaMu.Lock()
+	err := writeHiddenJSON(filepath.Join(quizDir(), q.Name+".json"), q)
+	metaMu.Unlock()
+	if err != nil {
+		logError("写入测验失败", err)
+		http.Error(w, "写入测验失败", http.StatusInternalServerError)
+		return
+	}
+	auditLog(r, "quiz.save", q.Name, auditDetail("questions", len(q.Questions)))
+	w.Write([]byte("OK"))
+}
+
+// 列出所有测验
+func handleListQuizzes(w http.ResponseWriter, r *http.Request) {
+	list := []string{}
+	entries, _ := os.ReadDir(quizDir())
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			list = append(list, strings.TrimSuffix(e.Name(), ".json"))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// 获取测验；学生端拿不到正确答案
+func handleGetQuiz(w http.ResponseWriter, r *http.Request) {
+	q, ok := loadQuiz(r.URL.Query().Get("name"))
+	if !ok {
+		http.Error(w, "测验不存在", http.StatusNotFound)
+		return
+	}
+	if !isTeacherRequest(r) {
+		q = q.public()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(q)
+}
+
+// 学生扫码进入作答页的地址
+func quizJoinURL(r *http.Request, session string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/quiz?session=%s", scheme, r.Host, url.QueryEscape(session))
+}
+
+// 开始作答：POST ?name=，返回场次和供学生扫码的二维码
+func handleRunQuiz(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+		return
+	}
+	q, ok := loadQuiz(r.URL.Query().Get("name"))
+	if !ok {
+		http.Error(w, "测验不存在", http.StatusNotFound)
+		return
+	}
+	s := startQuizSession(q)
+	joinURL := quizJoinURL(r, s.ID)
+	png, err := qrcode.Encode(joinURL, qrcode.Medium, 256)
+	if err != nil {
+		http.Error(w, "QR Generation failed", 500)
+		return
+	}
+	auditLog(r, "quiz.run", q.Name, auditDetail("session", s.ID, "timeLimit", q.TimeLimit))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session":  s.ID,
+		"deadline": s.Deadline,
+		"url":      joinURL,
+		"qr":       base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+// 结束作答：POST ?session=
+func handleStopQuiz(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+		return
+	}
+	rec, err := stopQuizSession(r.URL.Query().Get("session"))
+	if rec == nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "保存测验结果失败", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec.results(false, true))
+}
+
+// 学生端：当前场次的题目（不含答案）和自己已提交的作答
+func handleQuizCurrent(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("session")
+	participant := quizParticipant(w, r)
+	quizzes.Lock()
+	if id == "" {
+		id = quizzes.current
+	}
+	s := quizzes.sessions[id]
+	if s == nil {
+		quizzes.Unlock()
+		http.Error(w, "当前没有进行中的测验", http.StatusNotFound)
+		return
+	}
+	resp := map[string]interface{}{
+		"session":  s.ID,
+		"quiz":     s.Quiz.public(),
+		"open":     s.open(),
+		"deadline": s.Deadline,
+	}
+	if id, ok := studentIdentity(r); ok {
+		resp["student"] = id
+	}
+	if i, ok := s.byID[participant]; ok {
+		resp["choices"] = s.Responses[i].Choices
+		resp["name"] = s.Responses[i].Name
+	}
+	quizzes.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+type quizAnswerRequest struct {
+	Session  string `json:"session"`
+	Question int    `json:"question"`
+	Choices  []int  `json:"choices"`
+	Name     string `json:"name"`
+}
+
+// 学生提交一道题的答案，每题只能提交一次
+func handleQuizAnswer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+		return
+	}
+	var req quizAnswerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad JSON", 400)
+		return
+	}
+	participant := quizParticipant(w, r)
+	name := strings.TrimSpace(req.Name)
+	var class, number string
+	if acct, ok := authenticate(r); ok {
+		name = acct.Name
+	} else if id, ok := studentIdentity(r); ok {
+		name, class, number = id.Name, id.Class, id.Number
+	}
+	if len([]rune(name)) > 32 {
+		name = string([]rune(name)[:32])
+	}
+
+	quizzes.Lock()
+	defer quizzes.Unlock()
+	s := quizzes.sessions[req.Session]
+	if s == nil {
+		http.Error(w, "场次不存在", http.StatusNotFound)
+		return
+	}
+	if !s.open() {
+		http.Error(w, "作答已结束", http.StatusConflict)
+		return
+	}
+	if req.Question < 0 || req.Question >= len(s.Quiz.Questions) {
+		http.Error(w, "题号无效", http.StatusBadRequest)
+		return
+	}
+	qu := s.Quiz.Questions[req.Question]
+	seen := make(map[int]bool)
+	for _, c := range req.Choices {
+		if c < 0 || c >= len(qu.Options) || seen[c] {
+			http.Error(w, "选项无效", http.StatusBadRequest)
+			return
+		}
+		seen[c] = true
+	}
+	if len(req.Choices) == 0 || (!qu.Multiple && len(req.Choices) > 1) {
+		http.Error(w, "请选择一个选项", http.StatusBadRequest)
+		return
+	}
+	i, ok := s.byID[participant]
+	if !ok {
+		if name == "" {
+			name = fmt.Sprintf("匿名%d", len(s.Responses)+1)
+		}
+		s.Responses = append(s.Responses, QuizResponse{ID: participant, Name: name, Class: class, Number: number, Choices: make([][]int, len(s.Quiz.Questions))})
+		i = len(s.Responses) - 1
+		s.byID[participant] = i
+	}
+	resp := &s.Responses[i]
+	if resp.Choices[req.Question] != nil {
+		http.Error(w, "本题已作答", http.StatusConflict)
+		return
+	}
+	resp.Choices[req.Question] = req.Choices
+	resp.Updated = time.Now().Unix()
+	s.notify()
+	w.Write([]byte("OK"))
+}
+
+// 实时结果（SSE）：连接后立即推送一次，之后每次有人作答或场次结束时推送
+func handleQuizResults(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("session")
+	reveal := isTeacherRequest(r)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "不支持推送", http.StatusInternalServerError)
+		return
+	}
+	quizzes.Lock()
+	s := quizzes.sessions[id]
+	if s == nil {
+		quizzes.Unlock()
+		http.Error(w, "场次不存在", http.StatusNotFound)
+		return
+	}
+	ch := make(chan struct{}, 1)
+	s.watches[ch] = true
+	if quizzes.stop == nil {
+		quizzes.stop = make(chan struct{})
+	}
+	stop := quizzes.stop
+	quizzes.Unlock()
+	defer func() {
+		quizzes.Lock()
+		delete(s.watches, ch)
+		quizzes.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	ch <- struct{}{}
+	keepalive := time.NewTicker(20 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-ch:
+			quizzes.Lock()
+			open := s.open()
+			res := s.results(open, reveal || !open)
+			quizzes.Unlock()
+			data, _ := json.Marshal(res)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+			if !open {
+				fmt.Fprint(w, "event: end\ndata: {}\n\n")
+				flusher.Flush()
+				return
+			}
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-stop:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// 场次列表（教师端）：本次运行内的场次和已保存的结果
+func handleQuizSessions(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	type sessionInfo struct {
+		ID        string `json:"id"`
+		Quiz      string `json:"quiz"`
+		Started   int64  `json:"started"`
+		Ended     int64  `json:"ended,omitempty"`
+		Responses int    `json:"responses"`
+	}
+	filter := r.URL.Query().Get("name")
+	seen := make(map[string]bool)
+	list := []sessionInfo{}
+	quizzes.Lock()
+	for _, s := range quizzes.sessions {
+		if filter == "" || s.Quiz.Name == filter {
+			list = append(list, sessionInfo{s.ID, s.Quiz.Name, s.Started, s.Ended, len(s.Responses)})
+		}
+		seen[s.ID] = true
+	}
+	quizzes.Unlock()
+	entries, _ := os.ReadDir(quizResultDir())
+	for _, e := range entries {
+		id := strings.TrimSuffix(e.Name(), ".json")
+		if seen[id] || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		var rec QuizRecord
+		if readJSONFile(filepath.Join(quizResultDir(), e.Name()), &rec) != nil {
+			continue
+		}
+		if filter == "" || rec.Quiz.Name == filter {
+			list = append(list, sessionInfo{rec.ID, rec.Quiz.Name, rec.Started, rec.Ended, len(rec.Responses)})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Started > list[j].Started })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func choiceLetters(choices []int) string {
+	var b strings.Builder
+	sorted := append([]int(nil), choices...)
+	sort.Ints(sorted)
+	for _, c := range sorted {
+		b.WriteByte(byte('A' + c))
+	}
+	return b.String()
+}
+
+// 导出 CSV：每名学生一行，各题所选选项和得分；末尾附各选项人数
+func handleQuizExport(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	rec, _, ok := findQuizRecord(r.URL.Query().Get("session"))
+	if !ok {
+		http.Error(w, "场次不存在", http.StatusNotFound)
+		return
+	}
+	questions := rec.Quiz.Questions
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(rec.Quiz.Name+"-"+rec.ID+".csv"))
+	cw := newExcelCSV(w)
+	header := []string{"学生", "班级", "学号", "提交时间"}
+	scored := 0
+	for i, qu := range questions {
+		header = append(header, fmt.Sprintf("%d. %s", i+1, qu.Text))
+		if len(qu.Answer) > 0 {
+			scored++
+		}
+	}
+	header = append(header, fmt.Sprintf("得分（满分 %d）", scored))
+	cw.Write(header)
+	for _, resp := range rec.Responses {
+		row := []string{resp.Name, resp.Class, resp.Number, time.Unix(resp.Updated, 0).Format("2006-01-02 15:04:05")}
+		score := 0
+		for i, qu := range questions {
+			var picked []int
+			if i < len(resp.Choices) {
+				picked = resp.Choices[i]
+			}
+			row = append(row, choiceLetters(picked))
+			if len(qu.Answer) > 0 && picked != nil && sameChoices(picked, qu.Answer) {
+				score++
+			}
+		}
+		row = append(row, strconv.Itoa(score))
+		cw.Write(row)
+	}
+	cw.Write(nil)
+	res := rec.results(false, true)
+	for i, qr := range res.Questions {
+		answer := "投票"
+		if !qr.Poll {
+			answer = "正确答案 " + choiceLetters(qr.Answer)
+		}
+		row := []string{fmt.Sprintf("%d. %s", i+1, qr.Text), answer}
+		for j, opt := range qr.Options {
+			row = append(row, fmt.Sprintf("%c. %s: %d", 'A'+j, opt, qr.Counts[j]))
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	auditLog(r, "quiz.export", rec.Quiz.Name, auditDetail("session", rec.ID))
+}
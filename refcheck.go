@@ -0,0 +1,547 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ===== 失效引用检查 =====
+// 书签、标签和备课方案都以相对路径引用文件，在资源管理器里重命名/移动后会悄悄失效。
+// 这里统一收集所有引用，报告找不到目标的条目，并按文件名、大小和内容哈希给出候选。
+
+// 文件指纹：引用被保存时记录，文件失踪后用于按大小/哈希寻找新位置
+type fileFingerprint struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Hash    string `json:"hash"`
+}
+
+type RelinkSuggestion struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"` // "hash", "size", "name"
+}
+
+type DanglingRef struct {
+	Kind        string             `json:"kind"`            // "marker", "tag", "lesson"
+	Source      string             `json:"source"`          // 元数据文件或方案名
+	Field       string             `json:"field,omitempty"` // 方案内的字段位置
+	Path        string             `json:"path"`
+	Suggestions []RelinkSuggestion `json:"suggestions"`
+}
+
+type CheckReport struct {
+	Checked   int           `json:"checked"`
+	Dangling  []DanglingRef `json:"dangling"`
+	Generated int64         `json:"generated"`
+}
+
+type CheckFixRequest struct {
+	Relink map[string]string `json:"relink"` // 旧路径 -> 新路径
+	Prune  []string          `json:"prune"`  // 直接删除的旧路径
+}
+
+func hashFile(absPath string) (string, error) {
+	f, err := os.Open(absPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// 为被元数据引用的文件记录指纹（在后台调用，哈希大文件可能较慢）
+func recordFingerprints(relPaths ...string) {
+	fresh := make(map[string]fileFingerprint)
+	for _, p := range relPaths {
+		info, err := os.Stat(libraryPath(p))
+		if err != nil || info.IsDir() {
+			continue
+		}
+		fresh[p] = fileFingerprint{Size: info.Size(), ModTime: info.ModTime().Unix()}
+	}
+	if len(fresh) == 0 {
+		return
+	}
+
+	fpFile := metaPath(".fire_fingerprints.json")
+	metaMu.Lock()
+	db := make(map[string]fileFingerprint)
+	readJSONFile(fpFile, &db)
+	metaMu.Unlock()
+
+	for p, fp := range fresh {
+		if old, ok := db[p]; ok && old.Size == fp.Size && old.ModTime == fp.ModTime && old.Hash != "" {
+			delete(fresh, p)
+			continue
+		}
+		hash, err := hashFile(libraryPath(p))
+		if err != nil {
+			delete(fresh, p)
+			continue
+		}
+		fp.Hash = hash
+		fresh[p] = fp
+	}
+	if len(fresh) == 0 {
+		return
+	}
+
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	db = make(map[string]fileFingerprint)
+	readJSONFile(fpFile, &db)
+	for p, fp := range fresh {
+		db[p] = fp
+	}
+	writeHiddenJSON(fpFile, db)
+}
+
+// 遍历幻灯片槽位中的素材项，fn 返回 false 时移除该项
+func walkSlotItems(slots map[string]interface{}, fn func(item map[string]interface{}) bool) {
+	for id, v := range slots {
+		switch val := v.(type) {
+		case map[string]interface{}:
+			if _, ok := val["path"]; ok && !fn(val) {
+				slots[id] = nil
+			}
+		case []interface{}:
+			kept := val[:0]
+			for _, e := range val {
+				if item, ok := e.(map[string]interface{}); ok {
+					if _, has := item["path"]; has && !fn(item) {
+						continue
+					}
+				}
+				kept = append(kept, e)
+			}
+			slots[id] = kept
+		}
+	}
+}
+
+// 方案中引用的全部素材路径
+func lessonPaths(plan LessonPlan) []string {
+	var paths []string
+	for _, slide := range plan.Slides {
+		walkSlotItems(slide.Slots, func(item map[string]interface{}) bool {
+			if p, _ := item["path"].(string); p != "" {
+				paths = append(paths, p)
+			}
+			return true
+		})
+	}
+	return paths
+}
+
+// 方案中以测验槽位引用的测验名称
+func lessonQuizzes(plan LessonPlan) []string {
+	var names []string
+	for _, slide := range plan.Slides {
+		tpl, ok := resolveSlideTemplate(slide)
+		if !ok {
+			continue
+		}
+		for _, def := range tpl.Slots {
+			name, _ := slide.Slots[def.ID].(string)
+			name = strings.TrimSpace(name)
+			if def.Type == "quiz" && name != "" && !containsString(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+func loadAllLessons() map[string]LessonPlan {
+	lessons := make(map[string]LessonPlan)
+	lessonDir := filepath.Join(rootDir, ".fire_lessons")
+	entries, err := os.ReadDir(lessonDir)
+	if err != nil {
+		return lessons
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		var plan LessonPlan
+		if err := readJSONFile(filepath.Join(lessonDir, e.Name()), &plan); err != nil {
+			continue
+		}
+		lessons[strings.TrimSuffix(e.Name(), ".json")] = plan
+	}
+	return lessons
+}
+
+// 对所有元数据中的路径执行 fn：返回新路径表示改写，keep 为 false 表示删除该引用。
+// 返回受影响的引用数量。
+func rewriteReferences(fn func(p string) (newPath string, keep bool)) (int, error) {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	changed := 0
+
+	markerFile := metaPath(".fire_markers.json")
+	markerDB := make(map[string][]Marker)
+	if err := readJSONFile(markerFile, &markerDB); err != nil {
+		return 0, err
+	}
+	newMarkers := make(map[string][]Marker)
+	for p, markers := range markerDB {
+		np, keep := fn(p)
+		if !keep {
+			changed++
+			continue
+		}
+		if np != p {
+			changed++
+		}
+		newMarkers[np] = append(newMarkers[np], markers...)
+	}
+
+	tagFile := metaPath(".fire_tags.json")
+	tagDB := make(map[string][]string)
+	if err := readJSONFile(tagFile, &tagDB); err != nil {
+		return 0, err
+	}
+	newTags := make(map[string][]string)
+	for p, tags := range tagDB {
+		np, keep := fn(p)
+		if !keep {
+			changed++
+			continue
+		}
+		if np != p {
+			changed++
+		}
+		for _, t := range tags {
+			if !containsString(newTags[np], t) {
+				newTags[np] = append(newTags[np], t)
+			}
+		}
+	}
+
+	fpFile := metaPath(".fire_fingerprints.json")
+	fpDB := make(map[string]fileFingerprint)
+	readJSONFile(fpFile, &fpDB)
+	newFPs := make(map[string]fileFingerprint)
+	for p, fp := range fpDB {
+		if np, keep := fn(p); keep {
+			newFPs[np] = fp
+		}
+	}
+
+	lessonDir := filepath.Join(rootDir, ".fire_lessons")
+	changedPlans := make(map[string]LessonPlan)
+	for name, plan := range loadAllLessons() {
+		planChanged := false
+		for _, slide := range plan.Slides {
+			walkSlotItems(slide.Slots, func(item map[string]interface{}) bool {
+				p, _ := item["path"].(string)
+				np, keep := fn(p)
+				if !keep {
+					planChanged = true
+					changed++
+					return false
+				}
+				if np != p {
+					item["path"] = np
+					planChanged = true
+					changed++
+				}
+				return true
+			})
+		}
+		if planChanged {
+			changedPlans[name] = plan
+		}
+	}
+
+	if changed == 0 {
+		return 0, nil
+	}
+	// 先写书签和标签，再逐个写备课方案：中途失败时重新执行同一操作即可补完剩下的方案，
+	// 不会出现方案已改写而书签、标签仍停在旧路径、且再也对不上的情况
+	if err := writeHiddenJSON(markerFile, newMarkers); err != nil {
+		return changed, err
+	}
+	if err := writeHiddenJSON(tagFile, newTags); err != nil {
+		return changed, err
+	}
+	writeHiddenJSON(fpFile, newFPs)
+	now := time.Now().Unix()
+	for name, plan := range changedPlans {
+		plan.Updated = now
+		if err := writeHiddenJSON(filepath.Join(lessonDir, name+".json"), plan); err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 批量改链：旧路径本身或其子路径都会被替换（支持文件夹整体移动）
+func relinkReferences(moves map[string]string) (int, error) {
+	if len(moves) == 0 {
+		return 0, nil
+	}
+	return rewriteReferences(func(p string) (string, bool) {
+		if np, ok := moves[p]; ok {
+			return np, true
+		}
+		for old, np := range moves {
+			if strings.HasPrefix(p, old+"/") {
+				return np + strings.TrimPrefix(p, old), true
+			}
+		}
+		return p, true
+	})
+}
+
+func pruneReferences(paths []string) (int, error) {
+	if len(paths) == 0 {
+		return 0, nil
+	}
+	drop := make(map[string]bool)
+	for _, p := range paths {
+		drop[p] = true
+	}
+	return rewriteReferences(func(p string) (string, bool) {
+		return p, !drop[p]
+	})
+}
+
+func refExists(relPath string) bool {
+	if relPath == "" || cleanRelPath(relPath) != relPath {
+		return false
+	}
+	absPath, ok := resolvePath(relPath)
+	if !ok {
+		return false
+	}
+	_, err := os.Stat(absPath)
+	return err == nil
+}
+
+// 候选文件索引，按小写文件名和大小分组
+type candidateIndex struct {
+	byName map[string][]string
+	bySize map[int64][]string
+	hashes map[string]string
+}
+
+func buildCandidateIndex() *candidateIndex {
+	idx := &candidateIndex{
+		byName: make(map[string][]string),
+		bySize: make(map[int64][]string),
+		hashes: make(map[string]string),
+	}
+	walkLibrary(func(rel, _ string, d fs.DirEntry) error {
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		idx.byName[strings.ToLower(d.Name())] = append(idx.byName[strings.ToLower(d.Name())], rel)
+		idx.bySize[info.Size()] = append(idx.bySize[info.Size()], rel)
+		return nil
+	})
+	return idx
+}
+
+func (idx *candidateIndex) hashOf(relPath string) string {
+	if h, ok := idx.hashes[relPath]; ok {
+		return h
+	}
+	// 内容哈希索引里有且文件未变时直接复用
+	if e, ok := fileIndex.lookup(relPath); ok {
+		if info, err := os.Stat(libraryPath(relPath)); err == nil &&
+			info.Size() == e.Size && info.ModTime().Unix() == e.ModTime {
+			idx.hashes[relPath] = e.Hash
+			return e.Hash
+		}
+	}
+	h, _ := hashFile(libraryPath(relPath))
+	idx.hashes[relPath] = h
+	return h
+}
+
+// 为失效路径寻找候选：内容哈希一致 > 大小一致 > 文件名一致
+func (idx *candidateIndex) suggest(relPath string, fp *fileFingerprint) []RelinkSuggestion {
+	var out []RelinkSuggestion
+	seen := make(map[string]bool)
+	add := func(p, reason string) {
+		if !seen[p] {
+			seen[p] = true
+			out = append(out, RelinkSuggestion{Path: p, Reason: reason})
+		}
+	}
+	if fp != nil {
+		for _, c := range idx.bySize[fp.Size] {
+			if fp.Hash != "" && idx.hashOf(c) == fp.Hash {
+				add(c, "hash")
+			}
+		}
+		for _, c := range idx.bySize[fp.Size] {
+			add(c, "size")
+		}
+	}
+	for _, c := range idx.byName[strings.ToLower(path.Base(relPath))] {
+		add(c, "name")
+	}
+	if len(out) > 5 {
+		out = out[:5]
+	}
+	return out
+}
+
+// 收集所有元数据中的路径引用（不检查是否存在）
+func collectReferences() []DanglingRef {
+	metaMu.Lock()
+	markerDB := make(map[string][]Marker)
+	readJSONFile(metaPath(".fire_markers.json"), &markerDB)
+	tagDB := make(map[string][]string)
+	readJSONFile(metaPath(".fire_tags.json"), &tagDB)
+	lessons := loadAllLessons()
+	metaMu.Unlock()
+
+	var refs []DanglingRef
+	for p := range markerDB {
+		refs = append(refs, DanglingRef{Kind: "marker", Source: ".fire_markers.json", Path: p})
+	}
+	for p := range tagDB {
+		refs = append(refs, DanglingRef{Kind: "tag", Source: ".fire_tags.json", Path: p})
+	}
+	for name, plan := range lessons {
+		for i, slide := range plan.Slides {
+			for id, v := range slide.Slots {
+				field := fmt.Sprintf("slides[%d].slots.%s", i, id)
+				switch val := v.(type) {
+				case map[string]interface{}:
+					if p, _ := val["path"].(string); p != "" {
+						refs = append(refs, DanglingRef{Kind: "lesson", Source: name, Field: field, Path: p})
+					}
+				case []interface{}:
+					for j, e := range val {
+						if item, ok := e.(map[string]interface{}); ok {
+							if p, _ := item["path"].(string); p != "" {
+								refs = append(refs, DanglingRef{Kind: "lesson", Source: name, Field: fmt.Sprintf("%s[%d]", field, j), Path: p})
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return refs
+}
+
+func checkReferences() CheckReport {
+	report := CheckReport{Dangling: []DanglingRef{}, Generated: time.Now().Unix()}
+
+	refs := collectReferences()
+	metaMu.Lock()
+	fpDB := make(map[string]fileFingerprint)
+	readJSONFile(metaPath(".fire_fingerprints.json"), &fpDB)
+	metaMu.Unlock()
+	report.Checked = len(refs)
+
+	var idx *candidateIndex
+	for _, ref := range refs {
+		if refExists(ref.Path) {
+			continue
+		}
+		if idx == nil {
+			idx = buildCandidateIndex()
+		}
+		var fp *fileFingerprint
+		if f, ok := fpDB[ref.Path]; ok {
+			fp = &f
+		}
+		ref.Suggestions = idx.suggest(ref.Path, fp)
+		if ref.Suggestions == nil {
+			ref.Suggestions = []RelinkSuggestion{}
+		}
+		report.Dangling = append(report.Dangling, ref)
+	}
+	sort.Slice(report.Dangling, func(i, j int) bool {
+		a, b := report.Dangling[i], report.Dangling[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Kind+a.Source+a.Field < b.Kind+b.Source+b.Field
+	})
+	return report
+}
+
+// 失效引用报告 API：报告会列出所有课件和书签引用的路径，仅限教师端
+func handleCheck(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(checkReferences())
+}
+
+// 批量改链 / 清理失效引用 API
+func handleCheckFix(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireTeacher(w, r) {
+		return
+	}
+	var req CheckFixRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad JSON", 400)
+		return
+	}
+	for old, np := range req.Relink {
+		if cleanRelPath(old) != old || !refExists(np) {
+			http.Error(w, "无效的改链目标: "+np, http.StatusBadRequest)
+			return
+		}
+	}
+
+	relinked, err := relinkReferences(req.Relink)
+	if err != nil {
+		logError("改链失败", err)
+		http.Error(w, "改链失败", http.StatusInternalServerError)
+		return
+	}
+	for old, np := range req.Relink {
+		auditLog(r, "refs.relink", old, "to="+np)
+	}
+	pruned, err := pruneReferences(req.Prune)
+	if err != nil {
+		logError("清理失效引用失败", err)
+		http.Error(w, "清理失败", http.StatusInternalServerError)
+		return
+	}
+	for _, p := range req.Prune {
+		auditLog(r, "refs.delete", p, "")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"relinked": relinked, "pruned": pruned})
+}
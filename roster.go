@@ -0,0 +1,904 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// ===== 学生名册 =====
+// 名册保存在 .fire_roster.json：按班级列出学生（姓名、学号），每人一个 6 位 PIN，每班一个加入码。
+// 学生在 /join 输入 PIN（扫班级二维码可先点选自己的名字，仍需输入 PIN），服务器下发签名 Cookie 作为轻量身份，
+// 之后上传、测验作答、签到都记在该学生名下（requestUser 返回「班级/姓名#学号」），无需创建账号。
+
+type RosterStudent struct {
+	Number string `json:"number,omitempty"` // 学号，可为空
+	Name   string `json:"name"`
+	PIN    string `json:"pin"`
+	Gen    int    `json:"gen,omitempty"` // 每次重置 PIN 加一，之前下发的身份 Cookie 随之失效
+}
+
+type RosterClass struct {
+	Name     string          `json:"name"`
+	JoinCode string          `json:"joinCode"` // 班级二维码中的加入码
+	Students []RosterStudent `json:"students"`
+}
+
+type rosterDB struct {
+	Secret  string                  `json:"secret"` // 身份 Cookie 的签名密钥
+	Classes map[string]*RosterClass `json:"classes"`
+}
+
+// 已加入的学生身份
+type StudentIdentity struct {
+	Class  string `json:"class"`
+	Name   string `json:"name"`
+	Number string `json:"number,omitempty"`
+}
+
+type RosterImportResult struct {
+	Classes []string `json:"classes"`
+	Added   int      `json:"added"`
+	Updated int      `json:"updated"`
+	Removed int      `json:"removed"`
+	Skipped int      `json:"skipped"` // 缺少姓名的行
+}
+
+const studentCookie = "fire_student"
+
+// 按文件版本缓存的名册
+var roster = struct {
+	sync.Mutex
+	version string
+	db      *rosterDB
+}{}
+
+// 加入失败次数，防止逐个尝试 PIN
+var joinFailures = newFailureLimiter()
+
+const rosterFileName = ".fire_roster.json"
+
+func rosterFile() string {
+	return metaPath(rosterFileName)
+}
+
+// 学生在班级内的标识：有学号用学号，否则用姓名
+func (s RosterStudent) key() string {
+	if s.Number != "" {
+		return s.Number
+	}
+	return s.Name
+}
+
+func (id StudentIdentity) label() string {
+	if id.Number != "" {
+		return id.Class + "/" + id.Name + "#" + id.Number
+	}
+	return id.Class + "/" + id.Name
+}
+
+func loadRoster() *rosterDB {
+	version, _ := metaFilesVersion(rosterFile())
+	roster.Lock()
+	defer roster.Unlock()
+	if roster.db == nil || version != roster.version {
+		db := &rosterDB{}
+		readJSONFile(rosterFile(), db)
+		if db.Classes == nil {
+			db.Classes = make(map[string]*RosterClass)
+		}
+		roster.db, roster.version = db, version
+	}
+	return roster.db
+}
+
+// 在元数据锁内修改名册并写回；首次写入时生成签名密钥
+func updateRoster(fn func(db *rosterDB) error) error {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	db := &rosterDB{}
+	if err := readJSONFile(rosterFile(), db); err != nil {
+		return err
+	}
+	if db.Classes == nil {
+		db.Classes = make(map[string]*RosterClass)
+	}
+	if db.Secret == "" {
+		db.Secret = randomToken(32)
+	}
+	if err := fn(db); err != nil {
+		return err
+	}
+	return writeHiddenJSON(rosterFile(), db)
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// 生成名册内唯一的 6 位 PIN
+func newPIN(db *rosterDB) string {
+	used := make(map[string]bool)
+	for _, c := range db.Classes {
+		for _, s := range c.Students {
+			used[s.PIN] = true
+		}
+	}
+	for {
+		n, _ := rand.Int(rand.Reader, big.NewInt(900000))
+		pin := strconv.Itoa(int(n.Int64()) + 100000)
+		if !used[pin] {
+			return pin
+		}
+	}
+}
+
+// ===== 名册的备份与还原 =====
+// 备份默认不含签名密钥和 PIN（见 backup.secrets）：拿到 U 盘上的备份也无法伪造学生身份或冒用 PIN。
+
+// 去掉签名密钥和 PIN 后写入备份 zip（调用方持有 metaMu）
+func zipRosterWithoutSecrets(zw *zip.Writer) (int, error) {
+	info, err := os.Stat(rosterFile())
+	if err != nil {
+		return 0, err
+	}
+	db := &rosterDB{}
+	if err := readJSONFile(rosterFile(), db); err != nil {
+		return 0, err
+	}
+	db.Secret = ""
+	for _, c := range db.Classes {
+		for i := range c.Students {
+			c.Students[i].PIN = ""
+		}
+	}
+	data, err := json.Marshal(db)
+	if err != nil {
+		return 0, err
+	}
+	hdr := &zip.FileHeader{Name: rosterFileName, Method: zip.Deflate, Modified: info.ModTime()}
+	w, err := zw.CreateHeader(hdr)
+	if err != nil {
+		return 0, err
+	}
+	_, err = w.Write(data)
+	return 1, err
+}
+
+// 还原名册：备份中没有签名密钥时沿用本机的，已发出的身份 Cookie 继续有效；
+// 没有 PIN 的学生沿用本机同班同名同学号学生的 PIN，找不到时重新生成（调用方持有 metaMu）
+func restoreRoster(w io.Writer, src io.Reader) error {
+	db := &rosterDB{}
+	if err := json.NewDecoder(src).Decode(db); err != nil {
+		return err
+	}
+	cur := &rosterDB{}
+	readJSONFile(rosterFile(), cur)
+	if db.Secret == "" {
+		db.Secret = cur.Secret
+	}
+	if db.Secret == "" {
+		db.Secret = randomToken(32)
+	}
+	for key, c := range db.Classes {
+		old := cur.Classes[key]
+		if old == nil {
+			continue
+		}
+		for i := range c.Students {
+			s := &c.Students[i]
+			for _, o := range old.Students {
+				if s.PIN == "" && o.Name == s.Name && o.Number == s.Number {
+					s.PIN, s.Gen = o.PIN, o.Gen
+				}
+			}
+		}
+	}
+	// 沿用的 PIN 都填好之后再生成新的，避免重复
+	for _, c := range db.Classes {
+		for i := range c.Students {
+			if c.Students[i].PIN == "" {
+				c.Students[i].PIN = newPIN(db)
+			}
+		}
+	}
+	return json.NewEncoder(w).Encode(db)
+}
+
+func isValidClassName(name string) bool {
+	return name != "" && len(name) <= 64 && !strings.ContainsAny(name, "/\\\x00\r\n")
+}
+
+// ===== 表格解析 =====
+
+// 读取 CSV 或 XLSX（按文件头识别）为行列表
+func readTable(data []byte) ([][]string, error) {
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		return readXLSXRows(data)
+	}
+	data = bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF"))
+	if !utf8.Valid(data) {
+		return nil, errors.New("CSV 不是 UTF-8 编码，请在 Excel 中另存为「CSV UTF-8」或直接上传 xlsx")
+	}
+	cr := csv.NewReader(bytes.NewReader(data))
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	return cr.ReadAll()
+}
+
+type xlsxRels struct {
+	Rels []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxWorkbook struct {
+	Sheets []struct {
+		RID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxText struct {
+	T string `xml:"t"`
+	R []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxText) String() string {
+	if len(t.R) == 0 {
+		return t.T
+	}
+	var b strings.Builder
+	for _, r := range t.R {
+		b.WriteString(r.T)
+	}
+	return b.String()
+}
+
+type xlsxSheet struct {
+	Rows []struct {
+		Cells []struct {
+			Ref    string   `xml:"r,attr"`
+			Type   string   `xml:"t,attr"`
+			Value  string   `xml:"v"`
+			Inline xlsxText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+func readZipXML(files map[string]*zip.File, name string, v interface{}) error {
+	f, ok := files[name]
+	if !ok {
+		return errors.New("xlsx 缺少 " + name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return xml.NewDecoder(io.LimitReader(rc, 64<<20)).Decode(v)
+}
+
+// 列引用（如 C12）中的列号，从 0 开始
+func xlsxColumn(ref string) int {
+	col := 0
+	for _, ch := range ref {
+		if ch < 'A' || ch > 'Z' {
+			break
+		}
+		col = col*26 + int(ch-'A'+1)
+	}
+	return col - 1
+}
+
+// 读取工作簿第一个工作表。只取单元格的值，不处理公式和日期格式
+func readXLSXRows(data []byte) ([][]string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, errors.New("无法读取 xlsx: " + err.Error())
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	sheetPath := "xl/worksheets/sheet1.xml"
+	var wb xlsxWorkbook
+	var rels xlsxRels
+	if readZipXML(files, "xl/workbook.xml", &wb) == nil && len(wb.Sheets) > 0 && readZipXML(files, "xl/_rels/workbook.xml.rels", &rels) == nil {
+		for _, rel := range rels.Rels {
+			if rel.ID == wb.Sheets[0].RID {
+				if strings.HasPrefix(rel.Target, "/") {
+					sheetPath = strings.TrimPrefix(rel.Target, "/")
+				} else {
+					sheetPath = path.Join("xl", rel.Target)
+				}
+			}
+		}
+	}
+
+	var shared []string
+	var sst struct {
+		Items []xlsxText `xml:"si"`
+	}
+	if _, ok := files["xl/sharedStrings.xml"]; ok {
+		if err := readZipXML(files, "xl/sharedStrings.xml", &sst); err != nil {
+			return nil, err
+		}
+		for _, si := range sst.Items {
+			shared = append(shared, si.String())
+		}
+	}
+
+	var sheet xlsxSheet
+	if err := readZipXML(files, sheetPath, &sheet); err != nil {
+		return nil, err
+	}
+	var rows [][]string
+	for _, row := range sheet.Rows {
+		var cells []string
+		for i, c := range row.Cells {
+			col := i
+			if c.Ref != "" {
+				col = xlsxColumn(c.Ref)
+			}
+			if col < 0 || col > 1000 {
+				continue
+			}
+			for len(cells) <= col {
+				cells = append(cells, "")
+			}
+			switch c.Type {
+			case "s":
+				if n, err := strconv.Atoi(c.Value); err == nil && n >= 0 && n < len(shared) {
+					cells[col] = shared[n]
+				}
+			case "inlineStr":
+				cells[col] = c.Inline.String()
+			default:
+				cells[col] = c.Value
+			}
+		}
+		rows = append(rows, cells)
+	}
+	return rows, nil
+}
+
+// 表头别名 -> 字段
+var rosterHeaders = map[string]string{
+	"姓名": "name", "学生姓名": "name", "名字": "name", "name": "name", "student": "name",
+	"学号": "number", "学籍号": "number", "编号": "number", "number": "number", "id": "number", "student id": "number", "no": "number",
+	"班级": "class", "班": "class", "class": "class",
+}
+
+// 把表格解析为学生列表（class 为空时取表中的班级列）
+func parseRosterTable(rows [][]string, defaultClass string) (map[string][]RosterStudent, int, error) {
+	if len(rows) == 0 {
+		return nil, 0, errors.New("表格为空")
+	}
+	cols := map[string]int{}
+	for i, h := range rows[0] {
+		if field, ok := rosterHeaders[strings.ToLower(strings.TrimSpace(h))]; ok {
+			if _, dup := cols[field]; !dup {
+				cols[field] = i
+			}
+		}
+	}
+	if _, ok := cols["name"]; !ok {
+		return nil, 0, errors.New("表头缺少「姓名」列")
+	}
+	_, hasClass := cols["class"]
+	if !hasClass && defaultClass == "" {
+		return nil, 0, errors.New("表中没有「班级」列，请指定导入到哪个班级")
+	}
+	cell := func(row []string, field string) string {
+		i, ok := cols[field]
+		if !ok || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+
+	result := make(map[string][]RosterStudent)
+	skipped := 0
+	for _, row := range rows[1:] {
+		name := cell(row, "name")
+		if name == "" {
+			skipped++
+			continue
+		}
+		class := defaultClass
+		if c := cell(row, "class"); c != "" {
+			class = c
+		}
+		if !isValidClassName(class) {
+			skipped++
+			continue
+		}
+		number := strings.TrimSuffix(cell(row, "number"), ".0") // 数字单元格可能带 .0
+		result[class] = append(result[class], RosterStudent{Name: name, Number: number})
+	}
+	return result, skipped, nil
+}
+
+// 导入学生：按学号（无学号时按姓名）合并，已有学生保留 PIN；replace 时删除表中没有的学生
+func importRoster(data []byte, defaultClass string, replace bool) (RosterImportResult, error) {
+	var res RosterImportResult
+	if defaultClass != "" && !isValidClassName(defaultClass) {
+		return res, errors.New("班级名称为空或包含非法字符")
+	}
+	rows, err := readTable(data)
+	if err != nil {
+		return res, err
+	}
+	classes, skipped, err := parseRosterTable(rows, defaultClass)
+	if err != nil {
+		return res, err
+	}
+	res.Skipped = skipped
+	err = updateRoster(func(db *rosterDB) error {
+		for name, students := range classes {
+			c := db.Classes[name]
+			if c == nil {
+				c = &RosterClass{Name: name, JoinCode: randomToken(4)}
+				db.Classes[name] = c
+			}
+			existing := make(map[string]int)
+			for i, s := range c.Students {
+				existing[s.key()] = i
+			}
+			seen := make(map[string]bool)
+			for _, s := range students {
+				if seen[s.key()] {
+					continue
+				}
+				seen[s.key()] = true
+				if i, ok := existing[s.key()]; ok {
+					if c.Students[i].Name != s.Name {
+						c.Students[i].Name = s.Name
+						res.Updated++
+					}
+					continue
+				}
+				s.PIN = newPIN(db)
+				c.Students = append(c.Students, s)
+				res.Added++
+			}
+			if replace {
+				var kept []RosterStudent
+				for _, s := range c.Students {
+					if seen[s.key()] {
+						kept = append(kept, s)
+					} else {
+						res.Removed++
+					}
+				}
+				c.Students = kept
+			}
+			res.Classes = append(res.Classes, name)
+		}
+		return nil
+	})
+	sort.Strings(res.Classes)
+	return res, err
+}
+
+// 删除整个班级（student 为空）或其中一名学生
+func removeFromRoster(class, student string) error {
+	return updateRoster(func(db *rosterDB) error {
+		c := db.Classes[class]
+		if c == nil {
+			return errors.New("班级不存在: " + class)
+		}
+		if student == "" {
+			delete(db.Classes, class)
+			return nil
+		}
+		for i, s := range c.Students {
+			if s.key() == student {
+				c.Students = append(c.Students[:i], c.Students[i+1:]...)
+				return nil
+			}
+		}
+		return errors.New("学生不存在: " + student)
+	})
+}
+
+// 重新生成一名学生的 PIN（PIN 泄露时使用），返回新 PIN
+func resetPIN(class, student string) (string, error) {
+	var pin string
+	err := updateRoster(func(db *rosterDB) error {
+		c := db.Classes[class]
+		if c == nil {
+			return errors.New("班级不存在: " + class)
+		}
+		for i, s := range c.Students {
+			if s.key() == student {
+				pin = newPIN(db)
+				c.Students[i].PIN = pin
+				c.Students[i].Gen++
+				return nil
+			}
+		}
+		return errors.New("学生不存在: " + student)
+	})
+	return pin, err
+}
+
+func sortedClasses(db *rosterDB) []RosterClass {
+	var list []RosterClass
+	for _, c := range db.Classes {
+		list = append(list, *c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func findStudent(db *rosterDB, class, key string) (RosterStudent, bool) {
+	if c := db.Classes[class]; c != nil {
+		for _, s := range c.Students {
+			if s.key() == key {
+				return s, true
+			}
+		}
+	}
+	return RosterStudent{}, false
+}
+
+func classByJoinCode(db *rosterDB, code string) *RosterClass {
+	if code == "" {
+		return nil
+	}
+	for _, c := range db.Classes {
+		if secureEqual(c.JoinCode, code) {
+			return c
+		}
+	}
+	return nil
+}
+
+func secureEqual(a, b string) bool {
+	return hmac.Equal([]byte(a), []byte(b))
+}
+
+// ===== 身份 Cookie =====
+// 值为 base64(班级 \x00 学生标识 \x00 代数) + "." + HMAC。学生从名册中删除或重置 PIN 后 Cookie 随即失效
+
+func signIdentity(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func identityCookie(db *rosterDB, class string, s RosterStudent) *http.Cookie {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(class + "\x00" + s.key() + "\x00" + strconv.Itoa(s.Gen)))
+	return &http.Cookie{
+		Name:     studentCookie,
+		Value:    payload + "." + signIdentity(db.Secret, payload),
+		Path:     "/",
+		MaxAge:   180 * 24 * 3600,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// 请求携带的学生身份
+func studentIdentity(r *http.Request) (StudentIdentity, bool) {
+	c, err := r.Cookie(studentCookie)
+	if err != nil {
+		return StudentIdentity{}, false
+	}
+	payload, sig, ok := strings.Cut(c.Value, ".")
+	if !ok {
+		return StudentIdentity{}, false
+	}
+	db := loadRoster()
+	if db.Secret == "" || !secureEqual(sig, signIdentity(db.Secret, payload)) {
+		return StudentIdentity{}, false
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return StudentIdentity{}, false
+	}
+	class, rest, _ := strings.Cut(string(raw), "\x00")
+	key, gen, hasGen := strings.Cut(rest, "\x00")
+	if !hasGen {
+		gen = "0" // 升级前下发的 Cookie 不带代数，视为从未重置过
+	}
+	s, ok := findStudent(db, class, key)
+	if !ok || strconv.Itoa(s.Gen) != gen {
+		return StudentIdentity{}, false
+	}
+	return StudentIdentity{Class: class, Name: s.Name, Number: s.Number}, true
+}
+
+// 按 IP 记录失败次数，同一 IP 十分钟内失败 10 次后暂停尝试
+type failureLimiter struct {
+	sync.Mutex
+	byIP map[string][]time.Time
+}
+
+func newFailureLimiter() *failureLimiter {
+	return &failureLimiter{byIP: make(map[string][]time.Time)}
+}
+
+func (f *failureLimiter) blocked(ip string) bool {
+	f.Lock()
+	defer f.Unlock()
+	cutoff := time.Now().Add(-10 * time.Minute)
+	var recent []time.Time
+	for _, t := range f.byIP[ip] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) == 0 {
+		delete(f.byIP, ip)
+	} else {
+		f.byIP[ip] = recent
+	}
+	return len(recent) >= 10
+}
+
+func (f *failureLimiter) record(ip string) {
+	f.Lock()
+	f.byIP[ip] = append(f.byIP[ip], time.Now())
+	f.Unlock()
+}
+
+// ===== API =====
+
+// 名册（仅限教师端）：GET 列出，DELETE ?class=[&student=] 删除
+func handleRoster(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sortedClasses(loadRoster()))
+	case http.MethodDelete:
+		class, student := r.URL.Query().Get("class"), r.URL.Query().Get("student")
+		if err := removeFromRoster(class, student); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		auditLog(r, "roster.remove", class, auditDetail("student", student))
+		w.Write([]byte("OK"))
+	default:
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+	}
+}
+
+// 导入名册：请求体为 CSV 或 XLSX 文件，?class= 指定默认班级，?replace=1 删除表中没有的学生
+func handleRosterImport(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, 16<<20))
+	if err != nil {
+		http.Error(w, "读取上传内容失败", http.StatusBadRequest)
+		return
+	}
+	res, err := importRoster(data, r.URL.Query().Get("class"), r.URL.Query().Get("replace") == "1")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	auditLog(r, "roster.import", strings.Join(res.Classes, ","), auditDetail("added", res.Added, "updated", res.Updated, "removed", res.Removed))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// 重置 PIN：POST ?class=&student=
+func handleRosterPIN(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+		return
+	}
+	class, student := r.URL.Query().Get("class"), r.URL.Query().Get("student")
+	pin, err := resetPIN(class, student)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	auditLog(r, "roster.pin", class, auditDetail("student", student))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"pin": pin})
+}
+
+// 班级加入二维码：GET 获取，POST 重新生成加入码（旧二维码作废）
+func handleRosterQR(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	class := r.URL.Query().Get("class")
+	if r.Method == http.MethodPost {
+		err := updateRoster(func(db *rosterDB) error {
+			c := db.Classes[class]
+			if c == nil {
+				return errors.New("班级不存在: " + class)
+			}
+			c.JoinCode = randomToken(4)
+			return nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		auditLog(r, "roster.joincode", class, "")
+	}
+	c := loadRoster().Classes[class]
+	if c == nil {
+		http.Error(w, "班级不存在: "+class, http.StatusNotFound)
+		return
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	joinURL := fmt.Sprintf("%s://%s/join?code=%s", scheme, r.Host, url.QueryEscape(c.JoinCode))
+	png, err := qrcode.Encode(joinURL, qrcode.Medium, 256)
+	if err != nil {
+		http.Error(w, "QR Generation failed", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"class": c.Name,
+		"url":   joinURL,
+		"qr":    base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+// 导出某班的 PIN 表（CSV），打印后发给学生
+func handleRosterExport(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	class := r.URL.Query().Get("class")
+	c := loadRoster().Classes[class]
+	if c == nil {
+		http.Error(w, "班级不存在: "+class, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", "attachment; filename*=UTF-8''"+url.PathEscape(class+"-PIN.csv"))
+	cw := newExcelCSV(w)
+	cw.Write([]string{"班级", "学号", "姓名", "PIN"})
+	for _, s := range c.Students {
+		cw.Write([]string{class, s.Number, s.Name, s.PIN})
+	}
+	cw.Flush()
+	auditLog(r, "roster.export", class, "")
+}
+
+// 扫码加入时列出班级学生供点选（需要加入码，不返回 PIN）
+func handleRosterClass(w http.ResponseWriter, r *http.Request) {
+	c := classByJoinCode(loadRoster(), r.URL.Query().Get("code"))
+	if c == nil {
+		http.Error(w, "二维码已失效，请向老师重新获取", http.StatusNotFound)
+		return
+	}
+	type entry struct {
+		Key    string `json:"key"`
+		Name   string `json:"name"`
+		Number string `json:"number,omitempty"`
+	}
+	list := []entry{}
+	for _, s := range c.Students {
+		list = append(list, entry{s.key(), s.Name, s.Number})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"class": c.Name, "students": list})
+}
+
+type joinRequest struct {
+	PIN     string `json:"pin"`
+	Code    string `json:"code"`    // 班级加入码
+	Student string `json:"student"` // 扫码加入时点选的学生，须与 PIN 对应
+}
+
+// 学生加入：凭 PIN，扫码时再核对 PIN 属于所选班级和名字；成功后下发身份 Cookie
+func handleRosterJoin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+		return
+	}
+	ip := clientIP(r)
+	if joinFailures.blocked(ip) {
+		http.Error(w, "尝试次数过多，请稍后再试", http.StatusTooManyRequests)
+		return
+	}
+	var req joinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad JSON", 400)
+		return
+	}
+	db := loadRoster()
+	var class string
+	var student RosterStudent
+	found := false
+	// PIN 始终必填：二维码只负责预选班级和名字，防止扫到码的人冒充同班任何同学
+	if pin := strings.TrimSpace(req.PIN); pin != "" {
+		var qr *RosterClass
+		if req.Code != "" {
+			qr = classByJoinCode(db, req.Code)
+		}
+		for _, c := range db.Classes {
+			if req.Code != "" && (qr == nil || c.Name != qr.Name) {
+				continue
+			}
+			for _, s := range c.Students {
+				if secureEqual(s.PIN, pin) && (req.Student == "" || s.key() == req.Student) {
+					class, student, found = c.Name, s, true
+				}
+			}
+		}
+	}
+	if !found {
+		joinFailures.record(ip)
+		http.Error(w, "PIN 或二维码无效", http.StatusForbidden)
+		return
+	}
+	http.SetCookie(w, identityCookie(db, class, student))
+	id := StudentIdentity{Class: class, Name: student.Name, Number: student.Number}
+	via := "pin"
+	if req.Code != "" {
+		via = "qr"
+	}
+	// 本次请求还没有携带 Cookie，审计日志直接记新身份
+	appLog.write(LogEntry{Type: "audit", IP: ip, User: id.label(), Method: r.Method, Path: r.URL.Path, Action: "roster.join", Target: class, Detail: auditDetail("via", via)})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(id)
+}
+
+// 当前身份：GET 查询，DELETE 退出
+func handleRosterMe(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		http.SetCookie(w, &http.Cookie{Name: studentCookie, Value: "", Path: "/", MaxAge: -1})
+		w.Write([]byte("OK"))
+		return
+	}
+	id, ok := studentIdentity(r)
+	if !ok {
+		http.Error(w, "尚未加入班级", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(id)
+}
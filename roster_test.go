@@ -0,0 +1,115 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestXLSXColumn(t *testing.T) {
+	cases := map[string]int{"A1": 0, "B12": 1, "Z3": 25, "AA1": 26, "AZ9": 51, "BA1": 52, "": -1, "1": -1}
+	for ref, want := range cases {
+		if got := xlsxColumn(ref); got != want {
+			t.Errorf("xlsxColumn(%q) = %d，期望 %d", ref, got, want)
+		}
+	}
+}
+
+func makeXLSX(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func sheetXML(rows string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?><worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>` +
+		rows + `</sheetData></worksheet>`
+}
+
+func TestReadXLSXRows(t *testing.T) {
+	const (
+		workbook = `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="名单" sheetId="1" r:id="rId3"/></sheets></workbook>`
+		shared   = `<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><si><t>姓名</t></si><si><r><t>张</t></r><r><t>三</t></r></si></sst>`
+	)
+	rels := func(target string) string {
+		return `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Target="worksheets/sheet1.xml"/><Relationship Id="rId3" Target="` + target + `"/></Relationships>`
+	}
+	cases := []struct {
+		name  string
+		files map[string]string
+		want  [][]string
+		err   bool
+	}{
+		{"共享字符串与富文本", map[string]string{
+			"xl/sharedStrings.xml": shared,
+			"xl/worksheets/sheet1.xml": sheetXML(`<row r="1"><c r="A1" t="s"><v>0</v></c><c r="B1" t="inlineStr"><is><t>学号</t></is></c></row>` +
+				`<row r="2"><c r="A2" t="s"><v>1</v></c><c r="B2"><v>20240101</v></c></row>`),
+		}, [][]string{{"姓名", "学号"}, {"张三", "20240101"}}, false},
+		{"空单元格按列号补齐", map[string]string{
+			"xl/worksheets/sheet1.xml": sheetXML(`<row><c r="A1" t="inlineStr"><is><t>a</t></is></c><c r="C1"><v>3</v></c></row>`),
+		}, [][]string{{"a", "", "3"}}, false},
+		{"没有列引用时按顺序", map[string]string{
+			"xl/worksheets/sheet1.xml": sheetXML(`<row><c><v>1</v></c><c><v>2</v></c></row>`),
+		}, [][]string{{"1", "2"}}, false},
+		{"共享字符串下标越界", map[string]string{
+			"xl/sharedStrings.xml":     shared,
+			"xl/worksheets/sheet1.xml": sheetXML(`<row><c r="A1" t="s"><v>9</v></c><c r="B1" t="s"><v>-1</v></c></row>`),
+		}, [][]string{{"", ""}}, false},
+		{"列号过大的单元格被跳过", map[string]string{
+			"xl/worksheets/sheet1.xml": sheetXML(`<row><c r="A1"><v>1</v></c><c r="ZZZ1"><v>2</v></c></row>`),
+		}, [][]string{{"1"}}, false},
+		{"按工作簿关系找第一个工作表", map[string]string{
+			"xl/workbook.xml":            workbook,
+			"xl/_rels/workbook.xml.rels": rels("worksheets/sheet2.xml"),
+			"xl/worksheets/sheet1.xml":   sheetXML(`<row><c><v>错</v></c></row>`),
+			"xl/worksheets/sheet2.xml":   sheetXML(`<row><c><v>对</v></c></row>`),
+		}, [][]string{{"对"}}, false},
+		{"关系中的绝对路径", map[string]string{
+			"xl/workbook.xml":            workbook,
+			"xl/_rels/workbook.xml.rels": rels("/xl/worksheets/sheet2.xml"),
+			"xl/worksheets/sheet2.xml":   sheetXML(`<row><c><v>对</v></c></row>`),
+		}, [][]string{{"对"}}, false},
+		{"缺少工作表", map[string]string{"xl/workbook.xml": workbook}, nil, true},
+		{"工作表不是 XML", map[string]string{"xl/worksheets/sheet1.xml": "<row"}, nil, true},
+	}
+	for _, c := range cases {
+		rows, err := readTable(makeXLSX(t, c.files))
+		if (err != nil) != c.err {
+			t.Errorf("%s: 错误 %v", c.name, err)
+			continue
+		}
+		if !c.err && !reflect.DeepEqual(rows, c.want) {
+			t.Errorf("%s: 得到 %q，期望 %q", c.name, rows, c.want)
+		}
+	}
+
+	if _, err := readTable([]byte("PK\x03\x04 损坏的压缩包")); err == nil {
+		t.Error("损坏的 xlsx 没有报错")
+	}
+}
+
+func TestReadTableCSV(t *testing.T) {
+	rows, err := readTable([]byte("\xEF\xBB\xBF姓名,学号\n张三,01\n李四\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"姓名", "学号"}, {"张三", "01"}, {"李四"}}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("得到 %q，期望 %q", rows, want)
+	}
+	if _, err := readTable([]byte("\xD0\xD5\xC3\xFB,\xD1\xA7\xBA\xC5\n")); err == nil { // GBK 编码的「姓名,学号」
+		t.Error("GBK 编码的 CSV 没有报错")
+	}
+}
@@ -0,0 +1,88 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+// ===== systemd 服务 =====
+// service install 写入 /etc/systemd/system/firecloud.service 并 enable --now；
+// systemd 停止服务时发送 SIGTERM，由 serve 命令优雅退出。
+
+const systemdUnitPath = "/etc/systemd/system/firecloud.service"
+
+var (
+	errAddrInUse  error = syscall.EADDRINUSE
+	errAddrAccess error = syscall.EACCES
+)
+
+const systemdUnit = `[Unit]
+Description=FireCloud 教学云盘
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+ExecStart="%s" serve -root "%s" -addr "%s"
+Restart=on-failure
+TimeoutStopSec=%d
+AmbientCapabilities=CAP_NET_BIND_SERVICE
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// systemd 直接运行 serve 命令，不需要额外的服务入口
+func runAsService() (bool, int) {
+	return false, 0
+}
+
+func serviceInstalled() bool {
+	_, err := os.Stat(systemdUnitPath)
+	return err == nil
+}
+
+func systemctl(args ...string) error {
+	out, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %v: %v: %s", args, err, out)
+	}
+	return nil
+}
+
+func installService() error {
+	if runtime.GOOS != "linux" {
+		return errors.New("仅支持 Windows 服务和 Linux systemd")
+	}
+	if serviceInstalled() {
+		return fmt.Errorf("%s 已存在", systemdUnitPath)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	unit := fmt.Sprintf(systemdUnit, exe, rootDir, listenAddr, int(shutdownTimeout.Seconds())+5)
+	if err := os.WriteFile(systemdUnitPath, []byte(unit), 0644); err != nil {
+		return err
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	return systemctl("enable", "--now", "firecloud")
+}
+
+func uninstallService() error {
+	if !serviceInstalled() {
+		return errors.New("服务未安装")
+	}
+	systemctl("disable", "--now", "firecloud")
+	if err := os.Remove(systemdUnitPath); err != nil {
+		return err
+	}
+	return systemctl("daemon-reload")
+}
@@ -0,0 +1,134 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// ===== Windows 系统服务 =====
+// service install 把当前 EXE 注册为开机自动启动的服务，参数为 serve -root -addr；
+// 服务控制管理器启动时 serve 命令会识别出服务环境并交给 runAsService。
+
+const serviceName = "FireCloud"
+
+var (
+	errAddrInUse  error = windows.WSAEADDRINUSE
+	errAddrAccess error = windows.WSAEACCES
+)
+
+type fireService struct{}
+
+func (fireService) Execute(args []string, req <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	ln, err := startServer()
+	if err != nil {
+		return true, 1
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- serve(ln) }()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case c := <-req:
+			switch c.Cmd {
+			case svc.Interrogate:
+				status <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32((shutdownTimeout + 5*time.Second) / time.Millisecond)}
+				shutdownServer()
+				return false, 0
+			}
+		case err := <-errCh:
+			if err != nil {
+				return true, 2
+			}
+			return false, 0
+		}
+	}
+}
+
+// 由服务控制管理器启动时以服务方式运行；返回 false 表示当前不是服务环境
+func runAsService() (bool, int) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false, 0
+	}
+	if err := svc.Run(serviceName, fireService{}); err != nil {
+		logError("系统服务运行失败", err)
+		return true, 1
+	}
+	return true, 0
+}
+
+func serviceInstalled() bool {
+	m, err := mgr.Connect()
+	if err != nil {
+		return false
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return false
+	}
+	s.Close()
+	return true
+}
+
+// 注册并立即启动服务（需要管理员权限）
+func installService() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("服务 %s 已存在", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "FireCloud 教学云盘",
+		Description: "局域网教学资源共享服务",
+		StartType:   mgr.StartAutomatic,
+	}, "serve", "-root", rootDir, "-addr", listenAddr)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.Start()
+}
+
+// 停止并删除服务
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("服务 %s 未安装", serviceName)
+	}
+	defer s.Close()
+	if st, err := s.Control(svc.Stop); err == nil {
+		deadline := time.Now().Add(shutdownTimeout + 5*time.Second)
+		for st.State != svc.Stopped && time.Now().Before(deadline) {
+			time.Sleep(300 * time.Millisecond)
+			if st, err = s.Query(); err != nil {
+				break
+			}
+		}
+	}
+	return s.Delete()
+}
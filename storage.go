@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== 磁盘用量与配额 =====
+// 每个目录的累计大小由内容哈希索引的扫描结果汇总得出，上传成功后再增量修正，
+// 因此查询和配额判断都不需要重新遍历磁盘。
+
+type FolderUsage struct {
+	Name  string `json:"name"`
+	Bytes int64  `json:"bytes"`
+	Files int    `json:"files"`
+	Quota int64  `json:"quota,omitempty"`
+	Mount bool   `json:"mount,omitempty"`
+}
+
+type UploadAreaUsage struct {
+	Path     string        `json:"path"`
+	Quota    int64         `json:"quota,omitempty"`
+	Students []FolderUsage `json:"students"`
+}
+
+type StorageReport struct {
+	Total       uint64            `json:"total"`
+	Free        uint64            `json:"free"`
+	Used        uint64            `json:"used"`
+	Folders     []FolderUsage     `json:"folders"`
+	UploadAreas []UploadAreaUsage `json:"uploadAreas"`
+	Updated     int64             `json:"updated"`
+}
+
+type dirStat struct {
+	bytes int64
+	files int
+}
+
+type usageCache struct {
+	mu       sync.Mutex
+	dirs     map[string]*dirStat // 相对目录 -> 递归累计，"" 为根目录
+	ready    bool
+	updated  int64
+	gen      int          // 全量扫描的代数
+	scanning bool         // 扫描进行中：增量另记一份，扫描结果落地时重放，不被整体替换冲掉
+	deltas   []usageDelta // 本轮扫描开始以来的增量
+}
+
+type usageDelta struct {
+	path    string
+	bytes   int64
+	newFile bool
+}
+
+var storage = &usageCache{dirs: make(map[string]*dirStat)}
+
+// 文件所在的全部上级目录（含根目录 ""）
+func ancestorDirs(relPath string) []string {
+	dirs := []string{""}
+	parts := strings.Split(relPath, "/")
+	for i := 1; i < len(parts); i++ {
+		dirs = append(dirs, strings.Join(parts[:i], "/"))
+	}
+	return dirs
+}
+
+func addUsage(dirs map[string]*dirStat, relPath string, delta int64, newFile bool) {
+	for _, d := range ancestorDirs(relPath) {
+		st := dirs[d]
+		if st == nil {
+			st = &dirStat{}
+			dirs[d] = st
+		}
+		st.bytes += delta
+		if newFile {
+			st.files++
+		}
+	}
+}
+
+// 索引开始全量扫描，返回本轮的代数；此后的增量同时记入 deltas
+func (u *usageCache) beginScan() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.gen++
+	u.scanning = true
+	u.deltas = nil
+	return u.gen
+}
+
+// 扫描结束（成功或失败）后停止记录增量
+func (u *usageCache) endScan(gen int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.gen == gen {
+		u.scanning = false
+		u.deltas = nil
+	}
+}
+
+// 用第 gen 轮扫描的全量结果重建目录用量，并重放扫描期间的上传
+func (u *usageCache) rebuild(gen int, entries []IndexEntry) {
+	dirs := make(map[string]*dirStat)
+	for _, e := range entries {
+		addUsage(dirs, e.Path, e.Size, true)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.gen != gen {
+		return // 已有更新的一轮扫描
+	}
+	for _, d := range u.deltas {
+		addUsage(dirs, d.path, d.bytes, d.newFile)
+	}
+	u.dirs = dirs
+	u.ready = true
+	u.updated = time.Now().Unix()
+}
+
+// 上传或覆盖文件后按大小差值修正各级目录
+func (u *usageCache) add(relPath string, delta int64, newFile bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	addUsage(u.dirs, relPath, delta, newFile)
+	if u.scanning {
+		u.deltas = append(u.deltas, usageDelta{path: relPath, bytes: delta, newFile: newFile})
+	}
+}
+
+// 目录的递归用量；首次索引尚未完成时直接遍历该目录
+func (u *usageCache) usage(relDir string) dirStat {
+	u.mu.Lock()
+	if u.ready {
+		defer u.mu.Unlock()
+		if st := u.dirs[relDir]; st != nil {
+			return *st
+		}
+		return dirStat{}
+	}
+	u.mu.Unlock()
+
+	var st dirStat
+	filepath.WalkDir(libraryPath(relDir), func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			st.bytes += info.Size()
+			st.files++
+		}
+		return nil
+	})
+	return st
+}
+
+// 找到文件所属的学生上传目录（上传区下的第一级子文件夹）
+func studentDirOf(relPath string, areas []string) string {
+	for _, area := range areas {
+		area = cleanRelPath(area)
+		if area == "" || !strings.HasPrefix(relPath, area+"/") {
+			continue
+		}
+		rest := strings.TrimPrefix(relPath, area+"/")
+		if i := strings.Index(rest, "/"); i > 0 {
+			return area + "/" + rest[:i]
+		}
+	}
+	return ""
+}
+
+// 正在写入、尚未计入用量的字节数。配额检查把它们算作已用，并发上传不会一起越过配额
+var reserved = struct {
+	sync.Mutex
+	dirs  map[string]int64 // 相对目录 -> 预留字节
+	disks map[string]int64 // 磁盘（根目录或挂载点）-> 预留字节
+}{dirs: make(map[string]int64), disks: make(map[string]int64)}
+
+type quotaReservation struct {
+	dirs  []string
+	disk  string
+	bytes int64
+}
+
+// 写完（或失败）后释放预留，实际大小由 storage.add 计入
+func (q *quotaReservation) release() {
+	if q == nil {
+		return
+	}
+	reserved.Lock()
+	defer reserved.Unlock()
+	for _, d := range q.dirs {
+		reserved.dirs[d] -= q.bytes
+	}
+	reserved.disks[q.disk] -= q.bytes
+}
+
+// 上传前检查磁盘剩余空间和配额，通过后预留 size-existing 字节，直到调用方 release。
+// size 为待写入字节数，existing 为将被覆盖的旧文件大小；返回非空字符串表示拒绝原因。
+func checkQuota(relPath string, size, existing int64) (*quotaReservation, string) {
+	cfg := getConfig()
+	delta := size - existing
+	disk := libraryBase(relPath)
+	reserved.Lock()
+	defer reserved.Unlock()
+
+	if _, free, err := diskSpace(disk); err == nil && delta > 0 {
+		if avail := int64(free) - reserved.disks[disk]; avail-delta < cfg.MinFreeSpace {
+			return nil, fmt.Sprintf("磁盘空间不足：剩余 %s，需要 %s", formatBytes(avail), formatBytes(delta))
+		}
+	}
+
+	var dirs []string
+	if parts := strings.SplitN(relPath, "/", 2); len(parts) == 2 {
+		if limit := cfg.Quotas[parts[0]]; limit > 0 {
+			if used := storage.usage(parts[0]).bytes + reserved.dirs[parts[0]]; used+delta > limit {
+				return nil, fmt.Sprintf("文件夹「%s」超出配额：已用 %s / %s", parts[0], formatBytes(used), formatBytes(limit))
+			}
+			dirs = append(dirs, parts[0])
+		}
+	}
+
+	if cfg.StudentQuota > 0 {
+		if dir := studentDirOf(relPath, cfg.UploadAreas); dir != "" {
+			if used := storage.usage(dir).bytes + reserved.dirs[dir]; used+delta > cfg.StudentQuota {
+				return nil, fmt.Sprintf("「%s」超出个人配额：已用 %s / %s", dir, formatBytes(used), formatBytes(cfg.StudentQuota))
+			}
+			dirs = append(dirs, dir)
+		}
+	}
+	if delta <= 0 {
+		return nil, ""
+	}
+	q := &quotaReservation{dirs: dirs, disk: disk, bytes: delta}
+	for _, d := range dirs {
+		reserved.dirs[d] += delta
+	}
+	reserved.disks[disk] += delta
+	return q, ""
+}
+
+// 上传需要提前知道大小才能做配额判断
+func quotaApplies(relPath string) bool {
+	cfg := getConfig()
+	if cfg.MinFreeSpace > 0 {
+		return true
+	}
+	if parts := strings.SplitN(relPath, "/", 2); len(parts) == 2 && cfg.Quotas[parts[0]] > 0 {
+		return true
+	}
+	return cfg.StudentQuota > 0 && studentDirOf(relPath, cfg.UploadAreas) != ""
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func buildStorageReport() StorageReport {
+	cfg := getConfig()
+	report := StorageReport{Folders: []FolderUsage{}, UploadAreas: []UploadAreaUsage{}}
+	if total, free, err := diskSpace(rootDir); err == nil {
+		report.Total, report.Free, report.Used = total, free, total-free
+	}
+
+	if entries, err := os.ReadDir(rootDir); err == nil {
+		for _, e := range entries {
+			if !e.IsDir() || isMetaPath(e.Name()) || shadowedByMount(e.Name()) {
+				continue
+			}
+			st := storage.usage(e.Name())
+			report.Folders = append(report.Folders, FolderUsage{
+				Name: e.Name(), Bytes: st.bytes, Files: st.files, Quota: cfg.Quotas[e.Name()],
+			})
+		}
+	}
+	// 挂载点在各自的磁盘上，容量不计入上面的总量
+	for _, m := range activeMounts() {
+		st := storage.usage(m.Name)
+		report.Folders = append(report.Folders, FolderUsage{
+			Name: m.Name, Bytes: st.bytes, Files: st.files, Quota: cfg.Quotas[m.Name], Mount: true,
+		})
+	}
+	sort.Slice(report.Folders, func(i, j int) bool { return report.Folders[i].Bytes > report.Folders[j].Bytes })
+
+	for _, area := range cfg.UploadAreas {
+		area = cleanRelPath(area)
+		au := UploadAreaUsage{Path: area, Quota: cfg.StudentQuota, Students: []FolderUsage{}}
+		entries, _ := os.ReadDir(libraryPath(area))
+		for _, e := range entries {
+			if !e.IsDir() || isMetaPath(e.Name()) {
+				continue
+			}
+			st := storage.usage(area + "/" + e.Name())
+			au.Students = append(au.Students, FolderUsage{Name: e.Name(), Bytes: st.bytes, Files: st.files})
+		}
+		report.UploadAreas = append(report.UploadAreas, au)
+	}
+
+	storage.mu.Lock()
+	report.Updated = storage.updated
+	storage.mu.Unlock()
+	return report
+}
+
+// 存储看板 API：报告列出全部顶层文件夹（含未发布和受限挂载点）和每名学生的用量，仅限教师端
+func handleStorage(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildStorageReport())
+}
+
+// 配额设置 API
+func handleSaveQuotas(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Quotas       map[string]int64 `json:"quotas"`
+		UploadAreas  []string         `json:"uploadAreas"`
+		StudentQuota int64            `json:"studentQuota"`
+		MinFreeSpace int64            `json:"minFreeSpace"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad JSON", 400)
+		return
+	}
+	var errs []FieldError
+	for folder, limit := range req.Quotas {
+		if limit < 0 {
+			errs = append(errs, FieldError{Field: "quotas." + folder, Message: "配额不能为负数"})
+		}
+	}
+	if req.StudentQuota < 0 {
+		errs = append(errs, FieldError{Field: "studentQuota", Message: "学生配额不能为负数"})
+	}
+	if req.MinFreeSpace < 0 {
+		errs = append(errs, FieldError{Field: "minFreeSpace", Message: "最低剩余空间不能为负数"})
+	}
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+		writeValidationErrors(w, "配额设置有误", errs)
+		return
+	}
+	err := updateConfig(func(c *Config) {
+		c.Quotas = req.Quotas
+		c.UploadAreas = req.UploadAreas
+		c.StudentQuota = req.StudentQuota
+		c.MinFreeSpace = req.MinFreeSpace
+	})
+	if err != nil {
+		logError("保存配置失败", err)
+		http.Error(w, "保存配置失败", http.StatusInternalServerError)
+		return
+	}
+	auditLog(r, "quotas.save", "", auditDetail("folders", len(req.Quotas), "studentQuota", req.StudentQuota))
+	w.Write([]byte("OK"))
+}
@@ -0,0 +1,846 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== 教室间同步 =====
+// 一台 FireCloud 订阅另一台上的文件夹，定期拉取：
+// 1. 对方 /api/sync/manifest 给出文件夹内每个文件的大小、修改时间和内容哈希，以及相关的标签、书签和备课方案；
+// 2. 本机按哈希比较，内容相同的跳过，本机别处已有相同内容的直接复制，其余才下载；
+// 3. 上次同步时的哈希记在 .fire_sync.json，用来判断哪一边改过。两边都改过时修改时间较新的一方占用原路径，
+//    另一方另存为冲突副本；只有本机改过的保留本机版本。
+// 同步是单向的：本机的修改不会推回对方。
+
+type SyncSubscription struct {
+	Remote   string `json:"remote"`             // 对方地址，例如 http://192.168.1.21
+	Folder   string `json:"folder"`             // 对方的文件夹
+	Local    string `json:"local"`              // 本机文件夹，默认与 folder 相同
+	Interval int    `json:"interval,omitempty"` // 同步间隔（分钟），默认 10
+	User     string `json:"user,omitempty"`     // 对方要求登录时使用的账号
+	Password string `json:"password,omitempty"`
+}
+
+const defaultSyncInterval = 10
+
+type SyncFile struct {
+	Path    string `json:"path"` // 相对于同步文件夹
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Hash    string `json:"hash"`
+}
+
+type SyncManifest struct {
+	Folder      string              `json:"folder"`
+	Host        string              `json:"host"`
+	Files       []SyncFile          `json:"files"`
+	Tags        map[string][]string `json:"tags"`        // 键相对于同步文件夹
+	Markers     map[string][]Marker `json:"markers"`     // 同上
+	MetaUpdated int64               `json:"metaUpdated"` // 标签/书签文件的最后修改时间
+	Lessons     []LessonBundle      `json:"lessons"`     // 引用了该文件夹素材的备课方案
+}
+
+// 上次同步完成时两边一致的状态
+type syncBase struct {
+	Files    map[string]string `json:"files"`   // 路径 -> 哈希
+	Meta     map[string]string `json:"meta"`    // 路径 -> 标签与书签的摘要
+	Lessons  map[string]int64  `json:"lessons"` // 方案名 -> 对方的 updated
+	LastSync int64             `json:"lastSync"`
+}
+
+type SyncStatus struct {
+	Local      string   `json:"local"`
+	Remote     string   `json:"remote"`
+	Folder     string   `json:"folder"`
+	State      string   `json:"state"` // idle / running / error
+	LastSync   int64    `json:"lastSync,omitempty"`
+	LastError  string   `json:"lastError,omitempty"`
+	Files      int      `json:"files"`
+	Downloaded int      `json:"downloaded"`
+	Reused     int      `json:"reused"` // 本机已有相同内容，直接复制
+	Bytes      int64    `json:"bytes"`  // 实际下载的字节数
+	Deleted    int      `json:"deleted"`
+	Lessons    int      `json:"lessons"`
+	Conflicts  []string `json:"conflicts"`
+}
+
+var syncer = struct {
+	sync.Mutex
+	status map[string]*SyncStatus
+}{status: make(map[string]*SyncStatus)}
+
+var syncClient = &http.Client{Timeout: 30 * time.Minute}
+
+func syncStateFile() string {
+	return metaPath(".fire_sync.json")
+}
+
+func (s SyncSubscription) localFolder() string {
+	if s.Local != "" {
+		return cleanRelPath(s.Local)
+	}
+	return cleanRelPath(s.Folder)
+}
+
+func (s SyncSubscription) interval() time.Duration {
+	if s.Interval > 0 {
+		return time.Duration(s.Interval) * time.Minute
+	}
+	return defaultSyncInterval * time.Minute
+}
+
+// 按路径段转义，保留斜杠
+func escapeRelPath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// 文件的内容哈希，索引中记录仍有效时直接复用
+func currentHash(relPath, absPath string, info fs.FileInfo) (string, error) {
+	if e, ok := fileIndex.lookup(relPath); ok && e.Size == info.Size() && e.ModTime == info.ModTime().Unix() && e.Hash != "" {
+		return e.Hash, nil
+	}
+	return hashFile(absPath)
+}
+
+// 标签与书签的摘要，用于判断某一边是否改过
+func metaSignature(tags []string, markers []Marker) string {
+	if len(tags) == 0 && len(markers) == 0 {
+		return ""
+	}
+	sorted := append([]string(nil), tags...)
+	sort.Strings(sorted)
+	data, _ := json.Marshal(struct {
+		T []string
+		M []Marker
+	}{sorted, markers})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+func conflictSuffix(source string) string {
+	return " (冲突 " + source + " " + time.Now().Format("20060102-1504") + ")"
+}
+
+// 冲突副本的路径：第一课.mp4 -> 第一课 (冲突 来源 20261018-1504).mp4
+func conflictPath(relPath, source string) string {
+	ext := path.Ext(relPath)
+	return strings.TrimSuffix(relPath, ext) + conflictSuffix(source) + ext
+}
+
+// ===== 发布端 =====
+
+func buildSyncManifest(folder string) (SyncManifest, error) {
+	absFolder, ok := resolvePath(folder)
+	if !ok {
+		return SyncManifest{}, errors.New("禁止访问")
+	}
+	if info, err := os.Stat(absFolder); err != nil || !info.IsDir() {
+		return SyncManifest{}, errors.New("文件夹不存在: " + folder)
+	}
+	host, _ := os.Hostname()
+	m := SyncManifest{Folder: folder, Host: host, Files: []SyncFile{}, Tags: map[string][]string{}, Markers: map[string][]Marker{}, Lessons: []LessonBundle{}}
+	// 只发布列表中看得见的文件，与文件列表共用隐藏规则
+	filters := make(filterSet)
+	err := filepath.WalkDir(absFolder, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == absFolder {
+			return nil
+		}
+		rel, _ := filepath.Rel(absFolder, p)
+		rel = filepath.ToSlash(rel)
+		if filters.get(path.Dir("/" + joinRel(folder, rel))[1:]).hidden(d.Name(), d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		hash, err := currentHash(folder+"/"+rel, p, info)
+		if err != nil {
+			return nil
+		}
+		m.Files = append(m.Files, SyncFile{Path: rel, Size: info.Size(), ModTime: info.ModTime().Unix(), Hash: hash})
+		return nil
+	})
+	if err != nil {
+		return m, err
+	}
+
+	tagFile, markerFile := metaPath(".fire_tags.json"), metaPath(".fire_markers.json")
+	_, metaTime := metaFilesVersion(tagFile, markerFile)
+	m.MetaUpdated = metaTime.Unix()
+	tagDB := make(map[string][]string)
+	readJSONFile(tagFile, &tagDB)
+	markerDB := make(map[string][]Marker)
+	readJSONFile(markerFile, &markerDB)
+	prefix := folder + "/"
+	for p, tags := range tagDB {
+		if strings.HasPrefix(p, prefix) {
+			m.Tags[strings.TrimPrefix(p, prefix)] = tags
+		}
+	}
+	for p, markers := range markerDB {
+		if strings.HasPrefix(p, prefix) {
+			m.Markers[strings.TrimPrefix(p, prefix)] = markers
+		}
+	}
+
+	names := make([]string, 0)
+	lessons := loadAllLessons()
+	for name := range lessons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, p := range lessonPaths(lessons[name]) {
+			if strings.HasPrefix(p, prefix) {
+				m.Lessons = append(m.Lessons, bundleLesson(lessons[name]))
+				break
+			}
+		}
+	}
+	return m, nil
+}
+
+// 同步清单 API：GET /api/sync/manifest?path=文件夹
+func handleSyncManifest(w http.ResponseWriter, r *http.Request) {
+	folder := cleanRelPath(r.URL.Query().Get("path"))
+	if folder == "" {
+		http.Error(w, "缺少路径参数", http.StatusBadRequest)
+		return
+	}
+	if !canRead(r, folder) {
+		http.Error(w, "禁止访问", http.StatusForbidden)
+		return
+	}
+	m, err := buildSyncManifest(folder)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	// 未发布的内容不提前同步给对方
+	files := m.Files[:0]
+	for _, f := range m.Files {
+		if !hiddenFrom(r, folder+"/"+f.Path) {
+			files = append(files, f)
+		}
+	}
+	m.Files = files
+	for p := range m.Tags {
+		if hiddenFrom(r, folder+"/"+p) {
+			delete(m.Tags, p)
+		}
+	}
+	for p := range m.Markers {
+		if hiddenFrom(r, folder+"/"+p) {
+			delete(m.Markers, p)
+		}
+	}
+	lessons := m.Lessons[:0]
+	for _, b := range m.Lessons {
+		if !lessonHiddenFrom(r, b.Plan.Name) {
+			lessons = append(lessons, b)
+		}
+	}
+	m.Lessons = lessons
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+// ===== 订阅端 =====
+
+type syncRun struct {
+	ctx    context.Context // 服务停止时取消，下载随之中断
+	sub    SyncSubscription
+	local  string // 本机文件夹（虚拟路径）
+	status *SyncStatus
+	base   syncBase
+	source string // 冲突副本中标注的来源主机
+}
+
+func (s *syncRun) get(rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.sub.User != "" {
+		req.SetBasicAuth(s.sub.User, s.sub.Password)
+	}
+	resp, err := syncClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s %s", rawURL, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+func (s *syncRun) fetchManifest() (SyncManifest, error) {
+	var m SyncManifest
+	resp, err := s.get(strings.TrimRight(s.sub.Remote, "/") + "/api/sync/manifest?path=" + url.QueryEscape(cleanRelPath(s.sub.Folder)))
+	if err != nil {
+		return m, err
+	}
+	defer resp.Body.Close()
+	err = json.NewDecoder(resp.Body).Decode(&m)
+	return m, err
+}
+
+// 先写到同目录的隐藏临时文件，校验哈希后再改名，中途失败不会留下半个文件
+func (s *syncRun) writeFile(dst string, rf SyncFile, src io.Reader) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return 0, err
+	}
+	tmp := filepath.Join(filepath.Dir(dst), ".fire_sync_"+filepath.Base(dst))
+	out, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	h := sha256.New()
+	// 最多多读一个字节：比清单声明的大就是内容不符，不让对方写满磁盘
+	n, err := io.Copy(io.MultiWriter(out, h), io.LimitReader(src, rf.Size+1))
+	out.Close()
+	if err == nil && hex.EncodeToString(h.Sum(nil)) != rf.Hash {
+		err = errors.New("内容哈希不一致: " + rf.Path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	mtime := time.Unix(rf.ModTime, 0)
+	os.Chtimes(tmp, mtime, mtime)
+	os.Remove(dst)
+	return n, os.Rename(tmp, dst)
+}
+
+// 取得对方文件的内容写到本机 relPath：本机已有相同哈希的文件时直接复制。
+// 与上传一样先检查磁盘剩余空间和配额，超出时中止本次同步
+func (s *syncRun) fetchFile(rf SyncFile, relPath string) error {
+	dst := libraryPath(relPath)
+	var existing int64
+	info, statErr := os.Stat(dst)
+	if statErr == nil {
+		existing = info.Size()
+	}
+	quota, msg := checkQuota(relPath, rf.Size, existing)
+	if msg != "" {
+		return errors.New(msg)
+	}
+	defer quota.release()
+	if src, ok := fileIndex.findByHash(rf.Hash); ok {
+		if f, err := os.Open(libraryPath(src)); err == nil {
+			n, err := s.writeFile(dst, rf, f)
+			f.Close()
+			if err == nil {
+				storage.add(relPath, n-existing, statErr != nil)
+				s.status.Reused++
+				return nil
+			}
+		}
+	}
+	resp, err := s.get(strings.TrimRight(s.sub.Remote, "/") + "/files/" + escapeRelPath(cleanRelPath(s.sub.Folder)+"/"+rf.Path))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	n, err := s.writeFile(dst, rf, resp.Body)
+	if err != nil {
+		return err
+	}
+	storage.add(relPath, n-existing, statErr != nil)
+	s.status.Downloaded++
+	s.status.Bytes += n
+	return nil
+}
+
+func (s *syncRun) syncFiles(m SyncManifest) error {
+	absLocal := libraryPath(s.local)
+	remote := make(map[string]bool)
+	for _, rf := range m.Files {
+		if err := s.ctx.Err(); err != nil {
+			return err
+		}
+		rel := cleanRelPath(rf.Path)
+		if rel != rf.Path || rel == "" {
+			continue // 对方给出的路径不规范，跳过
+		}
+		remote[rel] = true
+		relPath := s.local + "/" + rel
+		absPath, ok := resolvePath(relPath)
+		if !ok || !isWithin(absLocal, absPath) {
+			continue
+		}
+		base := s.base.Files[rel]
+		info, statErr := os.Stat(absPath)
+		if statErr == nil && !info.IsDir() {
+			localHash, err := currentHash(relPath, absPath, info)
+			if err != nil {
+				return err
+			}
+			if localHash == rf.Hash {
+				s.base.Files[rel] = rf.Hash
+				continue
+			}
+			localChanged, remoteChanged := localHash != base, rf.Hash != base
+			if localChanged && !remoteChanged {
+				continue // 只有本机改过，保留本机版本
+			}
+			if localChanged && remoteChanged {
+				copyPath := conflictPath(relPath, s.source)
+				if rf.ModTime >= info.ModTime().Unix() {
+					// 对方较新：本机版本改名为冲突副本，原路径换成对方版本
+					if err := os.Rename(absPath, libraryPath(copyPath)); err != nil {
+						return err
+					}
+				} else {
+					// 本机较新：对方版本存为冲突副本
+					if err := s.fetchFile(rf, copyPath); err != nil {
+						return err
+					}
+					s.status.Conflicts = append(s.status.Conflicts, copyPath)
+					s.base.Files[rel] = rf.Hash
+					continue
+				}
+				s.status.Conflicts = append(s.status.Conflicts, copyPath)
+			}
+		}
+		if err := s.fetchFile(rf, relPath); err != nil {
+			return err
+		}
+		treeCache.touch(relPath)
+		s.base.Files[rel] = rf.Hash
+	}
+
+	// 对方已删除的文件：本机未改动过才删除
+	for rel, base := range s.base.Files {
+		if remote[rel] {
+			continue
+		}
+		delete(s.base.Files, rel)
+		relPath := s.local + "/" + rel
+		absPath := libraryPath(relPath)
+		info, err := os.Stat(absPath)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		if h, err := currentHash(relPath, absPath, info); err == nil && h == base {
+			if os.Remove(absPath) == nil {
+				s.status.Deleted++
+				treeCache.touch(relPath)
+			}
+		}
+	}
+	s.status.Files = len(m.Files)
+	return nil
+}
+
+// 标签与书签：只有一边改过时取改过的一边，两边都改过时按元数据文件的修改时间，较新的一方胜出
+func (s *syncRun) syncMeta(m SyncManifest) error {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	tagFile, markerFile := metaPath(".fire_tags.json"), metaPath(".fire_markers.json")
+	_, localTime := metaFilesVersion(tagFile, markerFile)
+	tagDB := make(map[string][]string)
+	if err := readJSONFile(tagFile, &tagDB); err != nil {
+		return err
+	}
+	markerDB := make(map[string][]Marker)
+	if err := readJSONFile(markerFile, &markerDB); err != nil {
+		return err
+	}
+
+	keys := make(map[string]bool)
+	for rel := range m.Tags {
+		keys[rel] = true
+	}
+	for rel := range m.Markers {
+		keys[rel] = true
+	}
+	for rel := range s.base.Meta {
+		keys[rel] = true
+	}
+	changed := false
+	for rel := range keys {
+		relPath := s.local + "/" + cleanRelPath(rel)
+		remoteSig := metaSignature(m.Tags[rel], m.Markers[rel])
+		localSig := metaSignature(tagDB[relPath], markerDB[relPath])
+		base := s.base.Meta[rel]
+		if remoteSig != localSig && remoteSig != base && (localSig == base || m.MetaUpdated > localTime.Unix()) {
+			if len(m.Tags[rel]) > 0 {
+				tagDB[relPath] = m.Tags[rel]
+			} else {
+				delete(tagDB, relPath)
+			}
+			if len(m.Markers[rel]) > 0 {
+				markerDB[relPath] = m.Markers[rel]
+			} else {
+				delete(markerDB, relPath)
+			}
+			changed = true
+		}
+		if remoteSig == "" {
+			delete(s.base.Meta, rel)
+		} else {
+			s.base.Meta[rel] = remoteSig
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if err := writeHiddenJSON(tagFile, tagDB); err != nil {
+		return err
+	}
+	return writeHiddenJSON(markerFile, markerDB)
+}
+
+// 备课方案按 updated 比较：两边都改过时较新的占用原名称，另一方另存为冲突副本
+func (s *syncRun) syncLessons(m SyncManifest) error {
+	folder := cleanRelPath(s.sub.Folder)
+	lessonDir := metaPath(".fire_lessons")
+	for _, bundle := range m.Lessons {
+		plan := bundle.Plan
+		if !isValidLessonName(plan.Name) {
+			continue
+		}
+		if folder != s.local {
+			for _, slide := range plan.Slides {
+				walkSlotItems(slide.Slots, func(item map[string]interface{}) bool {
+					if p, _ := item["path"].(string); strings.HasPrefix(p, folder+"/") {
+						item["path"] = s.local + strings.TrimPrefix(p, folder)
+					}
+					return true
+				})
+			}
+		}
+		base, synced := s.base.Lessons[plan.Name]
+		var local LessonPlan
+		readJSONFile(filepath.Join(lessonDir, plan.Name+".json"), &local)
+		if local.Name != "" && local.Updated == plan.Updated {
+			s.base.Lessons[plan.Name] = plan.Updated
+			continue
+		}
+		localChanged := local.Name != "" && (!synced || local.Updated != base)
+		remoteChanged := !synced || plan.Updated != base
+		if !remoteChanged {
+			continue
+		}
+		_, remap, err := installBundleTemplates(bundle.Templates)
+		if err != nil {
+			return err
+		}
+		remapTemplateVersions(&plan, remap)
+		if _, err := installBundleQuizzes(bundle.Quizzes); err != nil {
+			return err
+		}
+		target := plan
+		if localChanged {
+			copyPlan := plan
+			if local.Updated > plan.Updated {
+				copyPlan.Name = plan.Name + conflictSuffix(s.source)
+				target = copyPlan
+			} else {
+				copyPlan = local
+				copyPlan.Name = plan.Name + conflictSuffix(s.source)
+				if err := s.writeLesson(lessonDir, copyPlan); err != nil {
+					return err
+				}
+			}
+			s.status.Conflicts = append(s.status.Conflicts, "备课方案 "+copyPlan.Name)
+		}
+		if err := s.writeLesson(lessonDir, target); err != nil {
+			return err
+		}
+		s.base.Lessons[plan.Name] = plan.Updated
+		s.status.Lessons++
+	}
+	return nil
+}
+
+func (s *syncRun) writeLesson(lessonDir string, plan LessonPlan) error {
+	os.MkdirAll(lessonDir, 0755)
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	return writeHiddenJSON(filepath.Join(lessonDir, plan.Name+".json"), plan)
+}
+
+func loadSyncState() map[string]syncBase {
+	state := make(map[string]syncBase)
+	readJSONFile(syncStateFile(), &state)
+	return state
+}
+
+func saveSyncBase(local string, base syncBase) error {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	state := make(map[string]syncBase)
+	readJSONFile(syncStateFile(), &state)
+	state[local] = base
+	return writeHiddenJSON(syncStateFile(), state)
+}
+
+func syncStatusFor(sub SyncSubscription) *SyncStatus {
+	syncer.Lock()
+	defer syncer.Unlock()
+	local := sub.localFolder()
+	st := syncer.status[local]
+	if st == nil {
+		st = &SyncStatus{Local: local, State: "idle", Conflicts: []string{}}
+		if base, ok := loadSyncState()[local]; ok {
+			st.LastSync = base.LastSync
+		}
+		syncer.status[local] = st
+	}
+	st.Remote, st.Folder = sub.Remote, cleanRelPath(sub.Folder)
+	return st
+}
+
+// 执行一次同步，同一文件夹同时只跑一个
+func runSync(sub SyncSubscription) error {
+	local := sub.localFolder()
+	if local == "" || cleanRelPath(sub.Folder) == "" || sub.Remote == "" {
+		return errors.New("订阅缺少 remote / folder")
+	}
+	if m, _ := splitMount(local); m != nil && m.ReadOnly {
+		return errors.New("本机文件夹位于只读挂载点: " + local)
+	}
+	st := syncStatusFor(sub)
+	syncer.Lock()
+	if st.State == "running" {
+		syncer.Unlock()
+		return errors.New("正在同步: " + local)
+	}
+	// 运行期间在副本上累计，结束后一次性替换，状态接口不会读到一半的数据
+	run := &syncRun{ctx: backgroundCtx(), sub: sub, local: local, status: &SyncStatus{Local: local, Remote: st.Remote, Folder: st.Folder, State: "running", Conflicts: []string{}}}
+	st.State = "running"
+	syncer.Unlock()
+
+	base := loadSyncState()[local]
+	if base.Files == nil {
+		base.Files = make(map[string]string)
+	}
+	if base.Meta == nil {
+		base.Meta = make(map[string]string)
+	}
+	if base.Lessons == nil {
+		base.Lessons = make(map[string]int64)
+	}
+	run.base = base
+
+	err := func() error {
+		m, err := run.fetchManifest()
+		if err != nil {
+			return err
+		}
+		run.source = m.Host
+		if run.source == "" {
+			run.source = "remote"
+		}
+		if err := run.syncFiles(m); err != nil {
+			return err
+		}
+		if err := run.syncMeta(m); err != nil {
+			return err
+		}
+		return run.syncLessons(m)
+	}()
+	// 出错时也保存已完成部分的基准，下次不会把已同步的文件误判为冲突
+	if err == nil {
+		run.base.LastSync = time.Now().Unix()
+	}
+	if serr := saveSyncBase(local, run.base); serr != nil && err == nil {
+		err = serr
+	}
+	dataVersion.Add(1)
+
+	syncer.Lock()
+	*st = *run.status
+	st.LastSync = run.base.LastSync
+	st.State = "idle"
+	if err != nil {
+		st.State, st.LastError = "error", err.Error()
+	}
+	syncer.Unlock()
+
+	if err != nil {
+		logError("同步失败: "+local, err)
+	}
+	appLog.write(LogEntry{Type: "audit", Action: "sync.run", Target: local, Detail: auditDetail(
+		"remote", sub.Remote, "downloaded", run.status.Downloaded, "reused", run.status.Reused,
+		"deleted", run.status.Deleted, "conflicts", len(run.status.Conflicts))})
+	if run.status.Downloaded+run.status.Reused+run.status.Deleted > 0 {
+		rescanIndex()
+	}
+	return err
+}
+
+// 后台按各订阅的间隔同步，服务停止时退出
+func startSync() {
+	goBackground(func(ctx context.Context) {
+		for {
+			for _, sub := range getConfig().Sync {
+				if ctx.Err() != nil {
+					return
+				}
+				st := syncStatusFor(sub)
+				syncer.Lock()
+				due := st.State != "running" && time.Since(time.Unix(st.LastSync, 0)) >= sub.interval()
+				syncer.Unlock()
+				if due {
+					runSync(sub)
+				}
+			}
+			if !sleepOrStop(ctx, time.Minute) {
+				return
+			}
+		}
+	})
+}
+
+func syncStatuses() []SyncStatus {
+	list := []SyncStatus{}
+	for _, sub := range getConfig().Sync {
+		st := syncStatusFor(sub)
+		syncer.Lock()
+		list = append(list, *st)
+		syncer.Unlock()
+	}
+	return list
+}
+
+// 同步状态 API：每个订阅文件夹的最近结果（含对方地址和冲突路径，仅限教师端）
+func handleSyncStatus(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(syncStatuses())
+}
+
+// 订阅管理 API：GET 列出，POST 添加（同一本机文件夹则替换），DELETE ?local= 移除
+func handleSyncSubscriptions(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		subs := getConfig().Sync
+		list := make([]SyncSubscription, len(subs))
+		for i, s := range subs {
+			s.Password = ""
+			list[i] = s
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case http.MethodPost:
+		var sub SyncSubscription
+		if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+			http.Error(w, "Bad JSON", 400)
+			return
+		}
+		sub.Folder = cleanRelPath(sub.Folder)
+		sub.Local = sub.localFolder()
+		u, err := url.Parse(sub.Remote)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || sub.Folder == "" {
+			http.Error(w, "remote 须为 http(s) 地址，folder 不能为空", http.StatusBadRequest)
+			return
+		}
+		if _, ok := resolvePath(sub.Local); !ok || !canWrite(r, sub.Local) {
+			http.Error(w, "本机文件夹不可写: "+sub.Local, http.StatusBadRequest)
+			return
+		}
+		err = updateConfig(func(c *Config) {
+			var kept []SyncSubscription
+			for _, s := range c.Sync {
+				if s.localFolder() != sub.Local {
+					kept = append(kept, s)
+				}
+			}
+			c.Sync = append(kept, sub)
+		})
+		if err != nil {
+			http.Error(w, "保存配置失败", http.StatusInternalServerError)
+			return
+		}
+		auditLog(r, "sync.subscribe", sub.Local, auditDetail("remote", sub.Remote, "folder", sub.Folder))
+		w.Write([]byte("OK"))
+	case http.MethodDelete:
+		local := cleanRelPath(r.URL.Query().Get("local"))
+		found := false
+		err := updateConfig(func(c *Config) {
+			var kept []SyncSubscription
+			for _, s := range c.Sync {
+				if s.localFolder() == local {
+					found = true
+					continue
+				}
+				kept = append(kept, s)
+			}
+			c.Sync = kept
+		})
+		if err != nil || !found {
+			http.Error(w, "订阅不存在: "+local, http.StatusNotFound)
+			return
+		}
+		syncer.Lock()
+		delete(syncer.status, local)
+		syncer.Unlock()
+		auditLog(r, "sync.unsubscribe", local, "")
+		w.Write([]byte("OK"))
+	default:
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+	}
+}
+
+// 立即同步：POST /api/sync/run?local=文件夹，不带参数时同步全部订阅
+func handleSyncRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireTeacher(w, r) {
+		return
+	}
+	local := cleanRelPath(r.URL.Query().Get("local"))
+	started := 0
+	for _, sub := range getConfig().Sync {
+		if local == "" || sub.localFolder() == local {
+			sub := sub
+			goBackground(func(context.Context) { runSync(sub) })
+			started++
+		}
+	}
+	if started == 0 {
+		http.Error(w, "订阅不存在: "+local, http.StatusNotFound)
+		return
+	}
+	auditLog(r, "sync.trigger", local, "")
+	w.Write([]byte("OK"))
+}
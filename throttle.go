@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ===== 出口限速与公平分享 =====
+// 全班同时播放同一个视频时，少数快的笔记本会占满链路。这里对 /files/ 的学生端响应做整形：
+//   - 总出口上限按在线学生平均分配，每名学生的份额再平分给他的并发流；
+//   - 单个学生不超过 PerClientRate；
+//   - 有上传进行时预留 UploadReserve 给上传，教师机请求不受限。
+// 各速率单位均为字节/秒，0 表示不限制。
+
+type ThrottleConfig struct {
+	TotalRate     int64 `json:"totalRate"`
+	PerClientRate int64 `json:"perClientRate"`
+	UploadReserve int64 `json:"uploadReserve"`
+}
+
+const throttleChunk = 32 << 10
+
+type shapedStream struct {
+	client string
+	next   time.Time
+}
+
+type trafficShaper struct {
+	mu      sync.Mutex
+	streams map[*shapedStream]bool
+	meters  map[string]*rateMeter // 每个学生的实际速率
+	uploads atomic.Int64
+}
+
+var shaper = &trafficShaper{
+	streams: make(map[*shapedStream]bool),
+	meters:  make(map[string]*rateMeter),
+}
+
+type ClientRate struct {
+	IP      string `json:"ip"`
+	Streams int    `json:"streams"`
+	Allowed int64  `json:"allowed"` // 当前分配到的速率，0 表示不限
+	Actual  int64  `json:"actual"`
+}
+
+type ThrottleStatus struct {
+	TotalRate     int64        `json:"totalRate"`
+	PerClientRate int64        `json:"perClientRate"`
+	Uploads       int64        `json:"uploads"`
+	Clients       []ClientRate `json:"clients"`
+}
+
+func throttleEnabled() bool {
+	t := getConfig().Throttle
+	return t.TotalRate > 0 || t.PerClientRate > 0
+}
+
+func (s *trafficShaper) register(client string) *shapedStream {
+	st := &shapedStream{client: client, next: time.Now()}
+	s.mu.Lock()
+	s.streams[st] = true
+	if s.meters[client] == nil {
+		s.meters[client] = &rateMeter{}
+	}
+	s.mu.Unlock()
+	return st
+}
+
+func (s *trafficShaper) unregister(st *shapedStream) {
+	s.mu.Lock()
+	delete(s.streams, st)
+	stillActive := false
+	for other := range s.streams {
+		if other.client == st.client {
+			stillActive = true
+			break
+		}
+	}
+	if !stillActive {
+		delete(s.meters, st.client)
+	}
+	s.mu.Unlock()
+}
+
+// 计算每个学生的份额（调用方持有 s.mu）
+func (s *trafficShaper) clientShares() (map[string]int, map[string]int64) {
+	cfg := getConfig().Throttle
+	counts := make(map[string]int)
+	for st := range s.streams {
+		counts[st.client]++
+	}
+	shares := make(map[string]int64)
+	total := cfg.TotalRate
+	if total > 0 && s.uploads.Load() > 0 {
+		total -= cfg.UploadReserve
+		if floor := cfg.TotalRate / 10; total < floor {
+			total = floor // 至少保留一成给播放，避免完全卡死
+		}
+	}
+	for client := range counts {
+		var share int64
+		if total > 0 {
+			share = total / int64(len(counts))
+		}
+		if cfg.PerClientRate > 0 && (share == 0 || share > cfg.PerClientRate) {
+			share = cfg.PerClientRate
+		}
+		shares[client] = share
+	}
+	return counts, shares
+}
+
+// 为一个数据块排队，返回需要等待的时长
+func (s *trafficShaper) reserve(st *shapedStream, n int) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts, shares := s.clientShares()
+	if m := s.meters[st.client]; m != nil {
+		m.add(int64(n))
+	}
+	share := shares[st.client]
+	if share <= 0 {
+		return 0
+	}
+	rate := share / int64(counts[st.client])
+	if rate < 1024 {
+		rate = 1024
+	}
+	now := time.Now()
+	if st.next.Before(now) {
+		st.next = now
+	}
+	wait := st.next.Sub(now)
+	st.next = st.next.Add(time.Duration(int64(n) * int64(time.Second) / rate))
+	return wait
+}
+
+func (s *trafficShaper) status() ThrottleStatus {
+	cfg := getConfig().Throttle
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts, shares := s.clientShares()
+	out := ThrottleStatus{
+		TotalRate:     cfg.TotalRate,
+		PerClientRate: cfg.PerClientRate,
+		Uploads:       s.uploads.Load(),
+		Clients:       []ClientRate{},
+	}
+	for client, n := range counts {
+		cr := ClientRate{IP: client, Streams: n, Allowed: shares[client]}
+		if m := s.meters[client]; m != nil {
+			cr.Actual = m.rate()
+		}
+		out.Clients = append(out.Clients, cr)
+	}
+	sort.Slice(out.Clients, func(i, j int) bool { return out.Clients[i].IP < out.Clients[j].IP })
+	return out
+}
+
+// 按分配速率分块写出的 ResponseWriter
+type throttledWriter struct {
+	http.ResponseWriter
+	stream *shapedStream
+	done   <-chan struct{}
+}
+
+func (t *throttledWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > throttleChunk {
+			n = throttleChunk
+		}
+		if wait := shaper.reserve(t.stream, n); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-t.done:
+				timer.Stop()
+				return written, context.Canceled
+			}
+		}
+		m, err := t.ResponseWriter.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (t *throttledWriter) Flush() {
+	if f, ok := t.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// 包装文件响应；未开启限速或教师机请求时原样返回
+func shapeResponse(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	if !throttleEnabled() || isTeacherRequest(r) {
+		return w, func() {}
+	}
+	st := shaper.register(clientIP(r))
+	return &throttledWriter{ResponseWriter: w, stream: st, done: r.Context().Done()}, func() { shaper.unregister(st) }
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// ===== HTTPS 与本地 CA =====
+// 浏览器只在 HTTPS 下开放摄像头、剪贴板等接口。首次启用时在 .fire_tls 生成一个本地 CA，
+// 再由它签发覆盖本机所有局域网 IP 和主机名的服务器证书；IP 变化后自动重签。
+// 学生设备扫码下载 /firecloud-ca.crt 安装一次即可信任。
+
+type TLSConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Addr     string `json:"addr"`     // HTTPS 监听地址，默认 ":443"
+	Redirect bool   `json:"redirect"` // 学生端的 HTTP 请求跳转到 HTTPS（证书下载除外）
+}
+
+const (
+	caCertPath   = "/firecloud-ca.crt"
+	certRecheck  = 10 * time.Minute
+	certValidity = 397 * 24 * time.Hour // 苹果设备不接受有效期更长的服务器证书
+)
+
+var tlsServer atomic.Pointer[http.Server] // 未启用或已停止时为 nil；请求处理和托盘退出会并发读写
+
+func tlsAddr() string {
+	if a := getConfig().TLS.Addr; a != "" {
+		return a
+	}
+	return ":443"
+}
+
+func tlsDir() string {
+	return metaPath(".fire_tls")
+}
+
+type certManager struct {
+	mu     sync.Mutex
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	cert   *tls.Certificate
+	leaf   *x509.Certificate
+}
+
+var certs = &certManager{}
+
+// 服务器证书应覆盖的主机名和 IP
+func certNames() ([]string, []net.IP) {
+	names := []string{"localhost", "firecloud.local"}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		names = append(names, host, strings.ToLower(host)+".local")
+	}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	ips = append(ips, localIPs()...)
+	return names, ips
+}
+
+// CA 允许签发的域名：mDNS 的 .local、localhost 和本机主机名
+func caPermittedDomains(host string) []string {
+	domains := []string{"local", "localhost"}
+	if host = strings.ToLower(host); host != "" && host != "local" && host != "localhost" {
+		domains = append(domains, host)
+	}
+	return domains
+}
+
+// CA 允许签发的 IP：回环、RFC 1918 私有地址、链路本地地址和 IPv6 唯一本地地址
+func caPermittedRanges() []*net.IPNet {
+	var ranges []*net.IPNet
+	for _, cidr := range []string{"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16",
+		"::1/128", "fc00::/7", "fe80::/10"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		ranges = append(ranges, n)
+	}
+	return ranges
+}
+
+// 去掉 CA 名称约束之外的名称和 IP（例如改过的主机名、公网地址），否则整张证书都会被客户端拒绝。
+// 没有约束的旧 CA 全部保留
+func constrainNames(ca *x509.Certificate, names []string, ips []net.IP) ([]string, []net.IP) {
+	if len(ca.PermittedDNSDomains) > 0 {
+		var kept []string
+		for _, n := range names {
+			for _, d := range ca.PermittedDNSDomains {
+				d = strings.TrimPrefix(strings.ToLower(d), ".")
+				if ln := strings.ToLower(n); ln == d || strings.HasSuffix(ln, "."+d) {
+					kept = append(kept, n)
+					break
+				}
+			}
+		}
+		names = kept
+	}
+	if len(ca.PermittedIPRanges) > 0 {
+		var kept []net.IP
+		for _, ip := range ips {
+			for _, r := range ca.PermittedIPRanges {
+				if r.Contains(ip) {
+					kept = append(kept, ip)
+					break
+				}
+			}
+		}
+		ips = kept
+	}
+	return names, ips
+}
+
+func writePEM(path, typ string, der []byte, mode os.FileMode) error {
+	return os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), mode)
+}
+
+func readPEM(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("无效的 PEM 文件: " + path)
+	}
+	return block.Bytes, nil
+}
+
+func randomSerial() *big.Int {
+	n, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 120))
+	return n
+}
+
+// 读取或生成本地 CA（调用方持有 m.mu）
+func (m *certManager) loadCA() error {
+	if m.caCert != nil {
+		return nil
+	}
+	dir := tlsDir()
+	certFile, keyFile := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	if der, err := readPEM(certFile); err == nil {
+		keyDER, err := readPEM(keyFile)
+		if err != nil {
+			return err
+		}
+		if m.caCert, err = x509.ParseCertificate(der); err != nil {
+			return err
+		}
+		m.caKey, err = x509.ParseECPrivateKey(keyDER)
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		exec.Command("attrib", "+h", dir).Run()
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	tpl := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "FireCloud Local CA " + host, Organization: []string{"FireCloud"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		// 学生设备信任这个 CA 后，它只能为局域网内的名称和地址签发证书，ca.key 泄露也冒充不了外部网站
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         caPermittedDomains(host),
+		PermittedIPRanges:           caPermittedRanges(),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	if err := writePEM(keyFile, "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	m.caCert, _ = x509.ParseCertificate(der)
+	m.caKey = key
+	appLog.write(LogEntry{Type: "audit", Action: "tls.ca.create", Detail: auditDetail("subject", tpl.Subject.CommonName)})
+	return nil
+}
+
+// 证书是否覆盖全部名称与 IP，且距到期还有 30 天以上
+func certCovers(leaf *x509.Certificate, names []string, ips []net.IP) bool {
+	if leaf == nil || time.Until(leaf.NotAfter) < 30*24*time.Hour {
+		return false
+	}
+	for _, n := range names {
+		if !containsString(leaf.DNSNames, n) {
+			return false
+		}
+	}
+	for _, ip := range ips {
+		found := false
+		for _, have := range leaf.IPAddresses {
+			if have.Equal(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// 确保 CA 和服务器证书可用，本机 IP 变化或即将过期时重新签发
+func (m *certManager) ensure() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.loadCA(); err != nil {
+		return err
+	}
+	names, ips := certNames()
+	names, ips = constrainNames(m.caCert, names, ips)
+	if certCovers(m.leaf, names, ips) {
+		return nil
+	}
+
+	certFile, keyFile := filepath.Join(tlsDir(), "server.crt"), filepath.Join(tlsDir(), "server.key")
+	if pair, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+		if leaf, err := x509.ParseCertificate(pair.Certificate[0]); err == nil && certCovers(leaf, names, ips) {
+			m.cert, m.leaf = &pair, leaf
+			return nil
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: names[len(names)-1], Organization: []string{"FireCloud"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     names,
+		IPAddresses:  ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, m.caCert, &key.PublicKey, m.caKey)
+	if err != nil {
+		return err
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	if err := writePEM(keyFile, "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return err
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		return err
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	m.cert = &tls.Certificate{Certificate: [][]byte{der, m.caCert.Raw}, PrivateKey: key, Leaf: leaf}
+	m.leaf = leaf
+	var ipList []string
+	for _, ip := range ips {
+		ipList = append(ipList, ip.String())
+	}
+	appLog.write(LogEntry{Type: "audit", Action: "tls.cert.issue", Detail: auditDetail("names", strings.Join(names, ","), "ips", strings.Join(ipList, ","))})
+	return nil
+}
+
+func (m *certManager) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cert == nil {
+		return nil, errors.New("证书尚未生成")
+	}
+	return m.cert, nil
+}
+
+func (m *certManager) caFingerprint() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.caCert == nil {
+		return ""
+	}
+	sum := sha256.Sum256(m.caCert.Raw)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// 启用 HTTPS 时与 HTTP 服务并行监听。失败只记录错误，不影响 HTTP
+func startTLS(handler http.Handler) {
+	if !getConfig().TLS.Enabled {
+		return
+	}
+	if err := certs.ensure(); err != nil {
+		logError("生成 HTTPS 证书失败", err)
+		return
+	}
+	addr := tlsAddr()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		logError("HTTPS 服务启动失败", describeListenError(addr, err))
+		return
+	}
+	srv := &http.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: &tls.Config{GetCertificate: certs.getCertificate, MinVersion: tls.VersionTLS12},
+	}
+	tlsServer.Store(srv)
+	appLog.write(LogEntry{Type: "audit", Action: "server.start", Detail: auditDetail("addr", addr, "tls", true)})
+	goBackground(func(ctx context.Context) {
+		for sleepOrStop(ctx, certRecheck) {
+			if err := certs.ensure(); err != nil {
+				logError("更新 HTTPS 证书失败", err)
+			}
+		}
+	})
+	go func() {
+		if err := srv.ServeTLS(ln, "", ""); err != nil && err != http.ErrServerClosed {
+			logError("HTTPS 服务异常退出", err)
+		}
+	}()
+}
+
+// 把 r.Host 的主机部分与另一个监听地址的端口拼起来；默认端口省略
+func hostForAddr(r *http.Request, addr, defaultPort string) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	if port == "" || port == defaultPort {
+		return host
+	}
+	return host + ":" + port
+}
+
+// 学生端 HTTP 请求跳转到 HTTPS；本机访问与证书下载保持 HTTP
+func withTLSRedirect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := getConfig().TLS
+		if r.TLS != nil || !cfg.Enabled || !cfg.Redirect || tlsServer.Load() == nil ||
+			r.URL.Path == caCertPath || r.URL.Path == "/api/tls" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ip := net.ParseIP(clientIP(r)); ip != nil && ip.IsLoopback() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		target := "https://" + hostForAddr(r, tlsAddr(), "443") + r.URL.RequestURI()
+		// 不用 301/308：浏览器会永久缓存，教师关闭 HTTPS 后学生仍被送到已关闭的端口
+		http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+	})
+}
+
+// 下载 CA 证书（DER 格式，手机和 Windows 都能直接识别安装）
+func handleCACert(w http.ResponseWriter, r *http.Request) {
+	if err := certs.ensure(); err != nil {
+		logError("生成 HTTPS 证书失败", err)
+		http.Error(w, "证书生成失败", http.StatusInternalServerError)
+		return
+	}
+	certs.mu.Lock()
+	der := certs.caCert.Raw
+	certs.mu.Unlock()
+	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	w.Header().Set("Content-Disposition", `attachment; filename="firecloud-ca.crt"`)
+	w.Write(der)
+}
+
+// HTTPS 状态与证书下载二维码
+func handleTLSInfo(w http.ResponseWriter, r *http.Request) {
+	cfg := getConfig().TLS
+	info := map[string]interface{}{"enabled": cfg.Enabled, "running": tlsServer.Load() != nil}
+	if cfg.Enabled && certs.ensure() == nil {
+		caURL := "http://" + hostForAddr(r, listenAddr, "80") + caCertPath
+		info["caUrl"] = caURL
+		info["httpsUrl"] = "https://" + hostForAddr(r, tlsAddr(), "443") + "/"
+		info["fingerprint"] = certs.caFingerprint()
+		if png, err := qrcode.Encode(caURL, qrcode.Medium, 256); err == nil {
+			info["caQr"] = base64.StdEncoding.EncodeToString(png)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,124 @@
+//go:build !notray
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/getlantern/systray"
+)
+
+// ===== 托盘模式 =====
+// 双击 EXE 时的默认运行方式。无图形界面的机器请用 -tags notray 编译，或直接运行 serve 命令。
+
+// 服务启动失败的原因，非空时托盘提示不再刷新实时数字
+var startupError atomic.Value
+
+func runTray() {
+	systray.Run(onReady, onExit)
+}
+
+// 在托盘进程内启动 HTTP 服务；已安装为系统服务时由服务提供，托盘只做快捷入口
+func startTrayServer() {
+	if serviceInstalled() {
+		systray.SetTooltip("FireCloud 教学云盘 · 由系统服务提供")
+		return
+	}
+	ln, err := startServer()
+	if err != nil {
+		startupError.Store(err.Error())
+		systray.SetTooltip("FireCloud 教学云盘 · 启动失败: " + err.Error())
+		return
+	}
+	startupError.Store("")
+	go func() {
+		if err := serve(ln); err != nil {
+			startupError.Store(err.Error())
+			systray.SetTooltip("FireCloud 教学云盘 · 服务异常退出: " + err.Error())
+		}
+	}()
+}
+
+func onReady() {
+	systray.SetIcon(createFireIcon())
+	systray.SetTitle("FireCloud")
+	systray.SetTooltip("FireCloud 教学云盘 · 运行中")
+
+	mOpen := systray.AddMenuItem("🌐 打开浏览器", "打开管理页面")
+	mDir := systray.AddMenuItem("📁 打开 "+rootDir, "打开文件目录")
+	systray.AddSeparator()
+	mAutoStart := systray.AddMenuItemCheckbox("🚀 开机启动", "安装为系统服务，开机后无需登录即可使用", serviceInstalled())
+	systray.AddSeparator()
+	mInfo := systray.AddMenuItem("📡 "+getLocalIP()+listenAddr, "服务地址")
+	mInfo.Disable()
+	systray.AddSeparator()
+	mQuit := systray.AddMenuItem("❌ 退出", "关闭服务并退出")
+
+	startTrayServer()
+	go func() {
+		for range time.Tick(5 * time.Second) {
+			if msg, _ := startupError.Load().(string); msg != "" || serviceInstalled() {
+				continue
+			}
+			systray.SetTooltip(liveTooltip())
+		}
+	}()
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		openBrowser(fmt.Sprintf("http://localhost%s", listenAddr))
+	}()
+
+	// 命令行 Ctrl+C 或任务管理器结束进程时同样走优雅退出
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		systray.Quit()
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-mOpen.ClickedCh:
+				openBrowser(fmt.Sprintf("http://localhost%s", listenAddr))
+			case <-mDir.ClickedCh:
+				exec.Command("explorer", rootDir).Start()
+			case <-mAutoStart.ClickedCh:
+				if mAutoStart.Checked() {
+					if err := uninstallService(); err != nil {
+						logError("卸载系统服务失败", err)
+						systray.SetTooltip("FireCloud 教学云盘 · 关闭开机启动失败: " + err.Error())
+						continue
+					}
+					mAutoStart.Uncheck()
+					startTrayServer()
+				} else {
+					// 先让出端口，再由系统服务接管
+					shutdownServer()
+					if err := installService(); err != nil {
+						logError("安装系统服务失败", err)
+						systray.SetTooltip("FireCloud 教学云盘 · 开启开机启动失败（需要管理员权限）: " + err.Error())
+						startTrayServer()
+						continue
+					}
+					mAutoStart.Check()
+					systray.SetTooltip("FireCloud 教学云盘 · 由系统服务提供")
+				}
+			case <-mQuit.ClickedCh:
+				systray.Quit()
+			}
+		}
+	}()
+}
+
+func onExit() {
+	if !serviceInstalled() {
+		shutdownServer()
+	}
+}
@@ -0,0 +1,10 @@
+//go:build notray
+
+package main
+
+import "os"
+
+// 无图形界面的构建（go build -tags notray），双击或不带参数运行时直接以 serve 模式启动
+func runTray() {
+	os.Exit(runHeadless())
+}
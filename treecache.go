@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== 目录树缓存 =====
+// 备课编辑器的素材树只保存在内存里：每个目录记住上次读取时的 mtime，
+// 请求时先 stat 一下，只有 mtime 变了才重新 ReadDir。同一目录 2 秒内不重复检查。
+// 标签和书签按元数据文件的版本缓存，变化后才重新读取。音视频的媒体信息随目录一起读取。
+// /api/tree?path=&depth= 支持子树查询，depth 用尽处的文件夹标记为 lazy，由前端展开时再取。
+
+const treeRecheck = 2 * time.Second
+
+type cachedDir struct {
+	modTime time.Time
+	checked time.Time
+	dirs    []string              // 子文件夹名（已排序）
+	media   []string              // 出现在素材树中的文件名（已排序）
+	info    map[string]*MediaInfo // 音视频文件的媒体信息，随目录一起重新读取
+	mounts  string                // 根目录：读取时可用的挂载点，U 盘拔插后据此重建
+	rules   string                // 读取时隐藏规则的签名，.fireignore 或配置变化后重建
+}
+
+type dirTree struct {
+	mu          sync.Mutex
+	dirs        map[string]*cachedDir // 相对路径 -> 目录内容，"" 为根目录
+	gen         int64                 // 任一目录内容变化时加一
+	metaVersion string
+	tagDB       map[string][]string
+	markerDB    map[string][]Marker
+}
+
+var treeCache = &dirTree{dirs: make(map[string]*cachedDir)}
+
+func joinRel(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+func sortNames(names []string) {
+	sort.Slice(names, func(i, j int) bool { return strings.ToLower(names[i]) < strings.ToLower(names[j]) })
+}
+
+// 从缓存中移除某个目录及其全部子目录（调用方持有 t.mu）
+func (t *dirTree) dropSubtree(rel string) {
+	for k := range t.dirs {
+		if k == rel || rel == "" || strings.HasPrefix(k, rel+"/") {
+			delete(t.dirs, k)
+		}
+	}
+	t.gen++
+}
+
+// 取目录内容，必要时重新读取（调用方持有 t.mu）
+func (t *dirTree) dir(rel string) *cachedDir {
+	d := t.dirs[rel]
+	now := time.Now()
+	if d != nil && now.Sub(d.checked) < treeRecheck {
+		return d
+	}
+	abs, ok := resolvePath(rel)
+	if !ok {
+		return nil
+	}
+	info, err := os.Stat(abs)
+	if err != nil || !info.IsDir() {
+		if d != nil {
+			t.dropSubtree(rel)
+		}
+		return nil
+	}
+	mounts := ""
+	if rel == "" {
+		for _, m := range activeMounts() {
+			mounts += m.Name + "/"
+		}
+	}
+	filter := newListFilter(rel)
+	if d != nil && info.ModTime().Equal(d.modTime) && d.mounts == mounts && d.rules == filter.sig {
+		d.checked = now
+		return d
+	}
+
+	entries, err := os.ReadDir(abs)
+	if err != nil {
+		return nil
+	}
+	nd := &cachedDir{modTime: info.ModTime(), checked: now, mounts: mounts, rules: filter.sig, info: make(map[string]*MediaInfo)}
+	for _, e := range entries {
+		name := e.Name()
+		if filter.hidden(name, e.IsDir()) || (rel == "" && shadowedByMount(name)) {
+			continue
+		}
+		if e.IsDir() {
+			nd.dirs = append(nd.dirs, name)
+		} else if filter.inTree(name) {
+			nd.media = append(nd.media, name)
+			if fi, err := e.Info(); err == nil {
+				if m := mediaInfoFor(joinRel(rel, name), filepath.Join(abs, name), fi); m != nil {
+					nd.info[name] = m
+				}
+			}
+		}
+	}
+	if mounts != "" {
+		nd.dirs = append(nd.dirs, strings.Split(strings.TrimSuffix(mounts, "/"), "/")...)
+	}
+	sortNames(nd.dirs)
+	sortNames(nd.media)
+	if d != nil {
+		for _, old := range d.dirs {
+			if !containsString(nd.dirs, old) {
+				t.dropSubtree(joinRel(rel, old))
+			}
+		}
+	}
+	t.dirs[rel] = nd
+	t.gen++
+	return nd
+}
+
+// 子树里是否有媒体文件；没有的文件夹不出现在素材树中
+func (t *dirTree) hasMedia(rel string) bool {
+	d := t.dir(rel)
+	if d == nil {
+		return false
+	}
+	if len(d.media) > 0 {
+		return true
+	}
+	for _, name := range d.dirs {
+		if t.hasMedia(joinRel(rel, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// 标签与书签变化时重新读取（调用方持有 t.mu）
+func (t *dirTree) refreshMeta() {
+	tagFile := filepath.Join(rootDir, ".fire_tags.json")
+	markerFile := filepath.Join(rootDir, ".fire_markers.json")
+	version, _ := metaFilesVersion(tagFile, markerFile)
+	if version == t.metaVersion && t.tagDB != nil {
+		return
+	}
+	tagDB := make(map[string][]string)
+	readJSONFile(tagFile, &tagDB)
+	markerDB := make(map[string][]Marker)
+	readJSONFile(markerFile, &markerDB)
+	for p := range markerDB {
+		tagDB[p] = append(tagDB[p], "已标注")
+	}
+	t.tagDB, t.markerDB, t.metaVersion = tagDB, markerDB, version
+}
+
+// depth 为 0 表示不限层数
+func (t *dirTree) nodes(rel string, depth int) []TreeNode {
+	d := t.dir(rel)
+	if d == nil {
+		return nil
+	}
+	var nodes []TreeNode
+	for _, name := range d.dirs {
+		child := joinRel(rel, name)
+		node := TreeNode{Name: name, Path: child, IsDir: true, Tags: t.tagDB[child]}
+		if depth == 1 {
+			if !t.hasMedia(child) {
+				continue
+			}
+			node.Lazy = true
+		} else {
+			node.Children = t.nodes(child, depth-1)
+			if len(node.Children) == 0 {
+				continue
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	for _, name := range d.media {
+		child := joinRel(rel, name)
+		media := d.info[name]
+		nodes = append(nodes, TreeNode{Name: name, Path: child, Tags: t.tagDB[child],
+			Markers: flagMarkers(t.markerDB[child], media), Media: media})
+	}
+	return nodes
+}
+
+// 查询子树，同时返回可用于条件请求的 ETag
+func (t *dirTree) query(rel string, depth int) ([]TreeNode, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.refreshMeta()
+	nodes := t.nodes(rel, depth)
+	return nodes, makeETag("tree", rel, depth, t.gen, t.metaVersion)
+}
+
+// 上传等操作后让所在目录在下次请求时立即重新检查
+func (t *dirTree) touch(relFile string) {
+	dir := path.Dir(relFile)
+	if dir == "." {
+		dir = ""
+	}
+	t.mu.Lock()
+	if d := t.dirs[dir]; d != nil {
+		d.checked = time.Time{}
+	}
+	t.mu.Unlock()
+}
+
+// 获取带标签的目录树
+func handleGetTree(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	relPath := cleanRelPath(q.Get("path"))
+	if _, ok := resolveForRead(w, r, relPath); !ok {
+		return
+	}
+	depth, _ := strconv.Atoi(q.Get("depth"))
+	if depth < 0 {
+		depth = 0
+	}
+	nodes, etag := treeCache.query(relPath, depth)
+	if relPath == "" {
+		// 顶层按挂载点 ACL 过滤，ETag 随访问者身份区分
+		visible := []TreeNode{}
+		for _, n := range nodes {
+			if canRead(r, n.Path) {
+				visible = append(visible, n)
+			}
+		}
+		nodes = visible
+		etag = makeETag(etag, strings.Join(requestIdentities(r), ","))
+	}
+	if !isTeacherRequest(r) {
+		// 缓存的树对所有人相同，按定时发布规则剪掉学生看不到的部分
+		nodes = pruneHiddenNodes(r, nodes)
+		etag = makeETag(etag, visibilityState(r))
+	}
+	if notModified(w, r, etag, time.Time{}) {
+		return
+	}
+	if nodes == nil {
+		nodes = []TreeNode{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(nodes)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== 账号 =====
+// 账号保存在 .fire_users.json，密码为加盐的迭代 SHA-256（标准库没有 bcrypt）。
+// 教师账号通过 BasicAuth 登录后，与教师机本机访问享有相同权限。
+
+const passwordRounds = 10000
+
+type UserAccount struct {
+	Name    string `json:"name"`
+	Role    string `json:"role"` // "teacher" 或 "student"
+	Salt    string `json:"salt"`
+	Hash    string `json:"hash"`
+	Created int64  `json:"created"`
+}
+
+// 按文件版本缓存的账号表，以及已验证过的凭据（避免每个请求都做一万轮哈希）。
+// 错误的凭据也缓存一分钟：同一请求里 requestUser、isTeacherRequest 等会反复校验，浏览器也会重发
+var users = struct {
+	sync.Mutex
+	version  string
+	accounts map[string]UserAccount
+	verified map[string]bool
+	failed   map[string]time.Time
+}{}
+
+const failedAuthTTL = time.Minute
+
+// 密码错误次数，防止逐个尝试密码（每次尝试都要一万轮哈希）
+var authFailures = newFailureLimiter()
+
+func usersFile() string {
+	return metaPath(".fire_users.json")
+}
+
+func hashPassword(salt, password string) string {
+	sum := sha256.Sum256([]byte(salt + password))
+	for i := 1; i < passwordRounds; i++ {
+		sum = sha256.Sum256(append(sum[:], salt...))
+	}
+	return hex.EncodeToString(sum[:])
+}
+
+func isValidUserName(name string) bool {
+	return name != "" && len(name) <= 64 && !strings.ContainsAny(name, ":/\\ \t\r\n")
+}
+
+// 读取账号表（文件未变化时直接用缓存）
+func loadUsers() map[string]UserAccount {
+	version, _ := metaFilesVersion(usersFile())
+	users.Lock()
+	defer users.Unlock()
+	if users.accounts == nil || version != users.version {
+		accounts := make(map[string]UserAccount)
+		readJSONFile(usersFile(), &accounts)
+		users.accounts, users.version = accounts, version
+		users.verified, users.failed = make(map[string]bool), make(map[string]time.Time)
+	}
+	return users.accounts
+}
+
+// 在元数据锁内修改账号表并写回
+func updateUsers(fn func(accounts map[string]UserAccount) error) error {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	accounts := make(map[string]UserAccount)
+	if err := readJSONFile(usersFile(), &accounts); err != nil {
+		return err
+	}
+	if err := fn(accounts); err != nil {
+		return err
+	}
+	return writeHiddenJSON(usersFile(), accounts)
+}
+
+func newAccount(name, role, password string) (UserAccount, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return UserAccount{}, err
+	}
+	s := hex.EncodeToString(salt)
+	return UserAccount{Name: name, Role: role, Salt: s, Hash: hashPassword(s, password), Created: time.Now().Unix()}, nil
+}
+
+func addUser(name, role, password string) error {
+	if !isValidUserName(name) {
+		return errors.New("用户名为空或包含非法字符")
+	}
+	if role != "teacher" && role != "student" {
+		return errors.New("角色只能是 teacher 或 student")
+	}
+	if password == "" {
+		return errors.New("密码不能为空")
+	}
+	acct, err := newAccount(name, role, password)
+	if err != nil {
+		return err
+	}
+	return updateUsers(func(accounts map[string]UserAccount) error {
+		if _, exists := accounts[name]; exists {
+			return errors.New("用户已存在: " + name)
+		}
+		accounts[name] = acct
+		return nil
+	})
+}
+
+func setUserPassword(name, password string) error {
+	if password == "" {
+		return errors.New("密码不能为空")
+	}
+	return updateUsers(func(accounts map[string]UserAccount) error {
+		old, ok := accounts[name]
+		if !ok {
+			return errors.New("用户不存在: " + name)
+		}
+		acct, err := newAccount(name, old.Role, password)
+		if err != nil {
+			return err
+		}
+		acct.Created = old.Created
+		accounts[name] = acct
+		return nil
+	})
+}
+
+func removeUser(name string) error {
+	return updateUsers(func(accounts map[string]UserAccount) error {
+		if _, ok := accounts[name]; !ok {
+			return errors.New("用户不存在: " + name)
+		}
+		delete(accounts, name)
+		return nil
+	})
+}
+
+func listUsers() []UserAccount {
+	var list []UserAccount
+	for _, a := range loadUsers() {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// 校验 BasicAuth 凭据，返回对应账号
+func authenticate(r *http.Request) (UserAccount, bool) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return UserAccount{}, false
+	}
+	acct, ok := loadUsers()[name]
+	if !ok {
+		return UserAccount{}, false
+	}
+	sum := sha256.Sum256([]byte(acct.Salt + name + "\x00" + password)) // 缓存键不直接保存明文
+	key := hex.EncodeToString(sum[:])
+	users.Lock()
+	hit := users.verified[key]
+	failedAt, failed := users.failed[key]
+	users.Unlock()
+	if hit {
+		return acct, true
+	}
+	if failed && time.Since(failedAt) < failedAuthTTL {
+		return UserAccount{}, false
+	}
+	ip := clientIP(r)
+	if authFailures.blocked(ip) {
+		return UserAccount{}, false
+	}
+	if subtle.ConstantTimeCompare([]byte(hashPassword(acct.Salt, password)), []byte(acct.Hash)) != 1 {
+		authFailures.record(ip)
+		users.Lock()
+		now := time.Now()
+		for k, t := range users.failed {
+			if now.Sub(t) >= failedAuthTTL {
+				delete(users.failed, k)
+			}
+		}
+		users.failed[key] = now
+		users.Unlock()
+		return UserAccount{}, false
+	}
+	users.Lock()
+	users.verified[key] = true
+	users.Unlock()
+	return acct, true
+}
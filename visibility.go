@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== 定时发布 =====
+// 试卷答案、下周的素材可以提前放好，到时间才对学生可见：
+// 每个文件夹、文件或备课方案可以设置「从何时起可见」和「到何时为止可见」，两端都可以留空。
+// 规则保存在 .fire_visibility.json，文件夹的规则对其下所有内容生效。
+// 不可见的内容在列表、目录树、标签检索、备课方案列表中都不出现，直接访问返回 404；教师不受限制。
+
+type VisibilityWindow struct {
+	From  int64 `json:"from,omitempty"`  // 秒级时间戳，0 表示立即可见
+	Until int64 `json:"until,omitempty"` // 秒级时间戳，0 表示一直可见
+}
+
+type visibilityDB struct {
+	Paths   map[string]VisibilityWindow `json:"paths"`   // 素材库相对路径
+	Lessons map[string]VisibilityWindow `json:"lessons"` // 备课方案名称
+}
+
+// 教师查看的规则及其当前状态
+type VisibilityRule struct {
+	Kind   string `json:"kind"` // path / lesson
+	Target string `json:"target"`
+	VisibilityWindow
+	State string `json:"state"`          // scheduled 待发布 / visible 可见 / expired 已撤下
+	Next  int64  `json:"next,omitempty"` // 下一次状态变化的时间
+}
+
+var visibility = struct {
+	sync.Mutex
+	version string
+	db      *visibilityDB
+}{}
+
+func visibilityFile() string {
+	return metaPath(".fire_visibility.json")
+}
+
+func loadVisibility() *visibilityDB {
+	version, _ := metaFilesVersion(visibilityFile())
+	visibility.Lock()
+	defer visibility.Unlock()
+	if visibility.db == nil || version != visibility.version {
+		db := &visibilityDB{}
+		readJSONFile(visibilityFile(), db)
+		visibility.db, visibility.version = db, version
+	}
+	return visibility.db
+}
+
+func updateVisibility(fn func(db *visibilityDB)) error {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+	db := &visibilityDB{}
+	if err := readJSONFile(visibilityFile(), db); err != nil {
+		return err
+	}
+	if db.Paths == nil {
+		db.Paths = make(map[string]VisibilityWindow)
+	}
+	if db.Lessons == nil {
+		db.Lessons = make(map[string]VisibilityWindow)
+	}
+	fn(db)
+	return writeHiddenJSON(visibilityFile(), db)
+}
+
+func (v VisibilityWindow) state(now int64) string {
+	switch {
+	case v.From > 0 && now < v.From:
+		return "scheduled"
+	case v.Until > 0 && now >= v.Until:
+		return "expired"
+	}
+	return "visible"
+}
+
+func (v VisibilityWindow) hidden(now int64) bool {
+	return v.state(now) != "visible"
+}
+
+// 使路径当前不可见的规则（路径本身或任一上级文件夹）；按不区分大小写比较，与 Windows 文件系统一致
+func hidingRule(relPath string, now int64) (VisibilityWindow, bool) {
+	p := strings.ToLower(relPath)
+	for key, v := range loadVisibility().Paths {
+		k := strings.ToLower(key)
+		if (p == k || strings.HasPrefix(p, k+"/")) && v.hidden(now) {
+			return v, true
+		}
+	}
+	return VisibilityWindow{}, false
+}
+
+func pathHidden(relPath string, now int64) bool {
+	_, hidden := hidingRule(relPath, now)
+	return hidden
+}
+
+// 教师分享尚未发布的内容时给出的提示
+func releaseNotice(relPath string) string {
+	v, hidden := hidingRule(relPath, time.Now().Unix())
+	if !hidden {
+		return ""
+	}
+	if v.state(time.Now().Unix()) == "scheduled" {
+		return "尚未发布，学生要到 " + time.Unix(v.From, 0).Format("01-02 15:04") + " 后才能打开"
+	}
+	return "已撤下，学生无法打开"
+}
+
+// 对该请求隐藏的路径；教师总是可见
+func hiddenFrom(r *http.Request, relPath string) bool {
+	return relPath != "" && !isTeacherRequest(r) && pathHidden(relPath, time.Now().Unix())
+}
+
+func lessonHiddenFrom(r *http.Request, name string) bool {
+	v, ok := loadVisibility().Lessons[name]
+	return ok && !isTeacherRequest(r) && v.hidden(time.Now().Unix())
+}
+
+// 当前生效的隐藏规则，放进 ETag：规则按时间自动生效，文件和元数据都不会变化
+func visibilityState(r *http.Request) string {
+	if isTeacherRequest(r) {
+		return "teacher"
+	}
+	now := time.Now().Unix()
+	db := loadVisibility()
+	var keys []string
+	for k, v := range db.Paths {
+		if v.hidden(now) {
+			keys = append(keys, k)
+		}
+	}
+	for k, v := range db.Lessons {
+		if v.hidden(now) {
+			keys = append(keys, "lesson:"+k)
+		}
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "|")
+}
+
+// 从目录树中剪掉不可见的节点；剪完没有内容的文件夹一并去掉
+func pruneHiddenNodes(r *http.Request, nodes []TreeNode) []TreeNode {
+	var out []TreeNode
+	for _, n := range nodes {
+		if hiddenFrom(r, n.Path) {
+			continue
+		}
+		if n.IsDir && !n.Lazy {
+			n.Children = pruneHiddenNodes(r, n.Children)
+			if len(n.Children) == 0 {
+				continue
+			}
+		}
+		out = append(out, n)
+	}
+	return out
+}
+
+func visibilityRules(now int64) []VisibilityRule {
+	db := loadVisibility()
+	var rules []VisibilityRule
+	add := func(kind, target string, v VisibilityWindow) {
+		rule := VisibilityRule{Kind: kind, Target: target, VisibilityWindow: v, State: v.state(now)}
+		switch rule.State {
+		case "scheduled":
+			rule.Next = v.From
+		case "visible":
+			rule.Next = v.Until
+		}
+		rules = append(rules, rule)
+	}
+	for k, v := range db.Paths {
+		add("path", k, v)
+	}
+	for k, v := range db.Lessons {
+		add("lesson", k, v)
+	}
+	// 即将发生变化的排在前面，没有后续变化的按名称排在最后
+	sort.Slice(rules, func(i, j int) bool {
+		a, b := rules[i], rules[j]
+		if (a.Next == 0) != (b.Next == 0) {
+			return a.Next != 0
+		}
+		if a.Next != b.Next {
+			return a.Next < b.Next
+		}
+		return a.Kind+a.Target < b.Kind+b.Target
+	})
+	return rules
+}
+
+type visibilityRequest struct {
+	Kind   string `json:"kind"`
+	Target string `json:"target"`
+	VisibilityWindow
+}
+
+// GET 列出规则；POST 设置（from/until 都为 0 时删除）；DELETE ?kind=&target= 删除。仅教师可用
+func handleVisibility(w http.ResponseWriter, r *http.Request) {
+	if !requireTeacher(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		rules := visibilityRules(time.Now().Unix())
+		if rules == nil {
+			rules = []VisibilityRule{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rules)
+	case http.MethodPost, http.MethodDelete:
+		var req visibilityRequest
+		if r.Method == http.MethodPost {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Bad JSON", 400)
+				return
+			}
+		} else {
+			req.Kind, req.Target = r.URL.Query().Get("kind"), r.URL.Query().Get("target")
+		}
+		var errs []FieldError
+		switch req.Kind {
+		case "path":
+			req.Target = cleanRelPath(req.Target)
+			if _, ok := resolvePath(req.Target); !ok || req.Target == "" {
+				errs = append(errs, FieldError{Field: "target", Message: "路径无效"})
+			}
+		case "lesson":
+			if !isValidLessonName(req.Target) {
+				errs = append(errs, FieldError{Field: "target", Message: "备课方案名称无效"})
+			}
+		default:
+			errs = append(errs, FieldError{Field: "kind", Message: "类型只能是 path 或 lesson"})
+		}
+		if req.From > 0 && req.Until > 0 && req.Until <= req.From {
+			errs = append(errs, FieldError{Field: "until", Message: "结束时间必须晚于开始时间"})
+		}
+		if len(errs) > 0 {
+			writeValidationErrors(w, "定时发布设置有误", errs)
+			return
+		}
+		remove := r.Method == http.MethodDelete || (req.From == 0 && req.Until == 0)
+		err := updateVisibility(func(db *visibilityDB) {
+			rules := db.Paths
+			if req.Kind == "lesson" {
+				rules = db.Lessons
+			}
+			if remove {
+				delete(rules, req.Target)
+			} else {
+				rules[req.Target] = req.VisibilityWindow
+			}
+		})
+		if err != nil {
+			logError("写入定时发布设置失败", err)
+			http.Error(w, "保存失败", http.StatusInternalServerError)
+			return
+		}
+		if remove {
+			auditLog(r, "visibility.clear", req.Kind+":"+req.Target, "")
+		} else {
+			auditLog(r, "visibility.set", req.Kind+":"+req.Target, auditDetail("from", req.From, "until", req.Until))
+		}
+		w.Write([]byte("OK"))
+	default:
+		http.Error(w, "方法不允许", http.StatusMethodNotAllowed)
+	}
+}